@@ -1,10 +1,29 @@
 package main
 
+import "time"
+
 type Node struct {
 	Previous *Node
 	Next     *Node
 	Key      string
 	Value    string
+	Version  uint64
+	Kind     valueKind
+	Hash     map[string]string   // set when Kind is kindHash
+	List     []string            // set when Kind is kindList
+	Set      map[string]struct{} // set when Kind is kindSet
+	ZSet     map[string]float64  // set when Kind is kindZSet
+	Tags     []string            // invalidation tags, indexed by the shard
+	Size     int64               // approximate bytes, counted against the namespace quota
+	Sliding  time.Duration       // sliding expiry window; 0 for a fixed expiry or none
+
+	// Neighbours in the recency list of the node's namespace; see nsList.
+	NsPrevious *Node
+	NsNext     *Node
+
+	// Stampede protection; see freshnessLocked.
+	Grace     time.Duration // how long past its TTL the value is still served, stale
+	Recompute time.Duration // how long recomputing the value takes; enables early refresh
 }
 
 type DLL struct {
@@ -1,20 +1,79 @@
 package main
 
 import (
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"hash/fnv"
-	"log"
-	"os"
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const numShards = 16
 
-type diskSnapshot struct {
-	Data   map[string]string
-	Expiry map[string]time.Time
+// Write conditions accepted in KeyVal.Cond.
+const (
+	CondNotExists = "nx" // only write if the key is absent
+	CondExists    = "xx" // only write if the key is present
+)
+
+// ErrNotFound is wrapped by errors for missing keys and fields.
+var ErrNotFound = errors.New("not found")
+
+// ErrWrongType is returned when an operation targets a key holding a
+// different data type, e.g. Get on a hash.
+var ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+
+// ErrConflict is returned by PutIf when the write condition does not hold.
+var ErrConflict = errors.New("write condition not met")
+
+// ErrNotInteger is returned by Incr when the stored value is not an integer
+// or the result would overflow.
+var ErrNotInteger = errors.New("value is not an integer or out of range")
+
+var lastVersion atomic.Uint64
+
+// nextVersion returns a strictly increasing version for writes that arrive
+// without one (e.g. direct writes to an aux node).
+func nextVersion() uint64 {
+	for {
+		last := lastVersion.Load()
+		v := uint64(time.Now().UnixNano())
+		if v <= last {
+			v = last + 1
+		}
+		if lastVersion.CompareAndSwap(last, v) {
+			return v
+		}
+	}
+}
+
+// valueKind identifies the data type stored at a key.
+type valueKind uint8
+
+const (
+	kindString valueKind = iota
+	kindHash
+	kindList
+	kindSet
+	kindZSet
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindHash:
+		return "hash"
+	case kindList:
+		return "list"
+	case kindSet:
+		return "set"
+	case kindZSet:
+		return "zset"
+	default:
+		return "string"
+	}
 }
 
 // lruShard is one independently-locked segment of the cache.
@@ -23,12 +82,27 @@ type lruShard struct {
 	capacity int
 	bucket   map[string]*Node
 	dll      *DLL
-	expiry   map[string]time.Time
+	index    *keyIndex // the keys of bucket in lexical order, for scans
+	expiry   expiryHeap
+	expired  int64                          // keys removed because they expired
+	tags     map[string]map[string]struct{} // tag -> keys carrying it
+	usage    map[string]*nsUsage            // namespace -> what it holds here
+	quotas   map[string]Quota               // namespace -> per-shard limit
+	aof      *appendLog                     // nil unless the append-only file is enabled
+
+	// pushed is closed (and cleared) when a list in this shard gains
+	// elements, waking blocked pops. Created lazily by the first waiter.
+	pushed chan struct{}
 }
 
 type LRU struct {
-	shards   [numShards]lruShard
-	filepath string
+	shards       [numShards]lruShard
+	filepath     string
+	snapshotOpts SnapshotOptions
+	saveMu       sync.Mutex // one snapshot at a time
+	lastSnapshot snapshotStats
+	aof          *appendLog
+	refreshBeta  float64 // eagerness of early refresh; see freshnessLocked
 }
 
 func NewLRU(capacity int, filepath string) *LRU {
@@ -37,13 +111,16 @@ func NewLRU(capacity int, filepath string) *LRU {
 	if shardCap < 1 {
 		shardCap = 1
 	}
-	lru := &LRU{filepath: filepath}
+	lru := &LRU{filepath: filepath, refreshBeta: 1}
 	for i := range lru.shards {
 		lru.shards[i] = lruShard{
 			capacity: shardCap,
 			bucket:   make(map[string]*Node, shardCap),
 			dll:      NewDLL(),
-			expiry:   make(map[string]time.Time),
+			index:    newKeyIndex(),
+			expiry:   newExpiryHeap(),
+			tags:     make(map[string]map[string]struct{}),
+			usage:    make(map[string]*nsUsage),
 		}
 	}
 	return lru
@@ -60,223 +137,291 @@ func (lru *LRU) shardFor(key string) *lruShard {
 }
 
 func (lru *LRU) Get(key string) (string, error) {
+	kv, err := lru.Lookup(key)
+	return kv.Value, err
+}
+
+// Lookup returns the entry for key, including its version, and marks it as
+// most recently used. A sliding expiry is restarted and reported in the
+// entry's TTL. A value past its TTL but within its grace period is returned
+// marked stale; see freshnessLocked for when a read is told to refresh it.
+func (lru *LRU) Lookup(key string) (KeyVal, error) {
 	s := lru.shardFor(key)
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	node, ok := s.bucket[key]
-	if !ok {
-		return "", fmt.Errorf("value for the key %s not found", key)
+	node := s.liveLocked(key)
+	if node == nil {
+		return KeyVal{}, fmt.Errorf("value for the key %s %w", key, ErrNotFound)
 	}
-	if exp, hasExp := s.expiry[key]; hasExp && time.Now().After(exp) {
-		s.dll.Remove(node)
-		delete(s.bucket, key)
-		delete(s.expiry, key)
-		return "", fmt.Errorf("value for the key %s not found", key)
+	if node.Kind != kindString {
+		return KeyVal{}, ErrWrongType
 	}
-	s.dll.Remove(node)
-	s.dll.Prepend(node)
-	return node.Value, nil
+	s.touchLocked(node)
+	stale, refresh := s.freshnessLocked(node, time.Now(), lru.refreshBeta)
+	if !stale {
+		s.refreshLocked(node)
+	}
+	kv := KeyVal{Key: key, Value: node.Value, Version: node.Version, Stale: stale, Refresh: refresh}
+	if refresh {
+		// The master leases the refresh for about twice this long.
+		kv.Recompute = int(node.Recompute / time.Millisecond)
+	}
+	if node.Sliding > 0 {
+		kv.TTL, kv.Sliding = ttlSeconds(node.Sliding), true
+	}
+	return kv, nil
 }
 
 func (lru *LRU) Put(key, value string, ttlSecs int) {
 	s := lru.shardFor(key)
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.putLocked(key, value, ttlSecs)
+	s.putLocked(KeyVal{Key: key, Value: value, TTL: ttlSecs})
 }
 
-// putLocked inserts or updates a key. Caller must hold s.mu.
-func (s *lruShard) putLocked(key, value string, ttlSecs int) {
-	if node, ok := s.bucket[key]; ok {
-		node.Value = value
-		s.dll.Remove(node)
-		s.dll.Prepend(node)
-	} else {
-		if len(s.bucket) >= s.capacity {
-			tail := s.dll.Tail
-			delete(s.bucket, tail.Key)
-			delete(s.expiry, tail.Key)
-			s.dll.Remove(tail)
-		}
-		newNode := &Node{Key: key, Value: value}
-		s.bucket[key] = newNode
-		s.dll.Prepend(newNode)
+// PutIf stores kv subject to its write condition (Cond and IfVersion), which
+// is checked atomically with the write under the shard lock. It returns
+// ErrConflict when the condition does not hold.
+func (lru *LRU) PutIf(kv KeyVal) error {
+	_, err := lru.SwapIf(kv)
+	return err
+}
+
+// SwapIf is PutIf that also returns the entry the write replaced, or nil if
+// the key was absent, so the write can be undone with Revert.
+func (lru *LRU) SwapIf(kv KeyVal) (*entryRecord, error) {
+	s := lru.shardFor(kv.Key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.liveLocked(kv.Key)
+	if kv.Cond == CondNotExists && node != nil || kv.Cond == CondExists && node == nil {
+		return nil, ErrConflict
 	}
-	if ttlSecs > 0 {
-		s.expiry[key] = time.Now().Add(time.Duration(ttlSecs) * time.Second)
-	} else {
-		delete(s.expiry, key)
+	if kv.IfVersion != 0 && (node == nil || node.Version != kv.IfVersion) {
+		return nil, ErrConflict
+	}
+	var prev *entryRecord
+	if node != nil {
+		rec := s.recordLocked(node)
+		prev = &rec
 	}
+	s.putLocked(kv)
+	return prev, nil
 }
 
-// BulkPut groups entries by shard so each shard lock is acquired once.
-func (lru *LRU) BulkPut(entries []KeyVal) {
-	type kv struct {
-		key, val string
-		ttl      int
+// Revert undoes a write returned by SwapIf: if key still holds version, it
+// is put back to prev, or removed when prev is nil. It reports false when a
+// later write has replaced the entry since.
+func (lru *LRU) Revert(key string, version uint64, prev *entryRecord) bool {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.liveLocked(key)
+	if node == nil || node.Version != version {
+		return false
 	}
-	var groups [numShards][]kv
-	for _, e := range entries {
-		idx := shardIndex(e.Key)
-		groups[idx] = append(groups[idx], kv{e.Key, e.Value, e.TTL})
+	s.removeLocked(node)
+	if prev == nil || !prev.Expiry.IsZero() && time.Now().After(prev.Expiry) {
+		return true
 	}
-	for i := range lru.shards {
-		if len(groups[i]) == 0 {
-			continue
-		}
-		s := &lru.shards[i]
-		s.mu.Lock()
-		for _, e := range groups[i] {
-			s.putLocked(e.key, e.val, e.ttl)
-		}
-		s.mu.Unlock()
+	rec := *prev
+	rec.Key = key
+	node = rec.node()
+	s.insertLocked(node)
+	s.setTagsLocked(node, rec.Tags)
+	if !rec.Expiry.IsZero() {
+		s.expiry.set(key, rec.Expiry)
 	}
+	s.logWriteLocked(node)
+	return true
 }
 
-func (lru *LRU) Delete(key string) bool {
+// Incr adds delta to the integer stored at key and returns the result. A
+// missing key starts at 0 and takes ttlSecs as its expiry; an existing key
+// keeps its expiry.
+func (lru *LRU) Incr(key string, delta int64, ttlSecs int, version uint64) (int64, error) {
 	s := lru.shardFor(key)
 	s.mu.Lock()
 	defer s.mu.Unlock()
+
+	node := s.liveLocked(key)
+	if node == nil {
+		s.putLocked(KeyVal{Key: key, Value: strconv.FormatInt(delta, 10), TTL: ttlSecs, Version: version})
+		return delta, nil
+	}
+
+	if node.Kind != kindString {
+		return 0, ErrWrongType
+	}
+	curr, err := strconv.ParseInt(node.Value, 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	if delta > 0 && curr > math.MaxInt64-delta || delta < 0 && curr < math.MinInt64-delta {
+		return 0, ErrNotInteger
+	}
+	curr += delta
+
+	if version == 0 {
+		version = nextVersion()
+	}
+	node.Value = strconv.FormatInt(curr, 10)
+	node.Version = version
+	s.touchLocked(node)
+	s.resizeLocked(node)
+	s.logWriteLocked(node)
+	return curr, nil
+}
+
+// liveLocked returns the node for key, or nil if it is absent or expired.
+// Expired nodes are removed. Caller must hold s.mu.
+func (s *lruShard) liveLocked(key string) *Node {
 	node, ok := s.bucket[key]
 	if !ok {
-		return false
+		return nil
 	}
-	s.dll.Remove(node)
-	delete(s.bucket, key)
-	delete(s.expiry, key)
-	return true
+	if s.expiredLocked(key, time.Now()) {
+		s.removeLocked(node)
+		s.expired++
+		return nil
+	}
+	return node
 }
 
-func (lru *LRU) EraseCache() {
-	for i := range lru.shards {
-		s := &lru.shards[i]
-		s.mu.Lock()
-		s.dll = NewDLL()
-		s.bucket = make(map[string]*Node, s.capacity)
-		s.expiry = make(map[string]time.Time)
-		s.mu.Unlock()
-	}
+// touchLocked marks node as most recently used. Caller must hold s.mu.
+func (s *lruShard) touchLocked(node *Node) {
+	s.dll.Remove(node)
+	s.dll.Prepend(node)
+	ns, _ := splitKey(node.Key)
+	u := s.usageLocked(ns)
+	u.recent.remove(node)
+	u.recent.pushFront(node)
 }
 
-func (lru *LRU) GetAll() map[string]string {
-	result := make(map[string]string)
-	now := time.Now()
-	for i := range lru.shards {
-		s := &lru.shards[i]
-		s.mu.Lock()
-		for curr := s.dll.Head; curr != nil; curr = curr.Next {
-			if exp, hasExp := s.expiry[curr.Key]; !hasExp || now.Before(exp) {
-				result[curr.Key] = curr.Value
-			}
-		}
-		s.mu.Unlock()
+// insertLocked adds a new node as most recently used, evicting an entry if
+// the shard is full: the least recently used one of the namespace over its
+// share of the shard, see capacityVictimLocked. Entries of every data type
+// count as one unit against the capacity. The node's namespace quota is enforced
+// afterwards. Caller must hold s.mu.
+func (s *lruShard) insertLocked(node *Node) {
+	if len(s.bucket) >= s.capacity {
+		ns, _ := splitKey(node.Key)
+		s.removeLocked(s.capacityVictimLocked(ns))
 	}
-	return result
+	s.bucket[node.Key] = node
+	s.index.insert(node.Key)
+	s.dll.Prepend(node)
+	s.trackLocked(node)
+	s.enforceQuotaLocked(node)
 }
 
-// startReaper launches a background goroutine that removes expired keys every interval.
-func (lru *LRU) startReaper(interval time.Duration) {
-	go func() {
-		ticker := time.NewTicker(interval)
-		defer ticker.Stop()
-		for range ticker.C {
-			lru.reapExpired()
-		}
-	}()
+// removeLocked unlinks node and drops all index entries for it. Caller must hold s.mu.
+func (s *lruShard) removeLocked(node *Node) {
+	s.dll.Remove(node)
+	delete(s.bucket, node.Key)
+	s.index.remove(node.Key)
+	s.expiry.remove(node.Key)
+	s.setTagsLocked(node, nil)
+	s.untrackLocked(node)
+	s.logDeleteLocked(node.Key)
 }
 
-func (lru *LRU) reapExpired() {
-	now := time.Now()
-	for i := range lru.shards {
-		s := &lru.shards[i]
-		s.mu.Lock()
-		for key, exp := range s.expiry {
-			if now.After(exp) {
-				if node, ok := s.bucket[key]; ok {
-					s.dll.Remove(node)
-					delete(s.bucket, key)
-				}
-				delete(s.expiry, key)
-			}
+// putLocked inserts or updates a string key, replacing a value of any other
+// type and any previous tags and expiry. A zero kv.Version is replaced with a locally
+// generated one. Caller must hold s.mu.
+func (s *lruShard) putLocked(kv KeyVal) {
+	version := kv.Version
+	if version == 0 {
+		version = nextVersion()
+	}
+	node, ok := s.bucket[kv.Key]
+	if ok {
+		node.Kind = kindString
+		node.Value = kv.Value
+		node.Hash = nil
+		node.List = nil
+		node.Set = nil
+		node.ZSet = nil
+		node.Version = version
+		s.touchLocked(node)
+	} else {
+		node = &Node{Key: kv.Key, Value: kv.Value, Version: version}
+		s.insertLocked(node)
+	}
+	s.setTagsLocked(node, kv.Tags)
+	node.Sliding, node.Grace, node.Recompute = 0, 0, 0
+	if kv.TTL > 0 {
+		ttl := time.Duration(kv.TTL) * time.Second
+		if kv.Sliding {
+			node.Sliding = ttl
 		}
-		s.mu.Unlock()
+		if kv.Grace > 0 {
+			node.Grace = time.Duration(kv.Grace) * time.Second
+		}
+		if kv.Recompute > 0 {
+			node.Recompute = time.Duration(kv.Recompute) * time.Millisecond
+		}
+		s.expiry.set(kv.Key, time.Now().Add(ttl+node.Grace))
+	} else {
+		s.expiry.remove(kv.Key)
 	}
+	s.resizeLocked(node)
+	s.logWriteLocked(node)
 }
 
-func (lru *LRU) saveToDisk() (bool, error) {
-	snap := diskSnapshot{
-		Data:   make(map[string]string),
-		Expiry: make(map[string]time.Time),
+// BulkPut groups entries by shard so each shard lock is acquired once.
+// Write conditions are not evaluated for bulk writes.
+func (lru *LRU) BulkPut(entries []KeyVal) {
+	var groups [numShards][]KeyVal
+	for _, e := range entries {
+		idx := shardIndex(e.Key)
+		groups[idx] = append(groups[idx], e)
 	}
-
 	for i := range lru.shards {
+		if len(groups[i]) == 0 {
+			continue
+		}
 		s := &lru.shards[i]
 		s.mu.Lock()
-		for curr := s.dll.Head; curr != nil; curr = curr.Next {
-			snap.Data[curr.Key] = curr.Value
-		}
-		for k, v := range s.expiry {
-			snap.Expiry[k] = v
+		for _, e := range groups[i] {
+			s.putLocked(e)
 		}
 		s.mu.Unlock()
 	}
-
-	if len(snap.Data) == 0 {
-		return true, nil
-	}
-
-	file, err := os.OpenFile(lru.filepath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0777)
-	if err != nil {
-		return false, err
-	}
-	defer file.Close()
-
-	if err := gob.NewEncoder(file).Encode(snap); err != nil {
-		return false, err
-	}
-	log.Println("saved at: ", lru.filepath)
-	return true, nil
 }
 
-func (lru *LRU) loadFromDisk() (bool, error) {
-	file, err := os.Open(lru.filepath)
-	if err != nil {
-		return os.IsNotExist(err), err
-	}
-	defer file.Close()
-
-	var snap diskSnapshot
-	if err := gob.NewDecoder(file).Decode(&snap); err != nil {
-		return false, err
+func (lru *LRU) Delete(key string) bool {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node, ok := s.bucket[key]
+	if !ok {
+		return false
 	}
+	s.removeLocked(node)
+	return true
+}
 
-	// Group valid entries by shard to acquire each lock once.
-	type entry struct{ key, val string }
-	var groups [numShards][]entry
+// GetAll returns every live string value by its raw key, namespaced keys
+// included. Other types are left out.
+func (lru *LRU) GetAll() map[string]string {
+	result := make(map[string]string)
 	now := time.Now()
-	for k, v := range snap.Data {
-		if exp, hasExp := snap.Expiry[k]; hasExp && now.After(exp) {
-			continue // expired while server was down
-		}
-		groups[shardIndex(k)] = append(groups[shardIndex(k)], entry{k, v})
-	}
-
 	for i := range lru.shards {
-		if len(groups[i]) == 0 {
-			continue
-		}
 		s := &lru.shards[i]
 		s.mu.Lock()
-		for _, e := range groups[i] {
-			node := &Node{Key: e.key, Value: e.val}
-			s.dll.Append(node)
-			s.bucket[e.key] = node
-			if exp, ok := snap.Expiry[e.key]; ok {
-				s.expiry[e.key] = exp
+		for curr := s.dll.Head; curr != nil; curr = curr.Next {
+			if curr.Kind != kindString {
+				continue
+			}
+			if !s.expiredLocked(curr.Key, now) {
+				result[curr.Key] = curr.Value
 			}
 		}
 		s.mu.Unlock()
 	}
-	return true, nil
+	return result
 }
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Fsync policies of the append-only file.
+const (
+	FsyncAlways   = "always"   // every write is on disk before it is acknowledged
+	FsyncEverySec = "everysec" // at most one second of writes is lost on a crash
+	FsyncNever    = "never"    // the OS decides when to write
+)
+
+// defaultAOFCompactSize is the log size that triggers a compaction.
+const defaultAOFCompactSize = 64 << 20
+
+type aofOp uint8
+
+const (
+	aofSet aofOp = iota
+	aofDel
+	aofExpire
+	aofHSet
+	aofHDel
+	aofPush
+	aofPop
+	aofTrim
+	aofSAdd
+	aofSRem
+	aofZAdd
+)
+
+// aofRecord is one entry of the append-only file. A set record carries the
+// whole entry and an expire record the key's expiry and version, so
+// replaying either twice, or on top of a snapshot that already holds it, is
+// harmless.
+//
+// A typed mutation only carries its operation and arguments, so pushing
+// one element to a long list does not log the whole list. Such a record
+// holds the entry's version before (Prev) and after (Entry.Version) the
+// mutation, and replay applies it only to an entry still at Prev; a
+// mutation the snapshot already holds is skipped rather than applied twice.
+type aofRecord struct {
+	Op    aofOp
+	Entry entryRecord // the whole entry for aofSet; the key, kind and version otherwise
+	Prev  uint64      // version the mutation was applied to; 0 for a new key
+
+	Fields  map[string]string  // aofHSet
+	Members []string           // aofHDel, aofSAdd, aofSRem; the values of aofPush
+	Scores  map[string]float64 // aofZAdd
+	Left    bool               // aofPush, aofPop
+	Start   int                // aofTrim keeps the elements [Start, Stop)
+	Stop    int
+}
+
+// appendLog is an aux node's append-only file: every change to the cache is
+// appended to it, so a crash loses at most what the fsync policy allows
+// instead of everything since the last snapshot.
+//
+// Compaction folds the log into a snapshot. It first switches writes to
+// <path>.next, then saves a snapshot, which by then holds everything
+// logged to <path>, and finally renames <path>.next over <path>. A crash at
+// any point leaves a snapshot plus one or two logs that replay to the
+// same state.
+type appendLog struct {
+	mu      sync.Mutex
+	path    string
+	policy  string
+	file    *os.File
+	buf     *bufio.Writer
+	enc     *gob.Encoder
+	rotated bool  // writes go to <path>.next until the snapshot is saved
+	err     error // first write error, reported once
+	stop    chan struct{}
+
+	compactMu sync.Mutex // one compaction at a time
+}
+
+// createAppendLog starts an empty log at path, replacing any existing one.
+func createAppendLog(path, policy string) (*appendLog, error) {
+	switch policy {
+	case FsyncAlways, FsyncEverySec, FsyncNever:
+	default:
+		return nil, fmt.Errorf("unknown fsync policy %q", policy)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &appendLog{path: path, policy: policy, stop: make(chan struct{})}
+	a.setFileLocked(f)
+	if policy != FsyncAlways {
+		go a.flushEverySecond()
+	}
+	return a, nil
+}
+
+func (a *appendLog) setFileLocked(f *os.File) {
+	a.file = f
+	a.buf = bufio.NewWriter(f)
+	a.enc = gob.NewEncoder(a.buf)
+}
+
+// append writes rec to the log, syncing it first under FsyncAlways.
+func (a *appendLog) append(rec aofRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.enc.Encode(rec)
+	if err == nil && a.policy == FsyncAlways {
+		err = a.syncLocked()
+	}
+	if err != nil && a.err == nil {
+		a.err = err
+		log.Printf("append-only file %s: write failed, changes may be lost: %v", a.path, err)
+	}
+}
+
+// syncLocked flushes buffered records and, unless the policy is never,
+// fsyncs the file. Caller must hold a.mu.
+func (a *appendLog) syncLocked() error {
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+	if a.policy == FsyncNever {
+		return nil
+	}
+	return a.file.Sync()
+}
+
+func (a *appendLog) flushEverySecond() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.mu.Lock()
+			if err := a.syncLocked(); err != nil && a.err == nil {
+				a.err = err
+				log.Printf("append-only file %s: sync failed: %v", a.path, err)
+			}
+			a.mu.Unlock()
+		case <-a.stop:
+			return
+		}
+	}
+}
+
+// size returns how many bytes the current log holds.
+func (a *appendLog) size() int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	info, err := a.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size() + int64(a.buf.Buffered())
+}
+
+// rotate syncs the current log and switches writes to <path>.next. It is a
+// no-op if a previous compaction already rotated but failed to finish.
+func (a *appendLog) rotate() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rotated {
+		return nil
+	}
+	next, err := os.OpenFile(a.path+".next", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := a.syncLocked(); err != nil {
+		next.Close()
+		return err
+	}
+	a.file.Close()
+	a.setFileLocked(next)
+	a.rotated = true
+	return nil
+}
+
+// commit replaces the log with <path>.next once a snapshot holds everything
+// that was logged before the rotation.
+func (a *appendLog) commit() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.rotated {
+		return nil
+	}
+	if err := os.Rename(a.path+".next", a.path); err != nil {
+		return err
+	}
+	a.rotated = false
+	return nil
+}
+
+// close syncs and closes the log.
+func (a *appendLog) close() error {
+	close(a.stop)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.syncLocked(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// logWriteLocked appends the current state of node to the log. Caller must
+// hold s.mu.
+func (s *lruShard) logWriteLocked(node *Node) {
+	if s.aof == nil {
+		return
+	}
+	rec := aofRecord{Op: aofSet, Entry: s.recordLocked(node)}
+	s.aof.append(rec)
+}
+
+// logOpLocked appends a typed mutation of node, which was at version prev
+// before it, to the log. Caller must hold s.mu.
+func (s *lruShard) logOpLocked(node *Node, prev uint64, rec aofRecord) {
+	if s.aof == nil {
+		return
+	}
+	rec.Entry = entryRecord{Key: node.Key, Kind: node.Kind, Version: node.Version}
+	rec.Prev = prev
+	s.aof.append(rec)
+}
+
+// logExpireLocked appends node's current expiry to the log. Caller must
+// hold s.mu.
+func (s *lruShard) logExpireLocked(node *Node) {
+	if s.aof == nil {
+		return
+	}
+	rec := aofRecord{Op: aofExpire, Entry: entryRecord{Key: node.Key, Version: node.Version, Sliding: node.Sliding}}
+	if exp, ok := s.expiry.get(node.Key); ok {
+		rec.Entry.Expiry = exp
+	}
+	s.aof.append(rec)
+}
+
+// logDeleteLocked appends the removal of key to the log. Caller must hold
+// s.mu.
+func (s *lruShard) logDeleteLocked(key string) {
+	if s.aof != nil {
+		s.aof.append(aofRecord{Op: aofDel, Entry: entryRecord{Key: key}})
+	}
+}
+
+// OpenAppendLog replays the append-only file at path on top of whatever was
+// loaded from the snapshot, folds the result into a fresh snapshot and
+// starts logging every change to an empty file at path. It must run before
+// the node serves requests.
+func (lru *LRU) OpenAppendLog(path, policy string) error {
+	for _, p := range []string{path, path + ".next"} {
+		n, err := lru.replay(p)
+		if err != nil {
+			// A torn record at the end is what a crash mid-write leaves
+			// behind; everything before it has been applied.
+			log.Printf("append-only file %s: stopped after %d records: %v", p, n, err)
+		} else if n > 0 {
+			log.Printf("append-only file %s: replayed %d records", p, n)
+		}
+	}
+
+	if ok, err := lru.saveToDisk(); !ok {
+		return fmt.Errorf("saving snapshot before truncating the log: %w", err)
+	}
+	aof, err := createAppendLog(path, policy)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path + ".next"); err != nil && !os.IsNotExist(err) {
+		aof.close()
+		return err
+	}
+	lru.aof = aof
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		s.mu.Lock()
+		s.aof = aof
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// replay applies every record of the log at path and returns how many it
+// applied. A missing file holds no records.
+func (lru *LRU) replay(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	now := time.Now()
+	n := 0
+	for {
+		var rec aofRecord
+		if err := dec.Decode(&rec); err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+			return n, err
+		}
+		lru.apply(rec, now)
+		n++
+	}
+}
+
+// apply replays one record. A sliding expiry restarts from now, since reads
+// that refreshed it were not logged.
+func (lru *LRU) apply(rec aofRecord, now time.Time) {
+	s := lru.shardFor(rec.Entry.Key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch rec.Op {
+	case aofSet, aofDel:
+		s.applyEntryLocked(rec, now)
+	case aofExpire:
+		s.applyExpiryLocked(rec.Entry, now)
+	default:
+		s.applyOpLocked(rec)
+	}
+}
+
+// applyEntryLocked replaces the entry named by rec with its logged state.
+// Caller must hold s.mu.
+func (s *lruShard) applyEntryLocked(rec aofRecord, now time.Time) {
+	e := rec.Entry
+	if node, ok := s.bucket[e.Key]; ok {
+		s.removeLocked(node)
+	}
+	if rec.Op == aofDel || !e.Expiry.IsZero() && now.After(e.Expiry) {
+		return
+	}
+
+	node := e.node()
+	s.insertLocked(node)
+	s.setTagsLocked(node, e.Tags)
+	switch {
+	case e.Sliding > 0:
+		s.expiry.set(e.Key, now.Add(e.Sliding+e.Grace))
+	case !e.Expiry.IsZero():
+		s.expiry.set(e.Key, e.Expiry)
+	}
+}
+
+// applyExpiryLocked gives the key named by e the logged expiry. Caller must
+// hold s.mu.
+func (s *lruShard) applyExpiryLocked(e entryRecord, now time.Time) {
+	node, ok := s.bucket[e.Key]
+	if !ok {
+		return
+	}
+	node.Sliding = e.Sliding
+	if e.Version != 0 {
+		node.Version = e.Version
+	}
+	switch {
+	case e.Sliding > 0:
+		s.expiry.set(e.Key, now.Add(e.Sliding+node.Grace))
+	case e.Expiry.IsZero():
+		s.expiry.remove(e.Key)
+	case now.After(e.Expiry):
+		s.removeLocked(node)
+	default:
+		s.expiry.set(e.Key, e.Expiry)
+	}
+}
+
+// applyOpLocked replays a typed mutation if the entry it names is still at
+// the version the mutation was applied to. Caller must hold s.mu.
+func (s *lruShard) applyOpLocked(rec aofRecord) {
+	e := rec.Entry
+	node := s.bucket[e.Key]
+	var version uint64
+	if node != nil {
+		version = node.Version
+	}
+	if version != rec.Prev || node != nil && node.Kind != e.Kind {
+		return
+	}
+	if node == nil {
+		node = &Node{Key: e.Key, Kind: e.Kind}
+		switch e.Kind {
+		case kindHash:
+			node.Hash = make(map[string]string, len(rec.Fields))
+		case kindSet:
+			node.Set = make(map[string]struct{}, len(rec.Members))
+		case kindZSet:
+			node.ZSet = make(map[string]float64, len(rec.Scores))
+		}
+		s.insertLocked(node)
+	}
+
+	switch rec.Op {
+	case aofHSet:
+		for f, v := range rec.Fields {
+			node.Hash[f] = v
+		}
+	case aofHDel:
+		for _, f := range rec.Members {
+			delete(node.Hash, f)
+		}
+	case aofPush:
+		node.List = pushValues(node.List, rec.Members, rec.Left)
+	case aofPop:
+		if len(node.List) > 0 && rec.Left {
+			node.List = node.List[1:]
+		} else if len(node.List) > 0 {
+			node.List = node.List[:len(node.List)-1]
+		}
+	case aofTrim:
+		if rec.Start <= rec.Stop && rec.Stop <= len(node.List) {
+			node.List = append([]string(nil), node.List[rec.Start:rec.Stop]...)
+		}
+	case aofSAdd:
+		for _, m := range rec.Members {
+			node.Set[m] = struct{}{}
+		}
+	case aofSRem:
+		for _, m := range rec.Members {
+			delete(node.Set, m)
+		}
+	case aofZAdd:
+		for m, score := range rec.Scores {
+			node.ZSet[m] = score
+		}
+	}
+	node.Version = e.Version
+	s.resizeLocked(node)
+}
+
+// Compact folds the append-only file into a snapshot and truncates it.
+func (lru *LRU) Compact() error {
+	lru.aof.compactMu.Lock()
+	defer lru.aof.compactMu.Unlock()
+
+	if err := lru.aof.rotate(); err != nil {
+		return err
+	}
+	if ok, err := lru.saveToDisk(); !ok {
+		return err
+	}
+	return lru.aof.commit()
+}
+
+// AppendLogSize returns the size of the append-only file, or 0 if it is
+// disabled.
+func (lru *LRU) AppendLogSize() int64 {
+	if lru.aof == nil {
+		return 0
+	}
+	return lru.aof.size()
+}
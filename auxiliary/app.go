@@ -15,6 +15,7 @@ import (
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -35,7 +36,47 @@ func Start() {
 	}
 
 	aux := NewAuxiliary(capacity, filepath)
-	aux.LRU.startReaper(30 * time.Second)
+	aux.LRU.startReaper(100 * time.Millisecond)
+
+	// Per-namespace quotas, e.g. NAMESPACE_MAX_KEYS="search=5000,batch=20000"
+	quotas, err := parseQuotas(os.Getenv("NAMESPACE_MAX_KEYS"), os.Getenv("NAMESPACE_MAX_BYTES"))
+	if err != nil {
+		log.Fatalf("invalid namespace quotas: %v", err)
+	}
+	aux.LRU.SetQuotas(quotas)
+	prometheus.MustRegister(newNamespaceCollector(aux.LRU))
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "auxiliary_expired_keys_total",
+		Help: "Number of keys removed because their TTL passed",
+	}, func() float64 { return float64(aux.LRU.Expired()) }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auxiliary_snapshot_duration_seconds",
+		Help: "Time taken to write the last snapshot",
+	}, func() float64 { d, _, _ := aux.LRU.SnapshotStats(); return d.Seconds() }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auxiliary_snapshot_size_bytes",
+		Help: "Size of the last snapshot on disk",
+	}, func() float64 { _, size, _ := aux.LRU.SnapshotStats(); return float64(size) }))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "auxiliary_snapshot_entries",
+		Help: "Number of entries in the last snapshot",
+	}, func() float64 { _, _, n := aux.LRU.SnapshotStats(); return float64(n) }))
+
+	// Snapshot format: SNAPSHOT_COMPRESSION=gzip, SNAPSHOT_KEEP older copies
+	snapshotOpts := SnapshotOptions{Compress: os.Getenv("SNAPSHOT_COMPRESSION") == "gzip", Keep: 2}
+	if val := os.Getenv("SNAPSHOT_KEEP"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			snapshotOpts.Keep = n
+		}
+	}
+	aux.LRU.SetSnapshotOptions(snapshotOpts)
+
+	// Early refresh eagerness: XFETCH_BETA=1 by default, 0 turns it off
+	if val := os.Getenv("XFETCH_BETA"); val != "" {
+		if beta, err := strconv.ParseFloat(val, 64); err == nil && beta >= 0 {
+			aux.LRU.SetRefreshBeta(beta)
+		}
+	}
 
 	// Check if the cache file already exists and load the data in LRU cache
 	if ok, err := aux.LRU.loadFromDisk(); !ok {
@@ -44,26 +85,100 @@ func Start() {
 		log.Println("cache loaded from the disk")
 	}
 
+	// Replay the append-only file on top of the snapshot before serving
+	aofEnabled := os.Getenv("AOF_ENABLED") == "true"
+	compactSize := int64(defaultAOFCompactSize)
+	if aofEnabled {
+		policy := os.Getenv("AOF_FSYNC")
+		if policy == "" {
+			policy = FsyncEverySec
+		}
+		if val := os.Getenv("AOF_COMPACT_SIZE"); val != "" {
+			if n, err := strconv.ParseInt(val, 10, 64); err == nil && n > 0 {
+				compactSize = n
+			}
+		}
+		if err := aux.LRU.OpenAppendLog("/data/"+serverId+"-data.aof", policy); err != nil {
+			log.Fatalf("failed to open the append-only file: %v", err)
+		}
+	}
+
 	r := mux.NewRouter()
 	r.Use(mux.CORSMethodMiddleware(r))
+	r.Use(validateNamespace)
+	r.Use(validateKey)
 
 	// Handlers
 	r.HandleFunc("/data", aux.Put).Methods("POST")
 	r.HandleFunc("/data/{key}", aux.Get).Methods("GET")
 	r.HandleFunc("/data/{key}", aux.Delete).Methods("DELETE")
+	r.HandleFunc("/data", aux.DeleteMatching).Methods("DELETE")
+
+	// Expiry management
+	r.HandleFunc("/data/{key}/expire", aux.Expire).Methods("POST")
+	r.HandleFunc("/data/{key}/persist", aux.Persist).Methods("POST")
+	r.HandleFunc("/data/{key}/touch", aux.Touch).Methods("POST")
+	r.HandleFunc("/data/{key}/ttl", aux.TTL).Methods("GET")
+	r.HandleFunc("/data/{key}/revert", aux.Revert).Methods("POST")
+	r.HandleFunc("/data/{key}/entry", aux.Entry).Methods("GET")
+
+	// Atomic counters
+	r.HandleFunc("/incr", aux.Incr).Methods("POST")
+
+	// Hash (field map) operations
+	r.HandleFunc("/hash/{key}", aux.HSet).Methods("POST")
+	r.HandleFunc("/hash/{key}", aux.HGetAll).Methods("GET")
+	r.HandleFunc("/hash/{key}", aux.HDel).Methods("DELETE")
+	r.HandleFunc("/hash/{key}/{field}", aux.HGet).Methods("GET")
+	r.HandleFunc("/hash/{key}/{field}/incr", aux.HIncrBy).Methods("POST")
+
+	// List operations
+	r.HandleFunc("/list/{key}", aux.Range).Methods("GET")
+	r.HandleFunc("/list/{key}/lpush", aux.Push(true)).Methods("POST")
+	r.HandleFunc("/list/{key}/rpush", aux.Push(false)).Methods("POST")
+	r.HandleFunc("/list/{key}/lpop", aux.Pop(true)).Methods("POST")
+	r.HandleFunc("/list/{key}/rpop", aux.Pop(false)).Methods("POST")
+	r.HandleFunc("/list/{key}/trim", aux.Trim).Methods("POST")
+
+	// Set operations
+	r.HandleFunc("/set/{key}", aux.SMembers).Methods("GET")
+	r.HandleFunc("/set/{key}/add", aux.SetMembers(false)).Methods("POST")
+	r.HandleFunc("/set/{key}/remove", aux.SetMembers(true)).Methods("POST")
+	r.HandleFunc("/set/{key}/card", aux.SCard).Methods("GET")
+	r.HandleFunc("/set/{key}/members/{member}", aux.SIsMember).Methods("GET")
+
+	// Sorted set operations
+	r.HandleFunc("/zset/{key}", aux.ZRange).Methods("GET")
+	r.HandleFunc("/zset/{key}/byscore", aux.ZRangeByScore).Methods("GET")
+	r.HandleFunc("/zset/{key}/rank/{member}", aux.ZRank).Methods("GET")
+	r.HandleFunc("/zset/{key}/add", aux.ZAdd).Methods("POST")
+	r.HandleFunc("/zset/{key}/incr", aux.ZIncrBy).Methods("POST")
 
 	// Bulk operations
 	r.HandleFunc("/bulk", aux.BulkPut).Methods("POST")
 	r.HandleFunc("/bulk/get", aux.BulkGet).Methods("POST")
 
+	// Tag-based invalidation
+	r.HandleFunc("/tags/{tag}", aux.InvalidateTag).Methods("DELETE")
+
+	// Cursor-based key scan
+	r.HandleFunc("/scan", aux.Scan).Methods("GET")
+
 	// Send all key-val mappings
 	r.HandleFunc("/mappings", aux.Mappings).Methods("GET")
 
-	// Empty the cache
-	r.HandleFunc("/erase", aux.Erase).Methods("DELETE")
+	// Empty one namespace
+	r.HandleFunc("/namespaces/{ns}", aux.FlushNamespace).Methods("DELETE")
+
+	// Range transfers when the ring changes
+	r.HandleFunc("/export", aux.Export).Methods("POST")
+	r.HandleFunc("/import", aux.Import).Methods("POST")
+	r.HandleFunc("/ranges/drop", aux.DropRanges).Methods("POST")
+	r.HandleFunc("/ranges/count", aux.CountRanges).Methods("POST")
 
 	// Monitor health to check alive status
 	r.HandleFunc("/health", aux.Health).Methods("GET")
+	r.HandleFunc("/ready", aux.Ready).Methods("GET")
 
 	// Instrumentation
 	r.Handle("/metrics", promhttp.Handler())
@@ -89,9 +204,20 @@ func Start() {
 
 	// Self-register with the master periodically so it joins the hash ring without
 	// needing to be listed in AUX_SERVERS upfront, and recovers if the master restarts.
+	// With WARM_BOOT=true the node first copies the keys it is about to own from
+	// their current replicas, so it joins the ring warm.
 	if masterAddr := os.Getenv("MASTER_SERVER"); masterAddr != "" && serverId != "" {
 		selfAddr := fmt.Sprintf("%s:%s", serverId, port)
 		go func() {
+			if os.Getenv("WARM_BOOT") == "true" {
+				start := time.Now()
+				n, err := aux.WarmBoot(masterAddr, selfAddr)
+				if err != nil {
+					log.Printf("warm boot incomplete: %v", err)
+				}
+				log.Printf("warm boot copied %d entries in %v", n, time.Since(start))
+			}
+
 			body, _ := json.Marshal(map[string]string{"addr": selfAddr})
 			for {
 				resp, err := http.Post(
@@ -103,6 +229,7 @@ func Start() {
 					resp.Body.Close()
 					if resp.StatusCode == http.StatusOK {
 						log.Printf("registered with master at %s as %s", masterAddr, selfAddr)
+						aux.ready.Store(true)
 					} else {
 						log.Printf("master returned %d on registration", resp.StatusCode)
 					}
@@ -112,13 +239,17 @@ func Start() {
 				time.Sleep(15 * time.Second)
 			}
 		}()
+	} else {
+		aux.ready.Store(true)
 	}
 
 	// Listen to termination signals
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
 
-	// Save cache to disk every 10s; stops when shutdown is signalled.
+	// Save cache to disk every 10s; stops when shutdown is signalled. With
+	// the append-only file every change is already on disk, so the log is
+	// only folded into a snapshot once it grows past AOF_COMPACT_SIZE.
 	stopSaver := make(chan struct{})
 	go func() {
 		ticker := time.NewTicker(10 * time.Second)
@@ -126,6 +257,15 @@ func Start() {
 		for {
 			select {
 			case <-ticker.C:
+				if aofEnabled {
+					if aux.LRU.AppendLogSize() >= compactSize {
+						log.Println("compacting the append-only file...")
+						if err := aux.LRU.Compact(); err != nil {
+							log.Printf("failed compacting the append-only file: %v", err)
+						}
+					}
+					continue
+				}
 				log.Println("saving cache to disk...")
 				if ok, err := aux.LRU.saveToDisk(); !ok {
 					log.Printf("failed saving cache to disk: %s\n", err.Error())
@@ -151,7 +291,14 @@ func Start() {
 		log.Println("shutting down...")
 		log.Println("saving cache to disk...")
 
-		if ok, err := aux.LRU.saveToDisk(); !ok {
+		if aofEnabled {
+			if err := aux.LRU.Compact(); err != nil {
+				log.Printf("failed compacting the append-only file: %v", err)
+			}
+			if err := aux.LRU.aof.close(); err != nil {
+				log.Printf("failed closing the append-only file: %v", err)
+			}
+		} else if ok, err := aux.LRU.saveToDisk(); !ok {
 			log.Printf("failed to save the cache to disk: %s", err.Error())
 		}
 
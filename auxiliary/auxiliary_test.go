@@ -1,8 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
 )
 
 func TestDLL_Prepend(t *testing.T) {
@@ -124,6 +137,775 @@ func TestLRU_Put(t *testing.T) {
 	}
 }
 
+func TestLRU_PutIf(t *testing.T) {
+	lru := NewLRU(3, "")
+
+	if err := lru.PutIf(KeyVal{Key: "k", Value: "v1", Cond: CondExists}); err != ErrConflict {
+		t.Errorf("xx on missing key: want ErrConflict, got %v", err)
+	}
+	if err := lru.PutIf(KeyVal{Key: "k", Value: "v1", Cond: CondNotExists}); err != nil {
+		t.Errorf("nx on missing key: unexpected error %v", err)
+	}
+	if err := lru.PutIf(KeyVal{Key: "k", Value: "v2", Cond: CondNotExists}); err != ErrConflict {
+		t.Errorf("nx on existing key: want ErrConflict, got %v", err)
+	}
+
+	kv, err := lru.Lookup("k")
+	if err != nil || kv.Value != "v1" || kv.Version == 0 {
+		t.Fatalf("Unexpected entry after nx: %+v err=%v", kv, err)
+	}
+
+	if err := lru.PutIf(KeyVal{Key: "k", Value: "v3", IfVersion: kv.Version + 1}); err != ErrConflict {
+		t.Errorf("cas with stale version: want ErrConflict, got %v", err)
+	}
+	if err := lru.PutIf(KeyVal{Key: "k", Value: "v3", IfVersion: kv.Version}); err != nil {
+		t.Errorf("cas with current version: unexpected error %v", err)
+	}
+	if val, _ := lru.Get("k"); val != "v3" {
+		t.Errorf("Unexpected value after cas: got %s wanted %s", val, "v3")
+	}
+	// The previous version is no longer current.
+	if err := lru.PutIf(KeyVal{Key: "k", Value: "v4", IfVersion: kv.Version}); err != ErrConflict {
+		t.Errorf("cas replay: want ErrConflict, got %v", err)
+	}
+}
+
+func TestLRU_SwapIfAndRevert(t *testing.T) {
+	lru := NewLRU(4, "")
+
+	prev, err := lru.SwapIf(KeyVal{Key: "k", Value: "v1", Version: 10, Tags: []string{"t"}})
+	if err != nil || prev != nil {
+		t.Fatalf("first write: want no previous entry, got %v, %v", prev, err)
+	}
+	prev, err = lru.SwapIf(KeyVal{Key: "k", Value: "v2", Version: 20, IfVersion: 10})
+	if err != nil || prev == nil || prev.Value != "v1" {
+		t.Fatalf("cas: want previous v1, got %v, %v", prev, err)
+	}
+
+	if lru.Revert("k", 10, prev) {
+		t.Error("revert of a version the key no longer holds succeeded")
+	}
+	if !lru.Revert("k", 20, prev) {
+		t.Fatal("revert failed")
+	}
+	kv, err := lru.Lookup("k")
+	if err != nil || kv.Value != "v1" || kv.Version != 10 {
+		t.Errorf("after revert: want v1 at version 10, got %+v, %v", kv, err)
+	}
+	if keys := lru.InvalidateTag("t"); len(keys) != 1 {
+		t.Errorf("reverted entry lost its tags: %v", keys)
+	}
+
+	lru.SwapIf(KeyVal{Key: "new", Value: "v", Version: 30, Cond: CondNotExists})
+	if !lru.Revert("new", 30, nil) {
+		t.Fatal("revert of a created key failed")
+	}
+	if _, err := lru.Get("new"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("reverted create: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestLRU_Incr(t *testing.T) {
+	lru := NewLRU(3, "")
+
+	if val, err := lru.Incr("hits", 5, 0, 0); err != nil || val != 5 {
+		t.Errorf("Incr on missing key: got %d err=%v wanted 5", val, err)
+	}
+	if val, err := lru.Incr("hits", -7, 0, 0); err != nil || val != -2 {
+		t.Errorf("Decr: got %d err=%v wanted -2", val, err)
+	}
+	if val, _ := lru.Get("hits"); val != "-2" {
+		t.Errorf("Unexpected stored counter: got %s wanted %s", val, "-2")
+	}
+
+	lru.Put("name", "alex", 0)
+	if _, err := lru.Incr("name", 1, 0, 0); err != ErrNotInteger {
+		t.Errorf("Incr on non-integer: want ErrNotInteger, got %v", err)
+	}
+
+	lru.Put("big", "9223372036854775807", 0)
+	if _, err := lru.Incr("big", 1, 0, 0); err != ErrNotInteger {
+		t.Errorf("Incr overflow: want ErrNotInteger, got %v", err)
+	}
+}
+
+func TestLRU_Hash(t *testing.T) {
+	lru := NewLRU(3, "")
+
+	if added, err := lru.HSet("user", map[string]string{"name": "alex", "age": "25"}); err != nil || added != 2 {
+		t.Errorf("HSet: got %d err=%v wanted 2", added, err)
+	}
+	if added, _ := lru.HSet("user", map[string]string{"age": "26", "town": "ktm"}); added != 1 {
+		t.Errorf("HSet existing field: got %d added wanted 1", added)
+	}
+	if val, err := lru.HGet("user", "age"); err != nil || val != "26" {
+		t.Errorf("HGet: got %s err=%v wanted 26", val, err)
+	}
+	if _, err := lru.HGet("user", "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("HGet missing field: want ErrNotFound, got %v", err)
+	}
+	if val, err := lru.HIncrBy("user", "age", 4); err != nil || val != 30 {
+		t.Errorf("HIncrBy: got %d err=%v wanted 30", val, err)
+	}
+	if _, err := lru.Get("user"); err != ErrWrongType {
+		t.Errorf("Get on hash: want ErrWrongType, got %v", err)
+	}
+
+	lru.Put("plain", "v", 0)
+	if _, err := lru.HSet("plain", map[string]string{"f": "v"}); err != ErrWrongType {
+		t.Errorf("HSet on string: want ErrWrongType, got %v", err)
+	}
+
+	if removed, _ := lru.HDel("user", []string{"name", "age", "town"}); removed != 3 {
+		t.Errorf("HDel: got %d removed wanted 3", removed)
+	}
+	if _, err := lru.HGetAll("user"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected hash to be deleted with its last field, got %v", err)
+	}
+}
+
+func TestLRU_List(t *testing.T) {
+	lru := NewLRU(3, "")
+
+	lru.Push("jobs", []string{"b", "c"}, false)
+	if n, err := lru.Push("jobs", []string{"a"}, true); err != nil || n != 3 {
+		t.Errorf("Push: got length %d err=%v wanted 3", n, err)
+	}
+	if vals, _ := lru.Range("jobs", 0, -1); strings.Join(vals, ",") != "a,b,c" {
+		t.Errorf("Range: got %v wanted [a b c]", vals)
+	}
+	if vals, _ := lru.Range("jobs", -2, 10); strings.Join(vals, ",") != "b,c" {
+		t.Errorf("Range with negative start: got %v wanted [b c]", vals)
+	}
+	if val, _ := lru.Pop("jobs", false); val != "c" {
+		t.Errorf("Pop right: got %s wanted c", val)
+	}
+	if n, _ := lru.Trim("jobs", 1, 1); n != 1 {
+		t.Errorf("Trim: got length %d wanted 1", n)
+	}
+	if val, _ := lru.Pop("jobs", true); val != "b" {
+		t.Errorf("Pop left after trim: got %s wanted b", val)
+	}
+	if _, err := lru.Pop("jobs", true); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Pop on drained list: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestLRU_BlockingPop(t *testing.T) {
+	lru := NewLRU(3, "")
+
+	start := time.Now()
+	if _, err := lru.BlockingPop(context.Background(), "queue", true, 50*time.Millisecond); !errors.Is(err, ErrNotFound) {
+		t.Errorf("BlockingPop on empty list: want ErrNotFound, got %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("BlockingPop returned before its timeout")
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		lru.Push("queue", []string{"job"}, false)
+	}()
+	val, err := lru.BlockingPop(context.Background(), "queue", true, time.Second)
+	if err != nil || val != "job" {
+		t.Errorf("BlockingPop: got %s err=%v wanted job", val, err)
+	}
+}
+
+func TestLRU_Set(t *testing.T) {
+	lru := NewLRU(3, "")
+
+	if added, err := lru.SAdd("tags", []string{"go", "cache", "go"}); err != nil || added != 2 {
+		t.Errorf("SAdd: got %d err=%v wanted 2", added, err)
+	}
+	if ok, _ := lru.SIsMember("tags", "cache"); !ok {
+		t.Error("SIsMember: expected cache to be a member")
+	}
+	if n, _ := lru.SCard("tags"); n != 2 {
+		t.Errorf("SCard: got %d wanted 2", n)
+	}
+	if members, _ := lru.SMembers("tags"); strings.Join(members, ",") != "cache,go" {
+		t.Errorf("SMembers: got %v wanted [cache go]", members)
+	}
+	if removed, _ := lru.SRem("tags", []string{"go", "rust"}); removed != 1 {
+		t.Errorf("SRem: got %d wanted 1", removed)
+	}
+}
+
+func TestLRU_SortedSet(t *testing.T) {
+	lru := NewLRU(3, "")
+
+	lru.ZAdd("board", map[string]float64{"alice": 10, "bob": 20, "carol": 15})
+	if score, _ := lru.ZIncrBy("board", "alice", 15); score != 25 {
+		t.Errorf("ZIncrBy: got %v wanted 25", score)
+	}
+
+	top, _ := lru.ZRange("board", 0, 1, true)
+	if len(top) != 2 || top[0].Member != "alice" || top[1].Member != "bob" {
+		t.Errorf("ZRange rev: got %v wanted [alice bob]", top)
+	}
+	mid, _ := lru.ZRangeByScore("board", 12, 22, false)
+	if len(mid) != 2 || mid[0].Member != "carol" || mid[1].Member != "bob" {
+		t.Errorf("ZRangeByScore: got %v wanted [carol bob]", mid)
+	}
+	if rank, score, err := lru.ZRank("board", "carol", false); err != nil || rank != 0 || score != 15 {
+		t.Errorf("ZRank: got %d/%v err=%v wanted 0/15", rank, score, err)
+	}
+	if _, _, err := lru.ZRank("board", "dave", false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ZRank missing member: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestKeyIndex(t *testing.T) {
+	idx := newKeyIndex()
+	want := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", (i*7919)%1000)
+		if i%3 == 2 {
+			idx.remove(key)
+			delete(want, key)
+		} else {
+			idx.insert(key)
+			want[key] = true
+		}
+	}
+
+	var got []string
+	for x := idx.seek(""); x != nil; x = x.next[0] {
+		got = append(got, x.key)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("index holds %d keys, wanted %d", len(got), len(want))
+	}
+	for i, key := range got {
+		if !want[key] || i > 0 && got[i-1] >= key {
+			t.Fatalf("index out of order or holding a removed key at %d: %q", i, key)
+		}
+	}
+	if x := idx.seek("key-5"); x == nil || x.key < "key-5" {
+		t.Errorf("seek returned a key before its argument: %v", x)
+	}
+}
+
+func TestLRU_Scan(t *testing.T) {
+	lru := NewLRU(numShards*100, "")
+	for i := 0; i < 50; i++ {
+		lru.Put(fmt.Sprintf("user:%d", i), "v", 0)
+		lru.Put(fmt.Sprintf("order:%d", i), "v", 0)
+		lru.Put(namespacedKey("other", fmt.Sprintf("user:%d", i)), "v", 0)
+	}
+	lru.HSet("user:profile", map[string]string{"name": "alice"})
+	lru.Delete("user:49")
+	lru.Put("user:49", "v", 0)
+
+	seen := make(map[string]int)
+	cursor, pages := "0", 0
+	for {
+		page, err := lru.Scan(DefaultNamespace, cursor, 7, "user:*", "string")
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		for _, key := range page.Keys {
+			seen[key]++
+		}
+		pages++
+		if cursor = page.Cursor; cursor == "0" {
+			break
+		}
+	}
+	if len(seen) != 50 {
+		t.Errorf("Scan: got %d distinct keys wanted 50", len(seen))
+	}
+	for key, n := range seen {
+		if n != 1 || !strings.HasPrefix(key, "user:") {
+			t.Errorf("Scan: key %s returned %d times", key, n)
+		}
+	}
+	if pages < 2 {
+		t.Errorf("Scan: expected several pages, got %d", pages)
+	}
+
+	if _, err := lru.Scan(DefaultNamespace, "not-a-cursor!", 10, "", ""); err == nil {
+		t.Error("Scan: expected an error for a malformed cursor")
+	}
+}
+
+func TestLRU_DeleteMatching(t *testing.T) {
+	lru := NewLRU(numShards*100, "")
+	for i := 0; i < 300; i++ {
+		lru.Put(fmt.Sprintf("user:42:item:%d", i), "v", 0)
+	}
+	lru.Put("user:7:item:1", "v", 0)
+	lru.HSet("user:42:profile", map[string]string{"name": "alice"})
+
+	if keys := lru.DeleteMatching(DefaultNamespace, "user:42:", "", true); len(keys) != 301 {
+		t.Errorf("DeleteMatching dry run: got %d keys wanted 301", len(keys))
+	}
+	if _, err := lru.Get("user:42:item:0"); err != nil {
+		t.Error("DeleteMatching dry run should not remove keys")
+	}
+
+	if keys := lru.DeleteMatching(DefaultNamespace, "user:", "*:item:1?", false); len(keys) != 10 {
+		t.Errorf("DeleteMatching by pattern: got %d keys wanted 10", len(keys))
+	}
+	if keys := lru.DeleteMatching(DefaultNamespace, "user:42:", "", false); len(keys) != 291 {
+		t.Errorf("DeleteMatching by prefix: got %d keys wanted 291", len(keys))
+	}
+	if _, err := lru.Get("user:7:item:1"); err != nil {
+		t.Error("DeleteMatching removed a key outside the prefix")
+	}
+}
+
+func TestLRUShard_KeysAfterBoundsVisitedKeys(t *testing.T) {
+	lru := NewLRU(numShards*1000, "")
+	s := &lru.shards[0]
+	n := 0
+	for i := 0; n < 3*deleteBatch; i++ {
+		if key := fmt.Sprintf("user:%d", i); shardIndex(key) == 0 {
+			lru.Put(key, "v", 0)
+			n++
+		}
+	}
+
+	// A filter that accepts nothing still stops after deleteBatch keys.
+	none := func(string, *Node) bool { return false }
+	keys, last, visited := s.keysAfter("", "", deleteBatch, none)
+	if len(keys) != 0 || visited != deleteBatch || last == "" {
+		t.Errorf("keysAfter: got %d keys, %d visited, last %q; wanted 0, %d and a resume key", len(keys), visited, last, deleteBatch)
+	}
+	batches := 0
+	s.eachKeyBatch("", none, func([]string) { t.Error("eachKeyBatch: handed keys nothing accepted") })
+	s.eachKeyBatch("", nil, func(keys []string) {
+		batches++
+		if len(keys) > deleteBatch {
+			t.Errorf("eachKeyBatch: batch of %d keys", len(keys))
+		}
+	})
+	if batches != 3 {
+		t.Errorf("eachKeyBatch: got %d batches wanted 3", batches)
+	}
+}
+
+func TestLRU_ScanCountsVisitedKeys(t *testing.T) {
+	lru := NewLRU(numShards*200, "")
+	for i := 0; i < 1000; i++ {
+		lru.Put(fmt.Sprintf("k:%04d", i), "v", 0)
+	}
+	for i := 0; i < 500; i++ {
+		lru.Put(namespacedKey("other", fmt.Sprintf("k:%04d", i)), "v", 0)
+	}
+	lru.HSet("zz", map[string]string{"name": "alice"})
+
+	var found []string
+	cursor, pages := "0", 0
+	for {
+		page, err := lru.Scan(DefaultNamespace, cursor, 10, "", "hash")
+		if err != nil {
+			t.Fatalf("Scan: %v", err)
+		}
+		if pages == 0 && (len(page.Keys) != 0 || page.Cursor == "0") {
+			t.Errorf("Scan: first page got %v cursor %q, wanted an empty page and a cursor", page.Keys, page.Cursor)
+		}
+		found = append(found, page.Keys...)
+		pages++
+		if cursor = page.Cursor; cursor == "0" {
+			break
+		}
+	}
+	if len(found) != 1 || found[0] != "zz" {
+		t.Errorf("Scan: got %v wanted [zz]", found)
+	}
+	// Every visited key counts, filtered out or in another namespace.
+	if pages < 1501/10 {
+		t.Errorf("Scan: %d pages of 10 for 1501 keys, so a page visited more than 10", pages)
+	}
+}
+
+func TestLRU_InvalidateTag(t *testing.T) {
+	lru := NewLRU(numShards*10, "")
+	lru.PutIf(KeyVal{Key: "page:/home", Value: "<html>", Tags: []string{"product:1", "product:2"}})
+	lru.PutIf(KeyVal{Key: "page:/p/1", Value: "<html>", Tags: []string{"product:1"}})
+	lru.PutIf(KeyVal{Key: "page:/p/2", Value: "<html>", Tags: []string{"product:2"}})
+	// Rewriting a key replaces its tags.
+	lru.PutIf(KeyVal{Key: "page:/p/2", Value: "<html>", Tags: []string{"product:3"}})
+
+	keys := lru.InvalidateTag("product:1")
+	if strings.Join(keys, ",") != "page:/home,page:/p/1" {
+		t.Errorf("InvalidateTag: got %v wanted [page:/home page:/p/1]", keys)
+	}
+	if keys := lru.InvalidateTag("product:2"); len(keys) != 0 {
+		t.Errorf("InvalidateTag: stale index entries %v", keys)
+	}
+	if _, err := lru.Get("page:/p/2"); err != nil {
+		t.Errorf("InvalidateTag removed an untagged key: %v", err)
+	}
+	if keys := lru.InvalidateTag("product:3"); len(keys) != 1 {
+		t.Errorf("InvalidateTag: got %v wanted [page:/p/2]", keys)
+	}
+	for i := range lru.shards {
+		if n := len(lru.shards[i].tags); n != 0 {
+			t.Errorf("shard %d still indexes %d tags", i, n)
+		}
+	}
+}
+
+func TestLRU_ExpirePersistTTL(t *testing.T) {
+	lru := NewLRU(numShards*10, "")
+	lru.Put("k", "v", 0)
+
+	if ttl, _, err := lru.TTL("k"); err != nil || ttl != NoExpiry {
+		t.Errorf("TTL without expiry: got %v err=%v wanted NoExpiry", ttl, err)
+	}
+	if err := lru.Expire("k", time.Minute, false); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	if ttl, sliding, _ := lru.TTL("k"); ttl <= 59*time.Second || ttl > time.Minute || sliding {
+		t.Errorf("TTL after Expire: got %v sliding=%v wanted ~1m fixed", ttl, sliding)
+	}
+	if had, err := lru.Persist("k"); err != nil || !had {
+		t.Errorf("Persist: got %v err=%v wanted true", had, err)
+	}
+	if had, _ := lru.Persist("k"); had {
+		t.Error("Persist of a persistent key reported an expiry")
+	}
+	if ttl, _, _ := lru.TTL("k"); ttl != NoExpiry {
+		t.Errorf("TTL after Persist: got %v wanted NoExpiry", ttl)
+	}
+
+	lru.Expire("k", 20*time.Millisecond, false)
+	time.Sleep(30 * time.Millisecond)
+	if _, err := lru.Get("k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Expire elapsed: got %v wanted ErrNotFound", err)
+	}
+	for _, err := range []error{lru.Expire("missing", time.Minute, false), func() error { _, _, err := lru.Touch("missing"); return err }()} {
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("operation on missing key: got %v wanted ErrNotFound", err)
+		}
+	}
+}
+
+func TestLRU_SlidingExpiry(t *testing.T) {
+	lru := NewLRU(numShards*10, "")
+	lru.Put("session", "s", 0)
+	lru.Expire("session", 60*time.Millisecond, true)
+
+	// Each read lands within the window and restarts it, so the key outlives
+	// several windows.
+	for i := 0; i < 4; i++ {
+		time.Sleep(30 * time.Millisecond)
+		kv, err := lru.Lookup("session")
+		if err != nil {
+			t.Fatalf("Lookup %d: %v", i, err)
+		}
+		if !kv.Sliding {
+			t.Errorf("Lookup %d: sliding not reported", i)
+		}
+	}
+	if _, _, err := lru.Touch("session"); err != nil {
+		t.Fatalf("Touch: %v", err)
+	}
+	time.Sleep(90 * time.Millisecond)
+	if _, err := lru.Get("session"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after an idle window: got %v wanted ErrNotFound", err)
+	}
+
+	// A plain write replaces a sliding expiry.
+	lru.PutIf(KeyVal{Key: "k", Value: "v", TTL: 60, Sliding: true})
+	lru.Put("k", "v2", 0)
+	if ttl, sliding, _ := lru.TTL("k"); ttl != NoExpiry || sliding {
+		t.Errorf("TTL after overwrite: got %v sliding=%v wanted NoExpiry", ttl, sliding)
+	}
+}
+
+func TestLRU_EarlyRefreshAndGrace(t *testing.T) {
+	lru := NewLRU(numShards*10, "")
+
+	// A value past its TTL is served stale during its grace period, and
+	// every read of it is due a refresh; the master picks one reader.
+	lru.PutIf(KeyVal{Key: "k", Value: "v", TTL: 60, Grace: 30})
+	lru.shardFor("k").expiry.set("k", time.Now().Add(10*time.Second))
+	for i := 0; i < 2; i++ {
+		kv, err := lru.Lookup("k")
+		if err != nil || !kv.Stale || !kv.Refresh || kv.Value != "v" {
+			t.Fatalf("stale read %d: got %+v, %v wanted stale value with refresh", i, kv, err)
+		}
+	}
+	if ttl, _, _ := lru.TTL("k"); ttl != 0 {
+		t.Errorf("TTL of a stale value: got %v wanted 0", ttl)
+	}
+	lru.PutIf(KeyVal{Key: "k", Value: "v2", TTL: 60, Grace: 30})
+	if kv, _ := lru.Lookup("k"); kv.Stale || kv.Refresh {
+		t.Errorf("read after the refresh: got %+v wanted a fresh value", kv)
+	}
+
+	// Early refresh: with a huge beta any read before the expiry refreshes.
+	lru.PutIf(KeyVal{Key: "slow", Value: "v", TTL: 60, Recompute: 1000})
+	if kv, _ := lru.Lookup("slow"); kv.Refresh {
+		t.Errorf("read a minute before expiry of a 1s recompute: refresh suggested")
+	}
+	lru.SetRefreshBeta(1e9)
+	if kv, _ := lru.Lookup("slow"); kv.Stale || !kv.Refresh || kv.Recompute != 1000 {
+		t.Errorf("early read: got %+v wanted refresh of a fresh value, with its recompute time", kv)
+	}
+
+	// Keys without grace or recompute time are never flagged.
+	lru.Put("plain", "v", 60)
+	if kv, _ := lru.Lookup("plain"); kv.Stale || kv.Refresh {
+		t.Errorf("plain key: got %+v", kv)
+	}
+}
+
+func TestLRU_ReapExpired(t *testing.T) {
+	lru := NewLRU(numShards*100, "")
+	for i := 0; i < 300; i++ {
+		lru.Put(fmt.Sprintf("short:%d", i), "v", 0)
+		lru.Expire(fmt.Sprintf("short:%d", i), time.Millisecond, false)
+	}
+	lru.Put("long", "v", 60)
+	lru.Put("forever", "v", 0)
+	// Moving a deadline later keeps the key past the reap.
+	lru.Put("moved", "v", 0)
+	lru.Expire("moved", time.Millisecond, false)
+	lru.Expire("moved", time.Minute, false)
+	time.Sleep(5 * time.Millisecond)
+
+	if n := lru.reapExpired(); n != 300 {
+		t.Errorf("reapExpired: removed %d wanted 300", n)
+	}
+	for _, key := range []string{"long", "forever", "moved"} {
+		if _, err := lru.Get(key); err != nil {
+			t.Errorf("Get %s after reap: %v", key, err)
+		}
+	}
+	if n := lru.reapExpired(); n != 0 {
+		t.Errorf("second reapExpired: removed %d wanted 0", n)
+	}
+
+	// Keys found expired on access count too.
+	lru.Put("lazy", "v", 0)
+	lru.Expire("lazy", time.Millisecond, false)
+	time.Sleep(5 * time.Millisecond)
+	lru.Get("lazy")
+	if n := lru.Expired(); n != 301 {
+		t.Errorf("Expired: got %d wanted 301", n)
+	}
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		if len(s.expiry.queue) != len(s.expiry.index) {
+			t.Errorf("shard %d: heap holds %d deadlines, index %d", i, len(s.expiry.queue), len(s.expiry.index))
+		}
+	}
+}
+
+func TestExpiryHeap(t *testing.T) {
+	h := newExpiryHeap()
+	base := time.Now()
+	for i, offset := range []int{5, 3, 9, 1, 7} {
+		h.set(fmt.Sprint(i), base.Add(time.Duration(offset)*time.Second))
+	}
+	h.set("2", base) // move the latest to the front
+	h.remove("3")    // drop the earliest
+	h.set("0", base.Add(8*time.Second))
+
+	var order []string
+	for {
+		key, _, ok := h.next()
+		if !ok {
+			break
+		}
+		order = append(order, key)
+		h.remove(key)
+	}
+	if got := strings.Join(order, ","); got != "2,1,4,0" {
+		t.Errorf("expiry order: got %s wanted 2,1,4,0", got)
+	}
+}
+
+func TestLRU_NamespaceIsolation(t *testing.T) {
+	lru := NewLRU(numShards*10, "")
+	lru.Put(namespacedKey("search", "k"), "search-value", 0)
+	lru.Put(namespacedKey("batch", "k"), "batch-value", 0)
+	lru.Put("k", "default-value", 0)
+
+	if val, _ := lru.Get(namespacedKey("search", "k")); val != "search-value" {
+		t.Errorf("Get in search: got %q wanted search-value", val)
+	}
+	if page, _ := lru.Scan("batch", "0", 100, "", ""); strings.Join(page.Keys, ",") != "k" {
+		t.Errorf("Scan in batch: got %v wanted [k]", page.Keys)
+	}
+
+	if keys := lru.FlushNamespace("search"); len(keys) != 1 || keys[0] != "k" {
+		t.Errorf("FlushNamespace: got %v wanted [k]", keys)
+	}
+	if _, err := lru.Get(namespacedKey("search", "k")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("FlushNamespace left the key behind: err=%v", err)
+	}
+	if val, _ := lru.Get("k"); val != "default-value" {
+		t.Errorf("FlushNamespace touched another namespace: got %q", val)
+	}
+	if u := lru.NamespaceUsage()["batch"]; u.keys != 1 || u.bytes == 0 {
+		t.Errorf("NamespaceUsage: got %+v wanted 1 key", u)
+	}
+}
+
+func TestLRU_NamespaceQuota(t *testing.T) {
+	lru := NewLRU(numShards*100, "")
+	lru.SetQuotas(map[string]Quota{"batch": {Keys: numShards * 2}})
+
+	for i := 0; i < 50; i++ {
+		lru.Put(fmt.Sprintf("keep:%d", i), "v", 0)
+	}
+	for i := 0; i < 1000; i++ {
+		lru.Put(namespacedKey("batch", fmt.Sprintf("load:%d", i)), "v", 0)
+	}
+
+	usage := lru.NamespaceUsage()
+	if got := usage["batch"].keys; got > numShards*2 {
+		t.Errorf("batch holds %d keys, quota is %d", got, numShards*2)
+	}
+	if usage["batch"].evictions == 0 {
+		t.Error("expected quota evictions in batch")
+	}
+	if got := usage[DefaultNamespace].keys; got != 50 {
+		t.Errorf("default namespace lost keys to another namespace's load: %d left", got)
+	}
+
+	// A byte quota evicts older entries as a hash grows.
+	lru.SetQuotas(map[string]Quota{"search": {Bytes: numShards * 64}})
+	key := namespacedKey("search", "a")
+	lru.Put(namespacedKey("search", "b"), "", 0)
+	for i := 0; i < 100; i++ {
+		lru.HSet(key, map[string]string{fmt.Sprintf("f%d", i): "x"})
+	}
+	if _, err := lru.HGet(key, "f99"); err != nil {
+		t.Errorf("the entry being written must never be evicted: %v", err)
+	}
+}
+
+func TestLRU_NamespaceQuotaEvictsLeastRecentlyUsed(t *testing.T) {
+	lru := NewLRU(numShards*100, "")
+	lru.SetQuotas(map[string]Quota{"batch": {Keys: numShards * 2}})
+
+	// Every shard holds two batch keys, so a third one in the same shard
+	// evicts one of the first two.
+	keys := []string{namespacedKey("batch", "k0")}
+	for i := 1; len(keys) < 3; i++ {
+		if key := namespacedKey("batch", fmt.Sprintf("k%d", i)); lru.shardFor(key) == lru.shardFor(keys[0]) {
+			keys = append(keys, key)
+		}
+	}
+	lru.Put(keys[0], "v", 0)
+	lru.Put(keys[1], "v", 0)
+	lru.Put("other", "v", 0)
+	lru.Get(keys[0])
+	lru.Put(keys[2], "v", 0)
+
+	if _, err := lru.Get(keys[1]); err == nil {
+		t.Errorf("%q was the namespace's least recently used key and should be evicted", keys[1])
+	}
+	if _, err := lru.Get(keys[0]); err != nil {
+		t.Errorf("%q was read recently and should be kept: %v", keys[0], err)
+	}
+	if _, err := lru.Get("other"); err != nil {
+		t.Errorf("a key of another namespace was evicted: %v", err)
+	}
+}
+
+func TestLRU_CapacityEvictsFromNamespaceOverItsShare(t *testing.T) {
+	lru := NewLRU(numShards*10, "")
+	s := &lru.shards[0]
+	// keysIn returns n keys of ns that all land in shard 0.
+	keysIn := func(ns string, n int) []string {
+		var keys []string
+		for i := 0; len(keys) < n; i++ {
+			if key := namespacedKey(ns, fmt.Sprintf("k%d", i)); shardIndex(key) == 0 {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	big, small := keysIn("big", 10), keysIn("small", 6)
+
+	// big fills the shard; small's first five keys evict big's oldest.
+	for _, key := range big {
+		lru.Put(key, "v", 0)
+	}
+	for _, key := range small[:5] {
+		lru.Put(key, "v", 0)
+	}
+	if got := s.usage["small"].keys; got != 5 {
+		t.Errorf("small holds %d keys, wanted 5", got)
+	}
+	if _, err := lru.Get(big[0]); err == nil {
+		t.Error("big's least recently used key should be evicted")
+	}
+	if _, err := lru.Get(big[9]); err != nil {
+		t.Errorf("big's newest key was evicted: %v", err)
+	}
+
+	// At its share of half the shard, small pays for its own inserts.
+	lru.Put(small[5], "v", 0)
+	if got := s.usage["big"].keys; got != 5 {
+		t.Errorf("big holds %d keys, wanted 5", got)
+	}
+	if _, err := lru.Get(small[0]); err == nil {
+		t.Error("small's least recently used key should be evicted")
+	}
+}
+
+func TestAuxiliary_RejectsKeysWithSeparator(t *testing.T) {
+	aux := NewAuxiliary(numShards*100, "")
+
+	body := strings.NewReader(`{"key":"a\u0000b","value":"v"}`)
+	rec := httptest.NewRecorder()
+	aux.Put(rec, httptest.NewRequest(http.MethodPost, "/data", body))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Put: got status %d, want 400", rec.Code)
+	}
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/x", nil), map[string]string{"key": "a\x00b"})
+	rec = httptest.NewRecorder()
+	validateKey(http.HandlerFunc(aux.Get)).ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Get: got status %d, want 400", rec.Code)
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	quotas, err := parseQuotas("search=5000, batch=200", "search=1048576")
+	if err != nil {
+		t.Fatalf("parseQuotas: %v", err)
+	}
+	if quotas["search"] != (Quota{Keys: 5000, Bytes: 1048576}) || quotas["batch"] != (Quota{Keys: 200}) {
+		t.Errorf("parseQuotas: got %+v", quotas)
+	}
+	if _, err := parseQuotas("search=lots", ""); err == nil {
+		t.Error("parseQuotas: expected an error for a non-numeric quota")
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	cases := []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:42", true},
+		{"user:*", "order:42", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"key[0-9]", "key7", true},
+		{`a\*b`, "a*b", true},
+		{`a\*b`, "axb", false},
+	}
+	for _, c := range cases {
+		if got := globMatch(c.pattern, c.s); got != c.want {
+			t.Errorf("globMatch(%q, %q) = %v wanted %v", c.pattern, c.s, got, c.want)
+		}
+	}
+}
+
 func TestLRU_SaveAndLoadFromDisk(t *testing.T) {
 	filepath := "test.dat"
 
@@ -132,6 +914,10 @@ func TestLRU_SaveAndLoadFromDisk(t *testing.T) {
 	lru.Put("Name", "Alex", 0)
 	lru.Put("Age", "25", 0)
 	lru.Put("Country", "NP", 0)
+	lru.HSet("Profile", map[string]string{"lang": "go"})
+	lru.ZAdd("Board", map[string]float64{"alex": 42})
+	lru.PutIf(KeyVal{Key: "Country", Value: "NP", Tags: []string{"geo"}})
+	lru.Expire("Name", time.Hour, true)
 
 	if ok, err := lru.saveToDisk(); !ok {
 		t.Errorf("Failed to save to disk: err %v", err)
@@ -151,6 +937,22 @@ func TestLRU_SaveAndLoadFromDisk(t *testing.T) {
 		t.Errorf("Unexpected value for the key %s : wanted %s, got %s", "Name", "Alex", value)
 	}
 
+	if lang, err := newlru.HGet("Profile", "lang"); err != nil || lang != "go" {
+		t.Errorf("Unexpected hash field after reload: got %s err=%v", lang, err)
+	}
+
+	if _, score, err := newlru.ZRank("Board", "alex", false); err != nil || score != 42 {
+		t.Errorf("Unexpected sorted set score after reload: got %v err=%v", score, err)
+	}
+
+	if _, sliding, err := newlru.TTL("Name"); err != nil || !sliding {
+		t.Errorf("Unexpected expiry after reload: sliding=%v err=%v", sliding, err)
+	}
+
+	if keys := newlru.InvalidateTag("geo"); len(keys) != 1 || keys[0] != "Country" {
+		t.Errorf("Unexpected tag index after reload: got %v", keys)
+	}
+
 	err = os.Remove(filepath)
 	if err != nil {
 		t.Errorf("Failed to remove test file: err %v", err)
@@ -175,6 +977,506 @@ func Benchmark_LRUGet(b *testing.B) {
 	}
 }
 
+func TestLRU_RecencySurvivesRestart(t *testing.T) {
+	path := t.TempDir() + "/aux-data.dat"
+
+	// Five keys of one shard, so they compete for the same capacity.
+	var keys []string
+	for i := 0; len(keys) < 5; i++ {
+		if key := fmt.Sprintf("key-%d", i); shardIndex(key) == 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	lru := NewLRU(numShards*4, path)
+	for _, key := range keys[:4] {
+		lru.Put(key, "v", 0)
+	}
+	lru.Get(keys[0])
+	lru.Get(keys[1]) // most to least recent: 1, 0, 3, 2
+	if ok, err := lru.saveToDisk(); !ok {
+		t.Fatalf("saveToDisk: %v", err)
+	}
+
+	order := func(lru *LRU) []string {
+		var got []string
+		for curr := lru.shards[0].dll.Head; curr != nil; curr = curr.Next {
+			got = append(got, curr.Key)
+		}
+		return got
+	}
+	want := []string{keys[1], keys[0], keys[3], keys[2]}
+
+	restarted := NewLRU(numShards*4, path)
+	if ok, err := restarted.loadFromDisk(); !ok {
+		t.Fatalf("loadFromDisk: %v", err)
+	}
+	if got := order(restarted); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("recency after restart: got %v wanted %v", got, want)
+	}
+	restarted.Put(keys[4], "v", 0)
+	if _, err := restarted.Get(keys[2]); !errors.Is(err, ErrNotFound) {
+		t.Errorf("least recently used key %s survived eviction", keys[2])
+	}
+
+	// A smaller cache keeps the most recently used keys.
+	smaller := NewLRU(numShards*2, path)
+	if ok, err := smaller.loadFromDisk(); !ok {
+		t.Fatalf("loadFromDisk: %v", err)
+	}
+	if got := order(smaller); fmt.Sprint(got) != fmt.Sprint(want[:2]) {
+		t.Errorf("restore into a smaller cache: got %v wanted %v", got, want[:2])
+	}
+}
+
+func TestSnapshot_FallsBackWhenDamaged(t *testing.T) {
+	path := t.TempDir() + "/aux-data.dat"
+	opts := SnapshotOptions{Compress: true, Keep: 1}
+
+	lru := NewLRU(numShards*10, path)
+	lru.SetSnapshotOptions(opts)
+	lru.Put("k", "old", 0)
+	if ok, err := lru.saveToDisk(); !ok {
+		t.Fatalf("saveToDisk: %v", err)
+	}
+	lru.Put("k", "new", 0)
+	if ok, err := lru.saveToDisk(); !ok {
+		t.Fatalf("saveToDisk: %v", err)
+	}
+
+	load := func() string {
+		restarted := NewLRU(numShards*10, path)
+		restarted.SetSnapshotOptions(opts)
+		if ok, err := restarted.loadFromDisk(); !ok {
+			t.Fatalf("loadFromDisk: %v", err)
+		}
+		val, _ := restarted.Get("k")
+		return val
+	}
+	if val := load(); val != "new" {
+		t.Fatalf("intact snapshot: got %q wanted new", val)
+	}
+
+	data, _ := os.ReadFile(path)
+	data[len(data)-12] ^= 0xff // inside the last block's payload
+	os.WriteFile(path, data, 0644)
+	if val := load(); val != "old" {
+		t.Errorf("corrupt snapshot: got %q wanted old from the retained copy", val)
+	}
+
+	os.WriteFile(path, data[:len(data)-8], 0644) // no end marker
+	if _, err := readSnapshotFile(path); err == nil {
+		t.Error("truncated snapshot read without error")
+	}
+}
+
+func TestSnapshot_StreamsWhileWriting(t *testing.T) {
+	path := t.TempDir() + "/aux-data.dat"
+	const keys = numShards * snapshotBlockEntries * 2 // several blocks per shard
+
+	lru := NewLRU(keys*2, path)
+	for i := 0; i < keys; i++ {
+		lru.Put(fmt.Sprintf("key-%d", i), "v", 0)
+	}
+
+	// Writers keep going while the snapshot is taken; a shard is never
+	// locked for the whole save.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+				lru.Put(fmt.Sprintf("extra-%d", i), "v", 0)
+			}
+		}
+	}()
+	ok, err := lru.saveToDisk()
+	close(stop)
+	<-done
+	if !ok {
+		t.Fatalf("saveToDisk: %v", err)
+	}
+
+	duration, size, entries := lru.SnapshotStats()
+	if duration <= 0 || entries < keys {
+		t.Errorf("SnapshotStats: duration=%v entries=%d, wanted at least %d entries", duration, entries, keys)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != size {
+		t.Errorf("SnapshotStats size %d does not match file: %v err=%v", size, info, err)
+	}
+
+	restored, err := readSnapshotFile(path)
+	if err != nil {
+		t.Fatalf("readSnapshotFile: %v", err)
+	}
+	if int64(len(restored)) != entries {
+		t.Errorf("snapshot holds %d entries, stats say %d", len(restored), entries)
+	}
+}
+
+func TestSnapshot_ReadsLegacyFormat(t *testing.T) {
+	path := t.TempDir() + "/aux-data.dat"
+	f, _ := os.Create(path)
+	gob.NewEncoder(f).Encode(diskSnapshot{
+		Data:     map[string]string{"name": "alex"},
+		Hashes:   map[string]map[string]string{"profile": {"lang": "go"}},
+		Versions: map[string]uint64{"name": 7},
+		Tags:     map[string][]string{"name": {"people"}},
+	})
+	f.Close()
+
+	lru := NewLRU(numShards*10, path)
+	if ok, err := lru.loadFromDisk(); !ok {
+		t.Fatalf("loadFromDisk: %v", err)
+	}
+	if kv, err := lru.Lookup("name"); err != nil || kv.Value != "alex" || kv.Version != 7 {
+		t.Errorf("Lookup name: got %+v err=%v", kv, err)
+	}
+	if lang, err := lru.HGet("profile", "lang"); err != nil || lang != "go" {
+		t.Errorf("HGet: got %q err=%v", lang, err)
+	}
+	if keys := lru.InvalidateTag("people"); len(keys) != 1 {
+		t.Errorf("InvalidateTag: got %v wanted [name]", keys)
+	}
+
+	// The next save upgrades the file.
+	lru.saveToDisk()
+	if data, _ := os.ReadFile(path); !bytes.HasPrefix(data, []byte(snapshotMagic)) {
+		t.Error("snapshot was not rewritten in the block format")
+	}
+}
+
+func TestLRU_AppendLogReplay(t *testing.T) {
+	dir := t.TempDir()
+	snapPath, aofPath := dir+"/aux-data.dat", dir+"/aux-data.aof"
+
+	lru := NewLRU(numShards*10, snapPath)
+	if err := lru.OpenAppendLog(aofPath, FsyncAlways); err != nil {
+		t.Fatalf("OpenAppendLog: %v", err)
+	}
+	lru.Put("kept", "v1", 0)
+	lru.Put("deleted", "v", 0)
+	if err := lru.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	lru.Put("kept", "v2", 0)
+	lru.Delete("deleted")
+	lru.HSet("profile", map[string]string{"lang": "go"})
+	lru.SAdd("tags", []string{"a", "b"})
+	lru.Put("session", "s", 0)
+	lru.Expire("session", time.Hour, false)
+	// Crash: close the log without a final snapshot and leave a torn record.
+	lru.aof.close()
+	f, _ := os.OpenFile(aofPath, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0x42, 0x00, 0x01})
+	f.Close()
+
+	restarted := NewLRU(numShards*10, snapPath)
+	if ok, err := restarted.loadFromDisk(); !ok {
+		t.Fatalf("loadFromDisk: %v", err)
+	}
+	if err := restarted.OpenAppendLog(aofPath, FsyncEverySec); err != nil {
+		t.Fatalf("OpenAppendLog after crash: %v", err)
+	}
+	defer restarted.aof.close()
+
+	if val, err := restarted.Get("kept"); err != nil || val != "v2" {
+		t.Errorf("Get kept: got %q err=%v wanted v2", val, err)
+	}
+	if _, err := restarted.Get("deleted"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get deleted: got %v wanted ErrNotFound", err)
+	}
+	if lang, err := restarted.HGet("profile", "lang"); err != nil || lang != "go" {
+		t.Errorf("HGet: got %q err=%v wanted go", lang, err)
+	}
+	if n, err := restarted.SCard("tags"); err != nil || n != 2 {
+		t.Errorf("SCard: got %d err=%v wanted 2", n, err)
+	}
+	if ttl, _, err := restarted.TTL("session"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("TTL session: got %v err=%v wanted ~1h", ttl, err)
+	}
+	// Opening folded the log into the snapshot and started an empty one.
+	if info, err := os.Stat(aofPath); err != nil || info.Size() != 0 {
+		t.Errorf("append-only file after open: %v err=%v wanted empty", info, err)
+	}
+}
+
+func TestLRU_AppendLogReplaysTypedOps(t *testing.T) {
+	dir := t.TempDir()
+	snapPath, aofPath := dir+"/aux-data.dat", dir+"/aux-data.aof"
+
+	lru := NewLRU(numShards*10, snapPath)
+	if err := lru.OpenAppendLog(aofPath, FsyncAlways); err != nil {
+		t.Fatalf("OpenAppendLog: %v", err)
+	}
+	long := make([]string, 1000)
+	for i := range long {
+		long[i] = strings.Repeat("x", 100)
+	}
+	lru.Push("big", long, false)
+	before := lru.AppendLogSize()
+	lru.Push("big", []string{"y"}, true)
+	if grew := lru.AppendLogSize() - before; grew > 1024 {
+		t.Errorf("pushing one element logged %d bytes; the list should not be logged whole", grew)
+	}
+
+	// A compaction that crashes after saving its snapshot leaves records
+	// the snapshot already holds in both logs.
+	lru.Push("queue", []string{"a", "b"}, false)
+	lru.Push("queue", []string{"c"}, true)
+	lru.Pop("queue", false)
+	lru.Trim("queue", 1, -1)
+	lru.HIncrBy("counts", "hits", 5)
+	lru.ZIncrBy("board", "ann", 2)
+	if err := lru.aof.rotate(); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	lru.Push("queue", []string{"d"}, false)
+	lru.Expire("counts", time.Hour, false)
+	lru.HIncrBy("counts", "hits", 1)
+	lru.ZIncrBy("board", "ann", 1)
+	lru.SAdd("seen", []string{"x"})
+	if ok, err := lru.saveToDisk(); !ok {
+		t.Fatalf("saveToDisk: %v", err)
+	}
+	lru.SRem("seen", []string{"x", "y"})
+	lru.SAdd("seen", []string{"y"})
+	lru.aof.close()
+
+	restarted := NewLRU(numShards*10, snapPath)
+	if ok, err := restarted.loadFromDisk(); !ok {
+		t.Fatalf("loadFromDisk: %v", err)
+	}
+	if err := restarted.OpenAppendLog(aofPath, FsyncEverySec); err != nil {
+		t.Fatalf("OpenAppendLog: %v", err)
+	}
+	defer restarted.aof.close()
+
+	if got, err := restarted.Range("queue", 0, -1); err != nil || strings.Join(got, ",") != "a,d" {
+		t.Errorf("Range queue: got %v err=%v wanted [a d]", got, err)
+	}
+	if n, err := restarted.Range("big", 0, -1); err != nil || len(n) != 1001 || n[0] != "y" {
+		t.Errorf("Range big: got %d elements err=%v, wanted 1001 starting with y", len(n), err)
+	}
+	if hits, err := restarted.HGet("counts", "hits"); err != nil || hits != "6" {
+		t.Errorf("HGet: got %q err=%v wanted 6", hits, err)
+	}
+	if _, score, err := restarted.ZRank("board", "ann", false); err != nil || score != 3 {
+		t.Errorf("ZRank: got score %v err=%v wanted 3", score, err)
+	}
+	if members, err := restarted.SMembers("seen"); err != nil || len(members) != 1 || members[0] != "y" {
+		t.Errorf("SMembers: got %v err=%v wanted [y]", members, err)
+	}
+}
+
+func TestLRU_EntryCopiesTypedValue(t *testing.T) {
+	primary, replica := NewLRU(numShards*10, ""), NewLRU(numShards*10, "")
+	copyEntry := func() {
+		t.Helper()
+		rec, ok := primary.Entry("profile")
+		if !ok {
+			t.Fatal("Entry: profile not found")
+		}
+		var buf bytes.Buffer
+		sw := newSnapshotWriter(&buf, false)
+		sw.writeBlock([]entryRecord{rec})
+		sw.close()
+		if held, _, err := replica.ImportSnapshot(&buf); err != nil || held != 1 {
+			t.Fatalf("ImportSnapshot: held %d err=%v", held, err)
+		}
+	}
+
+	primary.HSet("profile", map[string]string{"lang": "go"})
+	copyEntry()
+	if lang, err := replica.HGet("profile", "lang"); err != nil || lang != "go" {
+		t.Errorf("HGet: got %q err=%v wanted go", lang, err)
+	}
+
+	// An expiry change is a new version, so its copy replaces the old one.
+	primary.Expire("profile", time.Hour, false)
+	copyEntry()
+	if ttl, _, err := replica.TTL("profile"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("TTL: got %v err=%v wanted ~1h", ttl, err)
+	}
+	if _, ok := primary.Entry("missing"); ok {
+		t.Error("Entry: found a missing key")
+	}
+}
+
+// exportAll writes every page of an export of ranges to w as one snapshot
+// stream and returns how many entries and pages it held.
+func exportAll(t *testing.T, lru *LRU, ranges []HashRange, w io.Writer) (entries, pages int) {
+	t.Helper()
+	sw := newSnapshotWriter(w, false)
+	for cursor := "0"; ; pages++ {
+		recs, next, err := lru.ExportRanges(ranges, cursor)
+		if err != nil {
+			t.Fatalf("ExportRanges: %v", err)
+		}
+		if len(recs) > 0 {
+			sw.writeBlock(recs)
+		}
+		entries += len(recs)
+		if next == "0" {
+			sw.close()
+			return entries, pages + 1
+		}
+		cursor = next
+	}
+}
+
+func TestLRU_ExportPages(t *testing.T) {
+	lru := NewLRU(numShards*300, "")
+	for i := 0; i < 3000; i++ {
+		lru.Put(fmt.Sprintf("key-%d", i), "v", 0)
+	}
+	var buf bytes.Buffer
+	entries, pages := exportAll(t, lru, []HashRange{{Start: 0, End: 0}}, &buf)
+	if entries != 3000 || pages < 3 {
+		t.Errorf("export: got %d entries in %d pages, wanted 3000 in at least 3", entries, pages)
+	}
+	recs, err := readSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("readSnapshot: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, rec := range recs {
+		if seen[rec.Key] {
+			t.Errorf("key %s exported twice", rec.Key)
+		}
+		seen[rec.Key] = true
+	}
+
+	// A narrow range is walked in bounded batches across many keys outside it.
+	narrow := []HashRange{{Start: 0, End: 1 << 26}}
+	in, want := inRanges(narrow), 0
+	for i := 0; i < 3000; i++ {
+		if in(fmt.Sprintf("key-%d", i)) {
+			want++
+		}
+	}
+	if entries, _ := exportAll(t, lru, narrow, io.Discard); entries != want {
+		t.Errorf("export of a narrow range: got %d entries wanted %d", entries, want)
+	}
+}
+
+func TestLRU_MoveRanges(t *testing.T) {
+	from, to := NewLRU(numShards*100, ""), NewLRU(numShards*100, "")
+	for i := 0; i < 200; i++ {
+		from.Put(fmt.Sprintf("key-%d", i), "v", 0)
+	}
+	ranges := []HashRange{{Start: 1 << 30, End: 1 << 31}, {Start: 3 << 30, End: 1 << 29}} // the second wraps
+
+	var buf bytes.Buffer
+	exported, _ := exportAll(t, from, ranges, &buf)
+	if imported, received, err := to.ImportSnapshot(&buf); err != nil || imported != exported || received != exported {
+		t.Fatalf("ImportSnapshot: got %d of %d entries err=%v, wanted %d", imported, received, err, exported)
+	}
+	if counts := from.CountRanges(ranges); counts[0]+counts[1] != exported {
+		t.Errorf("CountRanges: got %v, wanted %d keys in total", counts, exported)
+	}
+	if dropped := from.DropRanges(ranges); dropped != exported {
+		t.Errorf("DropRanges removed %d keys, wanted %d", dropped, exported)
+	}
+
+	keep := inRanges(ranges)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		_, errFrom := from.Get(key)
+		_, errTo := to.Get(key)
+		if moved := keep(key); moved != (errTo == nil) || moved == (errFrom == nil) {
+			t.Errorf("key %s: in ranges %v, on old owner %v, on new owner %v", key, moved, errFrom == nil, errTo == nil)
+		}
+	}
+}
+
+func TestLRU_ImportIntoFullCache(t *testing.T) {
+	from, to := NewLRU(numShards*100, ""), NewLRU(numShards, "") // one entry per shard
+	for i := 0; i < 200; i++ {
+		from.Put(fmt.Sprintf("key-%d", i), "v", 0)
+		to.Put(fmt.Sprintf("old-%d", i), "v", 0)
+	}
+	all := []HashRange{{Start: 0, End: 0}}
+
+	var buf bytes.Buffer
+	exported, _ := exportAll(t, from, all, &buf)
+	imported, received, err := to.ImportSnapshot(&buf)
+	if err != nil || received != exported {
+		t.Fatalf("ImportSnapshot: received %d of %d entries, err=%v", received, exported, err)
+	}
+	held := 0
+	for i := 0; i < 200; i++ {
+		if _, err := to.Get(fmt.Sprintf("key-%d", i)); err == nil {
+			held++
+		}
+	}
+	if held == 0 {
+		t.Error("a full cache imported nothing; imports should evict like writes")
+	}
+	if imported != held || imported >= exported {
+		t.Errorf("ImportSnapshot reported %d entries, the cache holds %d of the %d sent", imported, held, exported)
+	}
+}
+
+func TestWarmBoot(t *testing.T) {
+	joiner := NewAuxiliary(numShards*100, "")
+	joiner.LRU.Put("key-0", "local", 0) // older than the source's copy
+
+	source := NewAuxiliary(numShards*100, "")
+	for i := 0; i < 200; i++ {
+		source.LRU.Put(fmt.Sprintf("key-%d", i), "v", 0)
+	}
+	source.LRU.HSet("profile", map[string]string{"lang": "go"})
+	sourceSrv := httptest.NewServer(http.HandlerFunc(source.Export))
+	defer sourceSrv.Close()
+
+	half := HashRange{Start: 0, End: 1 << 31}
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/nodes/aux4:3004/ranges" {
+			http.NotFound(w, r)
+			return
+		}
+		// The first source is down, so the copy falls back to the second.
+		writeJSON(w, []RangeTransfer{{HashRange: half, Sources: []string{"127.0.0.1:1", strings.TrimPrefix(sourceSrv.URL, "http://")}}})
+	}))
+	defer master.Close()
+
+	n, err := joiner.WarmBoot(strings.TrimPrefix(master.URL, "http://"), "aux4:3004")
+	if err != nil {
+		t.Fatalf("WarmBoot: %v", err)
+	}
+
+	want := 0
+	for key := range source.LRU.GetAll() {
+		inHalf := half.Contains(crc32.ChecksumIEEE([]byte(key)))
+		_, err := joiner.LRU.Lookup(key)
+		if inHalf {
+			want++
+		}
+		if inHalf && err != nil || !inHalf && err == nil && key != "key-0" {
+			t.Errorf("key %s: in range %v, copied %v", key, inHalf, err == nil)
+		}
+	}
+	if half.Contains(crc32.ChecksumIEEE([]byte("profile"))) {
+		want++
+		if lang, err := joiner.LRU.HGet("profile", "lang"); err != nil || lang != "go" {
+			t.Errorf("hash not copied: got %q err=%v", lang, err)
+		}
+	}
+	if n != want {
+		t.Errorf("WarmBoot copied %d entries, wanted %d", n, want)
+	}
+	if half.Contains(crc32.ChecksumIEEE([]byte("key-0"))) {
+		if val, _ := joiner.LRU.Get("key-0"); val != "v" {
+			t.Errorf("newer copy of key-0 not taken: got %q", val)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	m.Run()
 }
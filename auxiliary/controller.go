@@ -3,11 +3,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,14 +22,65 @@ type Auxiliary struct {
 	LRU          *LRU
 	requests     *prometheus.CounterVec
 	responseTime *prometheus.HistogramVec
+	ready        atomic.Bool // set once the node has warmed up and registered
 }
 
 type KeyVal struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	TTL     int    `json:"ttl,omitempty"`     // seconds; 0 means no expiry
+	Version uint64 `json:"version,omitempty"` // assigned by the master on write
+
+	// Optional write conditions, evaluated atomically with the write.
+	Cond      string `json:"cond,omitempty"`       // CondNotExists or CondExists
+	IfVersion uint64 `json:"if_version,omitempty"` // compare-and-swap against this version
+
+	// Tags group unrelated keys for invalidation; see LRU.InvalidateTag.
+	Tags []string `json:"tags,omitempty"`
+
+	// Sliding makes TTL a window that every read restarts.
+	Sliding bool `json:"sliding,omitempty"`
+
+	// Stampede protection for keys with a TTL. Grace keeps serving the value
+	// for that many seconds past its TTL while one reader refreshes it;
+	// Recompute, the milliseconds it takes to rebuild the value, makes reads
+	// ask for a refresh shortly before the TTL runs out.
+	Grace     int `json:"grace,omitempty"`
+	Recompute int `json:"recompute_ms,omitempty"`
+
+	// Set on reads only. Stale marks a value past its TTL, within its grace
+	// period. Refresh asks this reader, and no concurrent one, to rebuild
+	// the value and write it back.
+	Stale   bool `json:"stale,omitempty"`
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+// TTLInfo is the expiry of a key as reported by the TTL operations. TTL is
+// in seconds, -1 if the key never expires.
+type TTLInfo struct {
+	Key     string `json:"key"`
+	TTL     int    `json:"ttl"`
+	Sliding bool   `json:"sliding,omitempty"`
+}
+
+// Increment is the body of an INCR/DECR request.
+type Increment struct {
+	Key     string `json:"key"`
+	Delta   int64  `json:"delta"`
+	TTL     int    `json:"ttl,omitempty"`     // applied only when the counter is created
+	Version uint64 `json:"version,omitempty"` // assigned by the master on write
+}
+
+// Counter is the result of an INCR/DECR request.
+type Counter struct {
 	Key   string `json:"key"`
-	Value string `json:"value"`
-	TTL   int    `json:"ttl,omitempty"` // seconds; 0 means no expiry
+	Value int64  `json:"value"`
 }
 
+// maxBlockTimeout caps blocking pops so they finish within the server's
+// write timeout.
+const maxBlockTimeout = 10 * time.Second
+
 var (
 	auxMetricsOnce     sync.Once
 	auxRequests        *prometheus.CounterVec
@@ -38,7 +93,7 @@ func NewAuxiliary(bucketSize int, filepath string) *Auxiliary {
 			prometheus.CounterOpts{
 				Name: "auxiliary_request_total",
 				Help: "Total number of requests to the auxiliary node",
-			}, []string{"method"},
+			}, []string{"method", "namespace"},
 		)
 		auxResponseTime = prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
@@ -46,7 +101,7 @@ func NewAuxiliary(bucketSize int, filepath string) *Auxiliary {
 				Help:    "Distribution of the response time processed by the auxiliary server",
 				Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
 			},
-			[]string{"method"},
+			[]string{"method", "namespace"},
 		)
 		prometheus.MustRegister(auxRequests, auxResponseTime)
 	})
@@ -63,38 +118,612 @@ func (aux *Auxiliary) Put(w http.ResponseWriter, r *http.Request) {
 
 	var kv KeyVal
 
-	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil || !validEntry(kv) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	if kv.Cond != "" && kv.Cond != CondNotExists && kv.Cond != CondExists {
+		http.Error(w, fmt.Sprintf("unknown write condition %q", kv.Cond), http.StatusBadRequest)
+		return
+	}
 
-	aux.LRU.Put(kv.Key, kv.Value, kv.TTL)
+	// With ?previous=true the replaced entry is returned, so the master can
+	// undo the write with Revert if its backing store rejects it.
+	if kv.Version == 0 {
+		kv.Version = nextVersion()
+	}
+	prev, err := aux.LRU.SwapIf(nsEntry(r, kv))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 
 	elapsedTime := time.Since(startTime).Seconds()
-	aux.requests.WithLabelValues(r.Method).Inc()
-	aux.responseTime.WithLabelValues(r.Method).Observe(elapsedTime)
+	aux.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	aux.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+	if r.URL.Query().Get("previous") == "true" {
+		writeJSON(w, revertRequest{Version: kv.Version, Previous: prev})
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 
 }
 
+// revertRequest undoes a write: the key is put back to Previous, or removed
+// when Previous is nil, if it still holds Version.
+type revertRequest struct {
+	Version  uint64       `json:"version"`
+	Previous *entryRecord `json:"previous"`
+}
+
+// Revert undoes a write returned by Put with ?previous=true. It answers 409
+// when the key has been written again since.
+func (aux *Auxiliary) Revert(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	var req revertRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !aux.LRU.Revert(nsKey(r, key), req.Version, req.Previous) {
+		http.Error(w, fmt.Sprintf("key %s was written again", key), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (aux *Auxiliary) Get(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
 	vars := mux.Vars(r)
 	key := vars["key"]
 
-	val, err := aux.LRU.Get(key)
+	kv, err := aux.LRU.Lookup(nsKey(r, key))
+	kv.Key = key
 
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		writeError(w, err)
 		return
 	}
 
 	elapsedTime := time.Since(startTime).Seconds()
-	aux.requests.WithLabelValues(r.Method).Inc()
-	aux.responseTime.WithLabelValues(r.Method).Observe(elapsedTime)
+	aux.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	aux.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(KeyVal{Key: key, Value: val})
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatUint(kv.Version, 10)))
+	json.NewEncoder(w).Encode(kv)
+}
+
+func (aux *Auxiliary) Incr(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+
+	var inc Increment
+	if err := json.NewDecoder(r.Body).Decode(&inc); err != nil || inc.Key == "" || !validKey(inc.Key) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	val, err := aux.LRU.Incr(nsKey(r, inc.Key), inc.Delta, inc.TTL, inc.Version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	elapsedTime := time.Since(startTime).Seconds()
+	aux.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	aux.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Counter{Key: inc.Key, Value: val})
+}
+
+// Expire sets the key named in the path to expire after {"ttl": seconds}.
+// With {"sliding": true} every read of the key restarts the countdown.
+func (aux *Auxiliary) Expire(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	var req struct {
+		TTL     int  `json:"ttl"`
+		Sliding bool `json:"sliding"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TTL <= 0 {
+		http.Error(w, "ttl must be a positive number of seconds", http.StatusBadRequest)
+		return
+	}
+
+	if err := aux.LRU.Expire(nsKey(r, key), time.Duration(req.TTL)*time.Second, req.Sliding); err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, TTLInfo{Key: key, TTL: req.TTL, Sliding: req.Sliding})
+}
+
+// Persist removes the expiry of the key named in the path.
+func (aux *Auxiliary) Persist(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	had, err := aux.LRU.Persist(nsKey(r, key))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"key": key, "persisted": had})
+}
+
+// TTL reports how long the key named in the path has left to live.
+func (aux *Auxiliary) TTL(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	ttl, sliding, err := aux.LRU.TTL(nsKey(r, key))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, TTLInfo{Key: key, TTL: ttlSeconds(ttl), Sliding: sliding})
+}
+
+// Touch marks the key named in the path as used, restarting a sliding
+// expiry, without returning its value.
+func (aux *Auxiliary) Touch(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	ttl, sliding, err := aux.LRU.Touch(nsKey(r, key))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, TTLInfo{Key: key, TTL: ttlSeconds(ttl), Sliding: sliding})
+}
+
+func (aux *Auxiliary) HSet(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	var req struct {
+		Fields map[string]string `json:"fields"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Fields) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	added, err := aux.LRU.HSet(nsKey(r, key), req.Fields)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]int{"added": added})
+}
+
+func (aux *Auxiliary) HGetAll(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	fields, err := aux.LRU.HGetAll(nsKey(r, key))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"key": key, "fields": fields})
+}
+
+func (aux *Auxiliary) HGet(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	vars := mux.Vars(r)
+
+	val, err := aux.LRU.HGet(nsKey(r, vars["key"]), vars["field"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]string{"key": vars["key"], "field": vars["field"], "value": val})
+}
+
+func (aux *Auxiliary) HDel(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	fields := r.URL.Query()["field"]
+	if len(fields) == 0 {
+		http.Error(w, "at least one field is required", http.StatusBadRequest)
+		return
+	}
+
+	removed, err := aux.LRU.HDel(nsKey(r, key), fields)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]int{"removed": removed})
+}
+
+func (aux *Auxiliary) HIncrBy(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	vars := mux.Vars(r)
+
+	var req struct {
+		Delta int64 `json:"delta"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	val, err := aux.LRU.HIncrBy(nsKey(r, vars["key"]), vars["field"], req.Delta)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]int64{"value": val})
+}
+
+// Push handles both LPUSH and RPUSH; left selects the head of the list.
+func (aux *Auxiliary) Push(left bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		key := mux.Vars(r)["key"]
+
+		var req struct {
+			Values []string `json:"values"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Values) == 0 {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		length, err := aux.LRU.Push(nsKey(r, key), req.Values, left)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		aux.observe(r, startTime)
+		writeJSON(w, map[string]int{"length": length})
+	}
+}
+
+// Pop handles LPOP and RPOP. With a ?timeout=<seconds> query parameter it
+// blocks until an element is available or the timeout passes.
+func (aux *Auxiliary) Pop(left bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		key := mux.Vars(r)["key"]
+
+		var timeout time.Duration
+		if raw := r.URL.Query().Get("timeout"); raw != "" {
+			secs, err := strconv.ParseFloat(raw, 64)
+			if err != nil || secs < 0 {
+				http.Error(w, "timeout must be a non-negative number of seconds", http.StatusBadRequest)
+				return
+			}
+			timeout = time.Duration(secs * float64(time.Second))
+			if timeout > maxBlockTimeout {
+				timeout = maxBlockTimeout
+			}
+		}
+
+		var val string
+		var err error
+		if timeout > 0 {
+			val, err = aux.LRU.BlockingPop(r.Context(), nsKey(r, key), left, timeout)
+		} else {
+			val, err = aux.LRU.Pop(nsKey(r, key), left)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		aux.observe(r, startTime)
+		writeJSON(w, KeyVal{Key: key, Value: val})
+	}
+}
+
+func (aux *Auxiliary) Range(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	start, stop, ok := parseBounds(r.URL.Query().Get("start"), r.URL.Query().Get("stop"))
+	if !ok {
+		http.Error(w, "start and stop must be integers", http.StatusBadRequest)
+		return
+	}
+
+	values, err := aux.LRU.Range(nsKey(r, key), start, stop)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"key": key, "values": values})
+}
+
+func (aux *Auxiliary) Trim(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	var req struct {
+		Start int `json:"start"`
+		Stop  int `json:"stop"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	length, err := aux.LRU.Trim(nsKey(r, key), req.Start, req.Stop)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]int{"length": length})
+}
+
+// SetMembers handles SADD (remove=false) and SREM (remove=true).
+func (aux *Auxiliary) SetMembers(remove bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+		key := mux.Vars(r)["key"]
+
+		var req struct {
+			Members []string `json:"members"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Members) == 0 {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		var n int
+		var err error
+		if remove {
+			n, err = aux.LRU.SRem(nsKey(r, key), req.Members)
+		} else {
+			n, err = aux.LRU.SAdd(nsKey(r, key), req.Members)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		aux.observe(r, startTime)
+		if remove {
+			writeJSON(w, map[string]int{"removed": n})
+		} else {
+			writeJSON(w, map[string]int{"added": n})
+		}
+	}
+}
+
+func (aux *Auxiliary) SMembers(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	members, err := aux.LRU.SMembers(nsKey(r, key))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"key": key, "members": members})
+}
+
+func (aux *Auxiliary) SIsMember(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	vars := mux.Vars(r)
+
+	ok, err := aux.LRU.SIsMember(nsKey(r, vars["key"]), vars["member"])
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"member": vars["member"], "is_member": ok})
+}
+
+func (aux *Auxiliary) SCard(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	n, err := aux.LRU.SCard(nsKey(r, key))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]int{"cardinality": n})
+}
+
+func (aux *Auxiliary) ZAdd(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	var req struct {
+		Members map[string]float64 `json:"members"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Members) == 0 {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	added, err := aux.LRU.ZAdd(nsKey(r, key), req.Members)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]int{"added": added})
+}
+
+func (aux *Auxiliary) ZIncrBy(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+
+	var req struct {
+		Member string  `json:"member"`
+		Delta  float64 `json:"delta"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Member == "" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	score, err := aux.LRU.ZIncrBy(nsKey(r, key), req.Member, req.Delta)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, ScoredMember{Member: req.Member, Score: score})
+}
+
+// ZRange returns members by rank (?start=&stop=), ascending unless ?rev=true.
+func (aux *Auxiliary) ZRange(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+	q := r.URL.Query()
+
+	start, stop, ok := parseBounds(q.Get("start"), q.Get("stop"))
+	if !ok {
+		http.Error(w, "start and stop must be integers", http.StatusBadRequest)
+		return
+	}
+
+	members, err := aux.LRU.ZRange(nsKey(r, key), start, stop, q.Get("rev") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"key": key, "members": members})
+}
+
+// ZRangeByScore returns members with ?min= <= score <= ?max= (either may be
+// omitted or given as -inf/+inf), ascending unless ?rev=true.
+func (aux *Auxiliary) ZRangeByScore(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	key := mux.Vars(r)["key"]
+	q := r.URL.Query()
+
+	min, max := math.Inf(-1), math.Inf(1)
+	var err error
+	if raw := q.Get("min"); raw != "" {
+		if min, err = strconv.ParseFloat(raw, 64); err != nil {
+			http.Error(w, "min must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+	if raw := q.Get("max"); raw != "" {
+		if max, err = strconv.ParseFloat(raw, 64); err != nil {
+			http.Error(w, "max must be a number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	members, err := aux.LRU.ZRangeByScore(nsKey(r, key), min, max, q.Get("rev") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"key": key, "members": members})
+}
+
+func (aux *Auxiliary) ZRank(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	vars := mux.Vars(r)
+
+	rank, score, err := aux.LRU.ZRank(nsKey(r, vars["key"]), vars["member"], r.URL.Query().Get("rev") == "true")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"member": vars["member"], "rank": rank, "score": score})
+}
+
+// parseBounds parses optional start/stop query values, defaulting to the
+// whole range (0, -1).
+func parseBounds(rawStart, rawStop string) (int, int, bool) {
+	start, stop := 0, -1
+	var err error
+	if rawStart != "" {
+		if start, err = strconv.Atoi(rawStart); err != nil {
+			return 0, 0, false
+		}
+	}
+	if rawStop != "" {
+		if stop, err = strconv.Atoi(rawStop); err != nil {
+			return 0, 0, false
+		}
+	}
+	return start, stop, true
+}
+
+// Scan returns one page of keys (?cursor=&count=&match=&type=). Iterate
+// until the returned cursor is "0".
+func (aux *Auxiliary) Scan(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	q := r.URL.Query()
+
+	count := 0
+	if raw := q.Get("count"); raw != "" {
+		var err error
+		if count, err = strconv.Atoi(raw); err != nil || count <= 0 {
+			http.Error(w, "count must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	kind := q.Get("type")
+	switch kind {
+	case "", "string", "hash", "list", "set", "zset":
+	default:
+		http.Error(w, fmt.Sprintf("unknown type %q", kind), http.StatusBadRequest)
+		return
+	}
+
+	page, err := aux.LRU.Scan(namespaceOf(r), q.Get("cursor"), count, q.Get("match"), kind)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	aux.observe(r, startTime)
+	writeJSON(w, page)
+}
+
+// DeleteMatching removes every key with the given ?prefix= and/or matching
+// the glob ?match=, or only counts them with ?dry_run=true.
+func (aux *Auxiliary) DeleteMatching(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	q := r.URL.Query()
+
+	prefix, match := q.Get("prefix"), q.Get("match")
+	if prefix == "" && match == "" {
+		http.Error(w, "prefix or match is required", http.StatusBadRequest)
+		return
+	}
+	dryRun := q.Get("dry_run") == "true"
+
+	keys := aux.LRU.DeleteMatching(namespaceOf(r), prefix, match, dryRun)
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"count": len(keys), "keys": keys, "dry_run": dryRun})
+}
+
+// InvalidateTag removes every key carrying the tag named in the path.
+func (aux *Auxiliary) InvalidateTag(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	keys := aux.LRU.InvalidateTag(nsKey(r, mux.Vars(r)["tag"]))
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"count": len(keys), "keys": keys})
 }
 
 func (aux *Auxiliary) Mappings(w http.ResponseWriter, r *http.Request) {
@@ -105,7 +734,7 @@ func (aux *Auxiliary) Mappings(w http.ResponseWriter, r *http.Request) {
 func (aux *Auxiliary) Delete(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	if !aux.LRU.Delete(key) {
+	if !aux.LRU.Delete(nsKey(r, key)) {
 		http.Error(w, fmt.Sprintf("key %s not found", key), http.StatusNotFound)
 		return
 	}
@@ -118,6 +747,15 @@ func (aux *Auxiliary) BulkPut(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	for i := range entries {
+		if !validEntry(entries[i]) {
+			http.Error(w, fmt.Sprintf("invalid key %q", entries[i].Key), http.StatusBadRequest)
+			return
+		}
+	}
+	for i := range entries {
+		entries[i] = nsEntry(r, entries[i])
+	}
 	aux.LRU.BulkPut(entries)
 	w.WriteHeader(http.StatusOK)
 }
@@ -128,9 +766,15 @@ func (aux *Auxiliary) BulkGet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	for _, key := range keys {
+		if !validKey(key) {
+			http.Error(w, fmt.Sprintf("invalid key %q", key), http.StatusBadRequest)
+			return
+		}
+	}
 	result := make(map[string]string, len(keys))
 	for _, key := range keys {
-		if val, err := aux.LRU.Get(key); err == nil {
+		if val, err := aux.LRU.Get(nsKey(r, key)); err == nil {
 			result[key] = val
 		}
 	}
@@ -138,15 +782,67 @@ func (aux *Auxiliary) BulkGet(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(result)
 }
 
-func (aux *Auxiliary) Erase(w http.ResponseWriter, r *http.Request) {
-	aux.LRU.EraseCache()
-	w.WriteHeader(http.StatusOK)
+// FlushNamespace removes every key of the namespace named in the path.
+func (aux *Auxiliary) FlushNamespace(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	ns := mux.Vars(r)["ns"]
+	if !namespacePattern.MatchString(ns) {
+		http.Error(w, fmt.Sprintf("invalid namespace %q", ns), http.StatusBadRequest)
+		return
+	}
+	keys := aux.LRU.FlushNamespace(ns)
+	aux.observe(r, startTime)
+	writeJSON(w, map[string]interface{}{"namespace": ns, "count": len(keys), "keys": keys})
+}
+
+// nsEntry maps a write's key and tags into the request's namespace.
+func nsEntry(r *http.Request, kv KeyVal) KeyVal {
+	kv.Key = nsKey(r, kv.Key)
+	if len(kv.Tags) > 0 {
+		tags := make([]string, len(kv.Tags))
+		for i, tag := range kv.Tags {
+			tags[i] = nsKey(r, tag)
+		}
+		kv.Tags = tags
+	}
+	return kv
 }
 
 func (aux *Auxiliary) Health(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func (aux *Auxiliary) observe(r *http.Request, startTime time.Time) {
+	ns := namespaceOf(r)
+	aux.requests.WithLabelValues(r.Method, ns).Inc()
+	aux.responseTime.WithLabelValues(r.Method, ns).Observe(time.Since(startTime).Seconds())
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError maps cache errors to HTTP status codes.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrConflict):
+		status = http.StatusConflict
+	case errors.Is(err, ErrWrongType):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrNotInteger):
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// SendMappings tells the master this node is shutting down. The body holds
+// the node's plain values, by raw key, which the master keeps as a backup;
+// the master copies the node's ranges, of every type, away through export
+// while the request is open, so the node must still be serving.
 func (aux *Auxiliary) SendMappings() {
 
 	postBody, err := json.Marshal(aux.LRU.GetAll())
@@ -157,7 +853,8 @@ func (aux *Auxiliary) SendMappings() {
 
 	log.Println("sending mappings to master server...")
 
-	client := &http.Client{Timeout: 10 * time.Second}
+	// Long enough for the master to copy this node's ranges.
+	client := &http.Client{Timeout: 60 * time.Second}
 	masterServer := os.Getenv("MASTER_SERVER")
 	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/rebalance-dead-aux", masterServer), bytes.NewBuffer(postBody))
 	if err != nil {
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// reapBatch bounds how many expired keys the reaper removes per lock hold,
+// so a burst of expiries never blocks readers of a shard for long.
+const reapBatch = 256
+
+// expiryItem is one deadline in an expiryHeap.
+type expiryItem struct {
+	key string
+	at  time.Time
+	pos int // index in the queue, maintained by the heap
+}
+
+// expiryQueue implements heap.Interface ordered by deadline.
+type expiryQueue []*expiryItem
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].pos = i
+	q[j].pos = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.pos = len(*q)
+	*q = append(*q, item)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// expiryHeap holds the deadlines of a shard's keys: a min-heap, so the next
+// key to expire is always at the top, plus an index by key so a deadline can
+// be read, moved or dropped in O(log n). Finding expired keys therefore costs
+// time proportional to the keys that actually expired.
+type expiryHeap struct {
+	queue expiryQueue
+	index map[string]*expiryItem
+}
+
+func newExpiryHeap() expiryHeap {
+	return expiryHeap{index: make(map[string]*expiryItem)}
+}
+
+// get returns the deadline of key, if it has one.
+func (h *expiryHeap) get(key string) (time.Time, bool) {
+	item, ok := h.index[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return item.at, true
+}
+
+// set gives key the deadline at, replacing any previous one.
+func (h *expiryHeap) set(key string, at time.Time) {
+	if item, ok := h.index[key]; ok {
+		item.at = at
+		heap.Fix(&h.queue, item.pos)
+		return
+	}
+	item := &expiryItem{key: key, at: at}
+	h.index[key] = item
+	heap.Push(&h.queue, item)
+}
+
+// remove drops the deadline of key and reports whether it had one.
+func (h *expiryHeap) remove(key string) bool {
+	item, ok := h.index[key]
+	if !ok {
+		return false
+	}
+	heap.Remove(&h.queue, item.pos)
+	delete(h.index, key)
+	return true
+}
+
+// next returns the key with the earliest deadline.
+func (h *expiryHeap) next() (string, time.Time, bool) {
+	if len(h.queue) == 0 {
+		return "", time.Time{}, false
+	}
+	return h.queue[0].key, h.queue[0].at, true
+}
+
+// expiredLocked reports whether key has passed its deadline. Caller must
+// hold s.mu.
+func (s *lruShard) expiredLocked(key string, now time.Time) bool {
+	exp, ok := s.expiry.get(key)
+	return ok && now.After(exp)
+}
+
+// reapLocked removes up to limit keys whose deadline has passed, earliest
+// first, and returns how many it removed. Caller must hold s.mu.
+func (s *lruShard) reapLocked(now time.Time, limit int) int {
+	n := 0
+	for ; n < limit; n++ {
+		key, at, ok := s.expiry.next()
+		if !ok || !now.After(at) {
+			break
+		}
+		if node, ok := s.bucket[key]; ok {
+			s.removeLocked(node)
+		} else {
+			s.expiry.remove(key)
+		}
+	}
+	s.expired += int64(n)
+	return n
+}
+
+// startReaper launches a background goroutine that removes expired keys
+// every interval. Each pass only looks at keys that have expired, so the
+// interval can be short without costing anything on an idle cache.
+func (lru *LRU) startReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			lru.reapExpired()
+		}
+	}()
+}
+
+// reapExpired removes every expired key, taking each shard lock once per
+// reapBatch keys, and returns how many were removed.
+func (lru *LRU) reapExpired() int {
+	total := 0
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		for {
+			s.mu.Lock()
+			n := s.reapLocked(time.Now(), reapBatch)
+			s.mu.Unlock()
+			total += n
+			if n < reapBatch {
+				break
+			}
+		}
+	}
+	return total
+}
+
+// Expired returns how many keys have expired since the cache started,
+// whether removed by the reaper or on access.
+func (lru *LRU) Expired() int64 {
+	var total int64
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		s.mu.Lock()
+		total += s.expired
+		s.mu.Unlock()
+	}
+	return total
+}
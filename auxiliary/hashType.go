@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// liveKindLocked returns the live node for key if it holds kind, nil if the
+// key is absent, or ErrWrongType. Caller must hold s.mu.
+func (s *lruShard) liveKindLocked(key string, kind valueKind) (*Node, error) {
+	node := s.liveLocked(key)
+	if node == nil {
+		return nil, nil
+	}
+	if node.Kind != kind {
+		return nil, ErrWrongType
+	}
+	return node, nil
+}
+
+// HSet sets fields on the hash at key, creating it if needed, and returns
+// how many fields were newly added.
+func (lru *LRU) HSet(key string, fields map[string]string) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindHash)
+	if err != nil {
+		return 0, err
+	}
+	if node == nil {
+		node = &Node{Key: key, Kind: kindHash, Hash: make(map[string]string, len(fields))}
+		s.insertLocked(node)
+	} else {
+		s.touchLocked(node)
+	}
+
+	prev := node.Version
+	added := 0
+	for f, v := range fields {
+		if _, exists := node.Hash[f]; !exists {
+			added++
+		}
+		node.Hash[f] = v
+	}
+	node.Version = nextVersion()
+	s.resizeLocked(node)
+	s.logOpLocked(node, prev, aofRecord{Op: aofHSet, Fields: fields})
+	return added, nil
+}
+
+// HGet returns one field of the hash at key.
+func (lru *LRU) HGet(key, field string) (string, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindHash)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", fmt.Errorf("value for the key %s %w", key, ErrNotFound)
+	}
+	s.touchLocked(node)
+	val, ok := node.Hash[field]
+	if !ok {
+		return "", fmt.Errorf("field %s of key %s %w", field, key, ErrNotFound)
+	}
+	return val, nil
+}
+
+// HGetAll returns a copy of every field of the hash at key.
+func (lru *LRU) HGetAll(key string) (map[string]string, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindHash)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("value for the key %s %w", key, ErrNotFound)
+	}
+	s.touchLocked(node)
+	return copyFields(node.Hash), nil
+}
+
+// HDel removes fields from the hash at key and returns how many existed.
+// The key is deleted once its last field is removed.
+func (lru *LRU) HDel(key string, fields []string) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindHash)
+	if err != nil || node == nil {
+		return 0, err
+	}
+
+	prev := node.Version
+	removed := 0
+	for _, f := range fields {
+		if _, ok := node.Hash[f]; ok {
+			delete(node.Hash, f)
+			removed++
+		}
+	}
+	if len(node.Hash) == 0 {
+		s.removeLocked(node)
+	} else if removed > 0 {
+		node.Version = nextVersion()
+		s.resizeLocked(node)
+		s.logOpLocked(node, prev, aofRecord{Op: aofHDel, Members: fields})
+	}
+	return removed, nil
+}
+
+// HIncrBy adds delta to the integer in field of the hash at key and returns
+// the result. Missing keys and fields start at 0.
+func (lru *LRU) HIncrBy(key, field string, delta int64) (int64, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindHash)
+	if err != nil {
+		return 0, err
+	}
+
+	var curr int64
+	if node != nil {
+		if raw, ok := node.Hash[field]; ok {
+			if curr, err = strconv.ParseInt(raw, 10, 64); err != nil {
+				return 0, ErrNotInteger
+			}
+		}
+	}
+	if delta > 0 && curr > math.MaxInt64-delta || delta < 0 && curr < math.MinInt64-delta {
+		return 0, ErrNotInteger
+	}
+	curr += delta
+
+	if node == nil {
+		node = &Node{Key: key, Kind: kindHash, Hash: make(map[string]string, 1)}
+		s.insertLocked(node)
+	} else {
+		s.touchLocked(node)
+	}
+	prev := node.Version
+	node.Hash[field] = strconv.FormatInt(curr, 10)
+	node.Version = nextVersion()
+	s.resizeLocked(node)
+	s.logOpLocked(node, prev, aofRecord{Op: aofHSet, Fields: map[string]string{field: node.Hash[field]}})
+	return curr, nil
+}
+
+func copyFields(fields map[string]string) map[string]string {
+	out := make(map[string]string, len(fields))
+	for f, v := range fields {
+		out[f] = v
+	}
+	return out
+}
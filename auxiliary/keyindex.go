@@ -0,0 +1,76 @@
+package main
+
+import "math/rand"
+
+const maxIndexLevel = 24
+
+// keyIndex keeps the keys of a shard in lexical order, so scans resume from
+// a cursor without copying and sorting the whole shard. It is a skip list:
+// inserts, removals and seeks take O(log n). It is not safe for concurrent
+// use; the shard lock guards it.
+type keyIndex struct {
+	head  indexNode
+	level int
+}
+
+type indexNode struct {
+	key  string
+	next []*indexNode
+}
+
+func newKeyIndex() *keyIndex {
+	return &keyIndex{head: indexNode{next: make([]*indexNode, maxIndexLevel)}, level: 1}
+}
+
+// path returns, for every level, the last node whose key sorts before key.
+func (idx *keyIndex) path(key string) [maxIndexLevel]*indexNode {
+	var update [maxIndexLevel]*indexNode
+	x := &idx.head
+	for lvl := idx.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil && x.next[lvl].key < key {
+			x = x.next[lvl]
+		}
+		update[lvl] = x
+	}
+	return update
+}
+
+// insert adds key; adding a key already present is a no-op.
+func (idx *keyIndex) insert(key string) {
+	update := idx.path(key)
+	if next := update[0].next[0]; next != nil && next.key == key {
+		return
+	}
+	lvl := 1
+	for lvl < maxIndexLevel && rand.Intn(4) == 0 {
+		lvl++
+	}
+	for ; idx.level < lvl; idx.level++ {
+		update[idx.level] = &idx.head
+	}
+	node := &indexNode{key: key, next: make([]*indexNode, lvl)}
+	for i := 0; i < lvl; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+}
+
+// remove deletes key if present.
+func (idx *keyIndex) remove(key string) {
+	update := idx.path(key)
+	node := update[0].next[0]
+	if node == nil || node.key != key {
+		return
+	}
+	for i := range node.next {
+		update[i].next[i] = node.next[i]
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+}
+
+// seek returns the first node whose key sorts at or after key, or nil.
+func (idx *keyIndex) seek(key string) *indexNode {
+	return idx.path(key)[0].next[0]
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Push appends values to the head (left) or tail of the list at key,
+// creating it if needed, and returns the new length. Values pushed to the
+// head end up in reverse order, as with repeated single pushes.
+func (lru *LRU) Push(key string, values []string, left bool) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindList)
+	if err != nil {
+		return 0, err
+	}
+	if node == nil {
+		node = &Node{Key: key, Kind: kindList}
+		s.insertLocked(node)
+	} else {
+		s.touchLocked(node)
+	}
+
+	prev := node.Version
+	node.List = pushValues(node.List, values, left)
+	node.Version = nextVersion()
+	s.resizeLocked(node)
+	s.logOpLocked(node, prev, aofRecord{Op: aofPush, Members: values, Left: left})
+
+	// Wake blocked pops waiting on this shard.
+	if s.pushed != nil {
+		close(s.pushed)
+		s.pushed = nil
+	}
+	return len(node.List), nil
+}
+
+// pushValues adds values to the head (left) or tail of list.
+func pushValues(list, values []string, left bool) []string {
+	if !left {
+		return append(list, values...)
+	}
+	out := make([]string, 0, len(values)+len(list))
+	for i := len(values) - 1; i >= 0; i-- {
+		out = append(out, values[i])
+	}
+	return append(out, list...)
+}
+
+// Pop removes and returns the head (left) or tail element of the list at
+// key. The key is deleted once its last element is popped.
+func (lru *LRU) Pop(key string, left bool) (string, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.popLocked(key, left)
+}
+
+// BlockingPop is Pop, but waits up to timeout for an element to be pushed
+// if the list is empty.
+func (lru *LRU) BlockingPop(ctx context.Context, key string, left bool, timeout time.Duration) (string, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	s := lru.shardFor(key)
+	for {
+		s.mu.Lock()
+		val, err := s.popLocked(key, left)
+		if !errors.Is(err, ErrNotFound) {
+			s.mu.Unlock()
+			return val, err
+		}
+		if s.pushed == nil {
+			s.pushed = make(chan struct{})
+		}
+		pushed := s.pushed
+		s.mu.Unlock()
+
+		select {
+		case <-pushed:
+		case <-timer.C:
+			return "", fmt.Errorf("no element in list %s before timeout: %w", key, ErrNotFound)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// popLocked pops one element from the list at key. Caller must hold s.mu.
+func (s *lruShard) popLocked(key string, left bool) (string, error) {
+	node, err := s.liveKindLocked(key, kindList)
+	if err != nil {
+		return "", err
+	}
+	if node == nil {
+		return "", fmt.Errorf("value for the key %s %w", key, ErrNotFound)
+	}
+
+	prev := node.Version
+	var val string
+	if left {
+		val, node.List = node.List[0], node.List[1:]
+	} else {
+		last := len(node.List) - 1
+		val, node.List = node.List[last], node.List[:last]
+	}
+	if len(node.List) == 0 {
+		s.removeLocked(node)
+	} else {
+		node.Version = nextVersion()
+		s.resizeLocked(node)
+		s.touchLocked(node)
+		s.logOpLocked(node, prev, aofRecord{Op: aofPop, Left: left})
+	}
+	return val, nil
+}
+
+// Range returns the elements of the list at key between start and stop,
+// inclusive. Negative indexes count from the end (-1 is the last element).
+func (lru *LRU) Range(key string, start, stop int) ([]string, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindList)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("value for the key %s %w", key, ErrNotFound)
+	}
+	s.touchLocked(node)
+
+	lo, hi := listBounds(len(node.List), start, stop)
+	out := make([]string, hi-lo)
+	copy(out, node.List[lo:hi])
+	return out, nil
+}
+
+// Trim keeps only the elements between start and stop (inclusive, same
+// indexing as Range) and returns the new length. An empty result deletes
+// the key.
+func (lru *LRU) Trim(key string, start, stop int) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindList)
+	if err != nil || node == nil {
+		return 0, err
+	}
+
+	lo, hi := listBounds(len(node.List), start, stop)
+	if lo == hi {
+		s.removeLocked(node)
+		return 0, nil
+	}
+	prev := node.Version
+	node.List = append([]string(nil), node.List[lo:hi]...)
+	node.Version = nextVersion()
+	s.resizeLocked(node)
+	s.logOpLocked(node, prev, aofRecord{Op: aofTrim, Start: lo, Stop: hi})
+	return len(node.List), nil
+}
+
+// listBounds converts inclusive, possibly negative indexes into a half-open
+// slice range [lo, hi) clamped to a list of length n.
+func listBounds(n, start, stop int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NamespaceHeader selects the namespace a request operates in. Requests
+// without it use DefaultNamespace.
+const NamespaceHeader = "X-Cache-Namespace"
+
+// DefaultNamespace holds keys written without a namespace. Its keys are
+// stored unprefixed, so data written before namespaces existed stays put.
+const DefaultNamespace = "default"
+
+// nsSep separates the namespace from the key in the shared key space.
+const nsSep = '\x00'
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// namespacedKey maps a client key into the key space shared by all
+// namespaces.
+func namespacedKey(ns, key string) string {
+	if ns == "" || ns == DefaultNamespace {
+		return key
+	}
+	return ns + string(nsSep) + key
+}
+
+// splitKey is the inverse of namespacedKey.
+func splitKey(internal string) (string, string) {
+	if i := strings.IndexByte(internal, nsSep); i >= 0 {
+		return internal[:i], internal[i+1:]
+	}
+	return DefaultNamespace, internal
+}
+
+// validKey reports whether a client key or tag can be namespaced. One
+// holding nsSep would be split back into a different namespace and key.
+func validKey(key string) bool {
+	return strings.IndexByte(key, nsSep) < 0
+}
+
+// validEntry reports whether the key and tags of a write are valid keys.
+func validEntry(kv KeyVal) bool {
+	for _, tag := range kv.Tags {
+		if !validKey(tag) {
+			return false
+		}
+	}
+	return validKey(kv.Key)
+}
+
+// namespaceOf returns the namespace of the request.
+func namespaceOf(r *http.Request) string {
+	if ns := r.Header.Get(NamespaceHeader); ns != "" {
+		return ns
+	}
+	return DefaultNamespace
+}
+
+// nsKey maps a key named by the request into the shared key space.
+func nsKey(r *http.Request, key string) string {
+	return namespacedKey(namespaceOf(r), key)
+}
+
+// validateNamespace rejects requests whose namespace header is malformed.
+func validateNamespace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ns := r.Header.Get(NamespaceHeader); ns != "" && !namespacePattern.MatchString(ns) {
+			http.Error(w, fmt.Sprintf("invalid namespace %q", ns), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateKey rejects requests whose path names a key or tag that is not a
+// valid key.
+func validateKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for _, name := range []string{"key", "tag"} {
+			if !validKey(vars[name]) {
+				http.Error(w, fmt.Sprintf("invalid %s %q", name, vars[name]), http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Quota limits how much of a node one namespace may use. Zero fields are
+// unlimited.
+type Quota struct {
+	Keys  int
+	Bytes int64
+}
+
+// nsUsage is what one namespace currently holds in a shard.
+type nsUsage struct {
+	keys      int
+	bytes     int64
+	evictions int64  // entries evicted to respect the namespace's quota
+	recent    nsList // the namespace's entries, most recently used first
+}
+
+// nsList orders the entries of one namespace by recency, like the shard's
+// DLL does for all of them, so a namespace over its quota finds its least
+// recently used entry without walking past other namespaces' entries.
+type nsList struct {
+	head, tail *Node
+}
+
+func (l *nsList) pushFront(node *Node) {
+	node.NsPrevious, node.NsNext = nil, l.head
+	if l.head != nil {
+		l.head.NsPrevious = node
+	} else {
+		l.tail = node
+	}
+	l.head = node
+}
+
+func (l *nsList) pushBack(node *Node) {
+	node.NsPrevious, node.NsNext = l.tail, nil
+	if l.tail != nil {
+		l.tail.NsNext = node
+	} else {
+		l.head = node
+	}
+	l.tail = node
+}
+
+func (l *nsList) remove(node *Node) {
+	if node.NsPrevious != nil {
+		node.NsPrevious.NsNext = node.NsNext
+	} else if l.head == node {
+		l.head = node.NsNext
+	}
+	if node.NsNext != nil {
+		node.NsNext.NsPrevious = node.NsPrevious
+	} else if l.tail == node {
+		l.tail = node.NsPrevious
+	}
+	node.NsPrevious, node.NsNext = nil, nil
+}
+
+func (u *nsUsage) over(q Quota) bool {
+	return q.Keys > 0 && u.keys > q.Keys || q.Bytes > 0 && u.bytes > q.Bytes
+}
+
+// parseQuotas reads per-namespace limits from two lists of ns=value pairs,
+// e.g. NAMESPACE_MAX_KEYS="search=5000,batch=20000" and
+// NAMESPACE_MAX_BYTES="search=67108864".
+func parseQuotas(maxKeys, maxBytes string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	parse := func(raw string, set func(q *Quota, n int64)) error {
+		for _, pair := range strings.Split(raw, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			ns, val, ok := strings.Cut(pair, "=")
+			n, err := strconv.ParseInt(val, 10, 64)
+			if !ok || err != nil || n <= 0 || !namespacePattern.MatchString(ns) {
+				return fmt.Errorf("invalid namespace quota %q", pair)
+			}
+			q := quotas[ns]
+			set(&q, n)
+			quotas[ns] = q
+		}
+		return nil
+	}
+	if err := parse(maxKeys, func(q *Quota, n int64) { q.Keys = int(n) }); err != nil {
+		return nil, err
+	}
+	if err := parse(maxBytes, func(q *Quota, n int64) { q.Bytes = n }); err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+// SetQuotas installs per-namespace quotas. Like the overall capacity, each
+// quota is split evenly across the shards and enforced per shard, so
+// enforcement never needs more than one shard lock.
+func (lru *LRU) SetQuotas(quotas map[string]Quota) {
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		perShard := make(map[string]Quota, len(quotas))
+		for ns, q := range quotas {
+			perShard[ns] = Quota{
+				Keys:  (q.Keys + numShards - 1) / numShards,
+				Bytes: (q.Bytes + numShards - 1) / numShards,
+			}
+		}
+		s.mu.Lock()
+		s.quotas = perShard
+		s.mu.Unlock()
+	}
+}
+
+// nodeSize approximates the memory held by an entry: its key plus its value
+// of whatever type.
+func nodeSize(node *Node) int64 {
+	size := len(node.Key) + len(node.Value)
+	for f, v := range node.Hash {
+		size += len(f) + len(v)
+	}
+	for _, v := range node.List {
+		size += len(v)
+	}
+	for m := range node.Set {
+		size += len(m)
+	}
+	for m := range node.ZSet {
+		size += len(m) + 8
+	}
+	return int64(size)
+}
+
+// usageLocked returns the usage record of ns, creating it if needed. Caller
+// must hold s.mu.
+func (s *lruShard) usageLocked(ns string) *nsUsage {
+	u := s.usage[ns]
+	if u == nil {
+		u = &nsUsage{}
+		s.usage[ns] = u
+	}
+	return u
+}
+
+// trackLocked adds a newly stored node to its namespace's usage and recency
+// list, at the same end of the list as it was added to the shard's DLL.
+// Caller must hold s.mu.
+func (s *lruShard) trackLocked(node *Node) {
+	ns, _ := splitKey(node.Key)
+	node.Size = nodeSize(node)
+	u := s.usageLocked(ns)
+	u.keys++
+	u.bytes += node.Size
+	if node == s.dll.Head {
+		u.recent.pushFront(node)
+	} else {
+		u.recent.pushBack(node)
+	}
+}
+
+// untrackLocked removes a node from its namespace's usage. Caller must hold
+// s.mu.
+func (s *lruShard) untrackLocked(node *Node) {
+	ns, _ := splitKey(node.Key)
+	u := s.usageLocked(ns)
+	u.keys--
+	u.bytes -= node.Size
+	u.recent.remove(node)
+}
+
+// resizeLocked recomputes the size of a node whose value changed and
+// enforces its namespace's quota. Caller must hold s.mu.
+func (s *lruShard) resizeLocked(node *Node) {
+	ns, _ := splitKey(node.Key)
+	size := nodeSize(node)
+	s.usageLocked(ns).bytes += size - node.Size
+	node.Size = size
+	s.enforceQuotaLocked(node)
+}
+
+// capacityVictimLocked picks the entry to evict when the shard is full and
+// a key of namespace ns is being inserted. Each namespace in the shard is
+// entitled to an equal share of its capacity: ns gives up its own least
+// recently used entry once it holds its share, otherwise the namespace
+// holding the most entries does. With a single namespace this is the
+// shard's least recently used entry. Caller must hold s.mu.
+func (s *lruShard) capacityVictimLocked(ns string) *Node {
+	active := 0
+	var largest *nsUsage
+	for _, u := range s.usage {
+		if u.keys == 0 {
+			continue
+		}
+		active++
+		if largest == nil || u.keys > largest.keys {
+			largest = u
+		}
+	}
+	own := s.usage[ns]
+	if own == nil || own.keys == 0 {
+		active++
+	} else if own.keys*active >= s.capacity {
+		return own.recent.tail
+	}
+	if largest == nil {
+		return s.dll.Tail
+	}
+	return largest.recent.tail
+}
+
+// enforceQuotaLocked evicts the least recently used entries of node's
+// namespace, never node itself, until the namespace is back within its
+// quota in this shard. Other namespaces are never touched. Caller must hold
+// s.mu.
+func (s *lruShard) enforceQuotaLocked(node *Node) {
+	ns, _ := splitKey(node.Key)
+	q, ok := s.quotas[ns]
+	if !ok {
+		return
+	}
+	u := s.usageLocked(ns)
+	for curr := u.recent.tail; curr != nil && u.over(q); {
+		prev := curr.NsPrevious
+		if curr != node {
+			s.removeLocked(curr)
+			u.evictions++
+		}
+		curr = prev
+	}
+}
+
+// overQuotaLocked reports whether node's namespace is over its quota.
+// Caller must hold s.mu.
+func (s *lruShard) overQuotaLocked(node *Node) bool {
+	ns, _ := splitKey(node.Key)
+	q, ok := s.quotas[ns]
+	return ok && s.usageLocked(ns).over(q)
+}
+
+// FlushNamespace removes every key of ns and returns the keys removed.
+func (lru *LRU) FlushNamespace(ns string) []string {
+	removed := make([]string, 0)
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		s.mu.Lock()
+		var keys []string
+		for key := range s.bucket {
+			if keyNS, _ := splitKey(key); keyNS == ns {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.Unlock()
+		for _, key := range s.removeKeys(keys) {
+			_, k := splitKey(key)
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// NamespaceUsage sums the usage of every namespace across the shards.
+func (lru *LRU) NamespaceUsage() map[string]nsUsage {
+	total := make(map[string]nsUsage)
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		s.mu.Lock()
+		for ns, u := range s.usage {
+			t := total[ns]
+			t.keys += u.keys
+			t.bytes += u.bytes
+			t.evictions += u.evictions
+			total[ns] = t
+		}
+		s.mu.Unlock()
+	}
+	return total
+}
+
+// namespaceCollector exports per-namespace usage at scrape time, so the
+// write path never touches Prometheus.
+type namespaceCollector struct {
+	lru       *LRU
+	keys      *prometheus.Desc
+	bytes     *prometheus.Desc
+	evictions *prometheus.Desc
+}
+
+func newNamespaceCollector(lru *LRU) *namespaceCollector {
+	labels := []string{"namespace"}
+	return &namespaceCollector{
+		lru:       lru,
+		keys:      prometheus.NewDesc("auxiliary_namespace_keys", "Number of keys held per namespace", labels, nil),
+		bytes:     prometheus.NewDesc("auxiliary_namespace_bytes", "Approximate bytes held per namespace", labels, nil),
+		evictions: prometheus.NewDesc("auxiliary_namespace_quota_evictions_total", "Entries evicted to keep a namespace within its quota", labels, nil),
+	}
+}
+
+func (c *namespaceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.keys
+	ch <- c.bytes
+	ch <- c.evictions
+}
+
+func (c *namespaceCollector) Collect(ch chan<- prometheus.Metric) {
+	for ns, u := range c.lru.NamespaceUsage() {
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(u.keys), ns)
+		ch <- prometheus.MustNewConstMetric(c.bytes, prometheus.GaugeValue, float64(u.bytes), ns)
+		ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(u.evictions), ns)
+	}
+}
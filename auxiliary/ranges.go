@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// HashRange is an arc of the master's hash ring: the key hashes h with
+// Start < h <= End, wrapping past zero when Start >= End.
+type HashRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// Contains reports whether hash falls in the range.
+func (r HashRange) Contains(hash uint32) bool {
+	if r.Start < r.End {
+		return hash > r.Start && hash <= r.End
+	}
+	return hash > r.Start || hash <= r.End
+}
+
+// inRanges reports whether the master would place key in one of ranges. The
+// master hashes the same namespaced key the cache stores.
+func inRanges(ranges []HashRange) func(key string) bool {
+	return func(key string) bool {
+		hash := crc32.ChecksumIEEE([]byte(key))
+		for _, r := range ranges {
+			if r.Contains(hash) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// ExportRanges returns the next page of live entries whose keys fall in
+// ranges, up to one snapshot block, after cursor ("0" or "" to start), and
+// the cursor of the page after it, "0" once there is none. Shards are walked
+// in order and keys within a shard in lexical order, like Scan, so an entry
+// that exists for the whole export is returned exactly once. Keys are
+// visited deleteBatch at a time and hashed without the shard lock, which is
+// then taken again only to copy the entries in ranges.
+func (lru *LRU) ExportRanges(ranges []HashRange, cursor string) ([]entryRecord, string, error) {
+	shard, after, err := decodeScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	in := inRanges(ranges)
+	recs := make([]entryRecord, 0)
+	for ; shard < numShards; shard, after = shard+1, "" {
+		s := &lru.shards[shard]
+		for {
+			limit := deleteBatch
+			if left := snapshotBlockEntries - len(recs); left < limit {
+				limit = left
+			}
+			keys, last, visited := s.keysAfter("", after, limit, nil)
+			matched := keys[:0]
+			for _, key := range keys {
+				if in(key) {
+					matched = append(matched, key)
+				}
+			}
+			if len(matched) > 0 {
+				now := time.Now()
+				s.mu.Lock()
+				for _, key := range matched {
+					if node, ok := s.bucket[key]; ok && !s.expiredLocked(key, now) {
+						recs = append(recs, s.recordLocked(node))
+					}
+				}
+				s.mu.Unlock()
+			}
+			if len(recs) == snapshotBlockEntries {
+				return recs, encodeScanCursor(shard, last), nil
+			}
+			if visited < limit {
+				break
+			}
+			after = last
+		}
+	}
+	return recs, "0", nil
+}
+
+// ImportSnapshot reads a snapshot stream, as written by ExportRanges, into
+// the cache block by block. It returns how many entries it received and how
+// many of them the cache holds afterwards, counting those it already held at
+// the same or a newer version. The difference was evicted to make room, so
+// the sender must not assume it is safe to delete those entries.
+func (lru *LRU) ImportSnapshot(r io.Reader) (held, received int, err error) {
+	err = readSnapshotBlocks(r, func(recs []entryRecord) error {
+		held += lru.importRecords(recs)
+		received += len(recs)
+		return nil
+	})
+	return held, received, err
+}
+
+// importRecords adds recs to the cache like ordinary writes: each becomes
+// the most recently used entry of its shard, evicting the least recently
+// used one if the shard is full. An entry the cache holds at the same or a
+// newer version is left alone. It returns how many of recs the cache holds
+// once all are in; one that expired on the way counts as held.
+func (lru *LRU) importRecords(recs []entryRecord) int {
+	var groups [numShards][]entryRecord
+	held := 0
+	now := time.Now()
+	for _, rec := range recs {
+		if !rec.Expiry.IsZero() && now.After(rec.Expiry) {
+			held++
+			continue
+		}
+		idx := shardIndex(rec.Key)
+		groups[idx] = append(groups[idx], rec)
+	}
+
+	for i := range lru.shards {
+		if len(groups[i]) == 0 {
+			continue
+		}
+		s := &lru.shards[i]
+		s.mu.Lock()
+		for _, rec := range groups[i] {
+			if node, ok := s.bucket[rec.Key]; ok {
+				if node.Version >= rec.Version {
+					continue
+				}
+				s.removeLocked(node)
+			}
+			node := rec.node()
+			s.insertLocked(node)
+			s.setTagsLocked(node, rec.Tags)
+			if !rec.Expiry.IsZero() {
+				s.expiry.set(node.Key, rec.Expiry)
+			}
+			s.logWriteLocked(node)
+		}
+		// Later records of the group may have evicted earlier ones.
+		for _, rec := range groups[i] {
+			if node, ok := s.bucket[rec.Key]; ok && node.Version >= rec.Version {
+				held++
+			}
+		}
+		s.mu.Unlock()
+	}
+	return held
+}
+
+// exportCursorHeader carries the cursor of the next page of an export.
+const exportCursorHeader = "X-Export-Cursor"
+
+// Export returns one page of the entries in the hash ranges given in the
+// body, as a snapshot stream of at most one block, so a node taking over
+// those ranges can copy them. The next page is asked for with
+// ?cursor=<X-Export-Cursor>; the cursor is "0" after the last page. Each
+// page is a short request of its own, so a copy can pause between pages
+// without a response staying open.
+func (aux *Auxiliary) Export(w http.ResponseWriter, r *http.Request) {
+	var ranges []HashRange
+	if err := json.NewDecoder(r.Body).Decode(&ranges); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	recs, next, err := aux.LRU.ExportRanges(ranges, r.URL.Query().Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(exportCursorHeader, next)
+	sw := newSnapshotWriter(w, false)
+	if len(recs) > 0 {
+		if err := sw.writeBlock(recs); err != nil {
+			log.Printf("export of %d ranges failed: %v", len(ranges), err)
+			return
+		}
+	}
+	if err := sw.close(); err != nil {
+		log.Printf("export of %d ranges failed: %v", len(ranges), err)
+	}
+}
+
+// Import reads a snapshot stream, usually one block of another node's
+// export forwarded by the master, into the cache. It reports how many
+// entries it received and, as count, how many it holds.
+func (aux *Auxiliary) Import(w http.ResponseWriter, r *http.Request) {
+	held, received, err := aux.LRU.ImportSnapshot(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("import stopped after %d entries: %v", received, err), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"count": held, "received": received})
+}
+
+// Entry returns the entry at the key named in the path as a snapshot
+// stream, which the master copies from a key's primary replica to the other
+// replicas through Import.
+func (aux *Auxiliary) Entry(w http.ResponseWriter, r *http.Request) {
+	rec, ok := aux.LRU.Entry(nsKey(r, mux.Vars(r)["key"]))
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	sw := newSnapshotWriter(w, false)
+	if err := sw.writeBlock([]entryRecord{rec}); err != nil {
+		log.Printf("copy of %s failed: %v", rec.Key, err)
+		return
+	}
+	if err := sw.close(); err != nil {
+		log.Printf("copy of %s failed: %v", rec.Key, err)
+	}
+}
+
+// Entry returns the live entry at key, of any type, with its version and
+// expiry.
+func (lru *LRU) Entry(key string) (entryRecord, bool) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	node := s.liveLocked(key)
+	if node == nil {
+		return entryRecord{}, false
+	}
+	return s.recordLocked(node), true
+}
+
+// CountRanges reports how many keys fall in each of the hash ranges given
+// in the body, so the master can show how much a rebalance has left to move.
+func (aux *Auxiliary) CountRanges(w http.ResponseWriter, r *http.Request) {
+	var ranges []HashRange
+	if err := json.NewDecoder(r.Body).Decode(&ranges); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string][]int{"counts": aux.LRU.CountRanges(ranges)})
+}
+
+// CountRanges returns how many live keys fall in each of ranges. The shard
+// lock is held for deleteBatch keys at a time, and keys are hashed after it
+// is released.
+func (lru *LRU) CountRanges(ranges []HashRange) []int {
+	counts := make([]int, len(ranges))
+	for i := range lru.shards {
+		lru.shards[i].eachKeyBatch("", nil, func(keys []string) {
+			for _, key := range keys {
+				hash := crc32.ChecksumIEEE([]byte(key))
+				for j, r := range ranges {
+					if r.Contains(hash) {
+						counts[j]++
+						break
+					}
+				}
+			}
+		})
+	}
+	return counts
+}
+
+// DropRanges removes every key in the hash ranges given in the body, once
+// the master has moved them to their new owners.
+func (aux *Auxiliary) DropRanges(w http.ResponseWriter, r *http.Request) {
+	var ranges []HashRange
+	if err := json.NewDecoder(r.Body).Decode(&ranges); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, map[string]int{"count": aux.LRU.DropRanges(ranges)})
+}
+
+// DropRanges removes every key in ranges and returns how many were live.
+// Like CountRanges it hashes keys without holding the shard lock.
+func (lru *LRU) DropRanges(ranges []HashRange) int {
+	in := inRanges(ranges)
+	total := 0
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		s.eachKeyBatch("", nil, func(keys []string) {
+			matched := keys[:0]
+			for _, key := range keys {
+				if in(key) {
+					matched = append(matched, key)
+				}
+			}
+			total += len(s.removeKeys(matched))
+		})
+	}
+	return total
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// SetRefreshBeta sets how eagerly values are refreshed before their TTL
+// runs out. 1 is the usual choice; larger values refresh earlier, and 0
+// turns early refresh off.
+func (lru *LRU) SetRefreshBeta(beta float64) {
+	lru.refreshBeta = beta
+}
+
+// freshnessLocked reports whether a read of node at now serves a stale
+// value and whether it is due for a refresh.
+//
+// A value is stale once its TTL has run out but its grace period has not.
+// A fresh value with a recompute time is refreshed early with XFetch: a
+// read refreshes it if now + Recompute * beta * -ln(U), U uniform in
+// (0, 1], reaches the expiry. Refreshes thus grow likely as the expiry
+// nears, sooner for values that are slow to rebuild, and are spread over
+// the readers instead of all landing when the TTL runs out.
+//
+// Every read of a stale value is due a refresh. Replicas do not agree on
+// who refreshes: the master grants one caller per key a lease, so a node
+// read directly leaves stampede control to its caller. Caller must hold
+// s.mu.
+func (s *lruShard) freshnessLocked(node *Node, now time.Time, beta float64) (stale, refresh bool) {
+	if node.Grace == 0 && node.Recompute == 0 {
+		return false, false
+	}
+	exp, ok := s.expiry.get(node.Key)
+	if !ok {
+		return false, false
+	}
+	soft := exp.Add(-node.Grace)
+	switch {
+	case now.After(soft):
+		return true, true
+	case node.Recompute > 0 && beta > 0:
+		early := time.Duration(float64(node.Recompute) * beta * -math.Log(1-rand.Float64()))
+		return false, !now.Add(early).Before(soft)
+	default:
+		return false, false
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultScanCount = 100
+	maxScanCount     = 1000
+)
+
+// ScanPage is one page of a cursor-based key scan. A Cursor of "0" means the
+// scan is complete.
+type ScanPage struct {
+	Cursor string   `json:"cursor"`
+	Keys   []string `json:"keys"`
+}
+
+// Scan returns the next page of keys of namespace ns after cursor ("0" or
+// "" to start).
+// Shards are walked in order and keys within a shard in lexical order, so a
+// key that exists for the whole scan is returned exactly once. Like Redis
+// SCAN, count bounds how many keys are visited, not returned: keys left out
+// by the type filter or the pattern, and in the default namespace the keys
+// of other namespaces, count too. A page may hold fewer keys, or none, while
+// the cursor is still non-zero.
+//
+// Each shard keeps its keys sorted, so a page only visits the keys it
+// covers; pattern matching runs after the shard lock is released.
+func (lru *LRU) Scan(ns, cursor string, count int, match, kind string) (ScanPage, error) {
+	shard, after, err := decodeScanCursor(cursor)
+	if err != nil {
+		return ScanPage{}, err
+	}
+	if count <= 0 {
+		count = defaultScanCount
+	}
+	if count > maxScanCount {
+		count = maxScanCount
+	}
+
+	prefix := namespacedKey(ns, "")
+	keep := func(key string, node *Node) bool {
+		if keyNS, _ := splitKey(key); keyNS != ns {
+			return false
+		}
+		return kind == "" || node.Kind.String() == kind
+	}
+	page := ScanPage{Keys: make([]string, 0)}
+	visited := 0
+	for ; shard < numShards; shard, after = shard+1, "" {
+		keys, last, n := lru.shards[shard].keysAfter(prefix, after, count-visited, keep)
+		for _, key := range keys {
+			if _, k := splitKey(key); match == "" || globMatch(match, k) {
+				page.Keys = append(page.Keys, k)
+			}
+		}
+		visited += n
+		if visited >= count {
+			page.Cursor = encodeScanCursor(shard, last)
+			return page, nil
+		}
+	}
+	page.Cursor = "0"
+	return page, nil
+}
+
+// deleteBatch bounds how many keys DeleteMatching removes per lock hold, so
+// readers of a shard are never blocked for long.
+const deleteBatch = 256
+
+// DeleteMatching removes every live key of namespace ns that starts with
+// prefix and matches the glob pattern match (either may be empty, not both)
+// and returns the keys removed. With dryRun set nothing is removed and the matching keys
+// are returned. Shards are processed one at a time, deleteBatch keys per
+// lock hold whether they match or not: only keys that start with prefix are
+// visited, and the pattern is matched after the lock is released.
+func (lru *LRU) DeleteMatching(ns, prefix, match string, dryRun bool) []string {
+	removed := make([]string, 0)
+	keep := func(key string, _ *Node) bool {
+		keyNS, _ := splitKey(key)
+		return keyNS == ns
+	}
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		s.eachKeyBatch(namespacedKey(ns, prefix), keep, func(keys []string) {
+			matched := keys[:0]
+			for _, key := range keys {
+				if _, k := splitKey(key); match == "" || globMatch(match, k) {
+					matched = append(matched, key)
+				}
+			}
+			if !dryRun {
+				matched = s.removeKeys(matched)
+			}
+			for _, key := range matched {
+				_, k := splitKey(key)
+				removed = append(removed, k)
+			}
+		})
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// removeKeys deletes the given keys from the shard, taking the lock once per
+// batch, and returns the ones that were present and live.
+func (s *lruShard) removeKeys(keys []string) []string {
+	var removed []string
+	for len(keys) > 0 {
+		n := deleteBatch
+		if n > len(keys) {
+			n = len(keys)
+		}
+		s.mu.Lock()
+		for _, key := range keys[:n] {
+			if node := s.liveLocked(key); node != nil {
+				s.removeLocked(node)
+				removed = append(removed, key)
+			}
+		}
+		s.mu.Unlock()
+		keys = keys[n:]
+	}
+	return removed
+}
+
+// keysAfter visits, in lexical order, up to limit live keys of the shard
+// that start with prefix and sort after the given key. It returns the ones
+// keep accepts (nil accepts every key), the last key visited, from which a
+// caller resumes, and how many keys it visited; fewer than limit means the
+// shard has no more.
+func (s *lruShard) keysAfter(prefix, after string, limit int, keep func(key string, node *Node) bool) (keys []string, last string, visited int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.walkLocked(prefix, after, func(key string, node *Node) bool {
+		if visited == limit {
+			return false
+		}
+		visited++
+		last = key
+		if keep == nil || keep(key, node) {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys, last, visited
+}
+
+// walkLocked calls fn, in lexical order, with the live keys of the shard
+// that start with prefix and sort after the given key, until fn returns
+// false. Caller must hold s.mu.
+func (s *lruShard) walkLocked(prefix, after string, fn func(key string, node *Node) bool) {
+	from := prefix
+	if after > from {
+		from = after
+	}
+	now := time.Now()
+	for x := s.index.seek(from); x != nil; x = x.next[0] {
+		if !strings.HasPrefix(x.key, prefix) {
+			return
+		}
+		if after != "" && x.key == after || s.expiredLocked(x.key, now) {
+			continue
+		}
+		if !fn(x.key, s.bucket[x.key]) {
+			return
+		}
+	}
+}
+
+// eachKeyBatch hands fn the keys of the shard that start with prefix and
+// that keep accepts, visiting deleteBatch keys per lock hold, so the shard
+// lock is never held for the whole walk however few keys keep accepts. fn
+// runs without the lock and may remove the keys it is given.
+func (s *lruShard) eachKeyBatch(prefix string, keep func(key string, node *Node) bool, fn func(keys []string)) {
+	after := ""
+	for {
+		keys, last, visited := s.keysAfter(prefix, after, deleteBatch, keep)
+		if len(keys) > 0 {
+			fn(keys)
+		}
+		if visited < deleteBatch {
+			return
+		}
+		after = last
+	}
+}
+
+// encodeScanCursor packs a shard index and the last key returned from it
+// into an opaque, URL-safe cursor.
+func encodeScanCursor(shard int, after string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(shard) + ":" + after))
+}
+
+func decodeScanCursor(cursor string) (int, string, error) {
+	if cursor == "" || cursor == "0" {
+		return 0, "", nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	idx, after, ok := strings.Cut(string(raw), ":")
+	shard, err := strconv.Atoi(idx)
+	if !ok || err != nil || shard < 0 || shard >= numShards {
+		return 0, "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return shard, after, nil
+}
+
+// globMatch reports whether s matches a Redis-style glob pattern: * matches
+// any run of characters, ? any single character, [abc] / [a-z] / [^a] a
+// character class, and \ escapes the next character.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if s == "" {
+				return false
+			}
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// Unterminated class: treat '[' literally.
+				if s[0] != '[' {
+					return false
+				}
+				pattern, s = pattern[1:], s[1:]
+				continue
+			}
+			class := pattern[1 : end+1]
+			if !classMatch(class, s[0]) {
+				return false
+			}
+			pattern, s = pattern[end+2:], s[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return s == ""
+}
+
+func classMatch(class string, c byte) bool {
+	negate := strings.HasPrefix(class, "^")
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		if i+2 < len(class) && class[i+1] == '-' {
+			if class[i] <= c && c <= class[i+2] {
+				matched = true
+			}
+			i += 2
+			continue
+		}
+		if class[i] == c {
+			matched = true
+		}
+	}
+	return matched != negate
+}
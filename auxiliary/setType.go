@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ScoredMember is one element of a sorted set.
+type ScoredMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// SAdd adds members to the set at key, creating it if needed, and returns
+// how many were not already present.
+func (lru *LRU) SAdd(key string, members []string) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindSet)
+	if err != nil {
+		return 0, err
+	}
+	if node == nil {
+		node = &Node{Key: key, Kind: kindSet, Set: make(map[string]struct{}, len(members))}
+		s.insertLocked(node)
+	} else {
+		s.touchLocked(node)
+	}
+
+	prev := node.Version
+	added := 0
+	for _, m := range members {
+		if _, ok := node.Set[m]; !ok {
+			node.Set[m] = struct{}{}
+			added++
+		}
+	}
+	node.Version = nextVersion()
+	s.resizeLocked(node)
+	s.logOpLocked(node, prev, aofRecord{Op: aofSAdd, Members: members})
+	return added, nil
+}
+
+// SRem removes members from the set at key and returns how many were
+// present. The key is deleted once its last member is removed.
+func (lru *LRU) SRem(key string, members []string) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindSet)
+	if err != nil || node == nil {
+		return 0, err
+	}
+
+	prev := node.Version
+	removed := 0
+	for _, m := range members {
+		if _, ok := node.Set[m]; ok {
+			delete(node.Set, m)
+			removed++
+		}
+	}
+	if len(node.Set) == 0 {
+		s.removeLocked(node)
+	} else if removed > 0 {
+		node.Version = nextVersion()
+		s.resizeLocked(node)
+		s.logOpLocked(node, prev, aofRecord{Op: aofSRem, Members: members})
+	}
+	return removed, nil
+}
+
+// SMembers returns the members of the set at key in lexical order.
+func (lru *LRU) SMembers(key string) ([]string, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindSet)
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("value for the key %s %w", key, ErrNotFound)
+	}
+	s.touchLocked(node)
+	return setMembers(node.Set), nil
+}
+
+// SIsMember reports whether member belongs to the set at key. A missing key
+// is an empty set.
+func (lru *LRU) SIsMember(key, member string) (bool, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindSet)
+	if err != nil || node == nil {
+		return false, err
+	}
+	s.touchLocked(node)
+	_, ok := node.Set[member]
+	return ok, nil
+}
+
+// SCard returns the number of members of the set at key. A missing key is
+// an empty set.
+func (lru *LRU) SCard(key string) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindSet)
+	if err != nil || node == nil {
+		return 0, err
+	}
+	s.touchLocked(node)
+	return len(node.Set), nil
+}
+
+// ZAdd sets the scores of members in the sorted set at key, creating it if
+// needed, and returns how many members were newly added.
+func (lru *LRU) ZAdd(key string, members map[string]float64) (int, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindZSet)
+	if err != nil {
+		return 0, err
+	}
+	if node == nil {
+		node = &Node{Key: key, Kind: kindZSet, ZSet: make(map[string]float64, len(members))}
+		s.insertLocked(node)
+	} else {
+		s.touchLocked(node)
+	}
+
+	prev := node.Version
+	added := 0
+	for m, score := range members {
+		if _, ok := node.ZSet[m]; !ok {
+			added++
+		}
+		node.ZSet[m] = score
+	}
+	node.Version = nextVersion()
+	s.resizeLocked(node)
+	s.logOpLocked(node, prev, aofRecord{Op: aofZAdd, Scores: members})
+	return added, nil
+}
+
+// ZIncrBy adds delta to the score of member (0 if absent) in the sorted set
+// at key and returns the new score.
+func (lru *LRU) ZIncrBy(key, member string, delta float64) (float64, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.liveKindLocked(key, kindZSet)
+	if err != nil {
+		return 0, err
+	}
+	var score float64
+	if node != nil {
+		score = node.ZSet[member]
+	}
+	score += delta
+	if math.IsInf(score, 0) || math.IsNaN(score) {
+		return 0, ErrNotInteger
+	}
+
+	if node == nil {
+		node = &Node{Key: key, Kind: kindZSet, ZSet: make(map[string]float64, 1)}
+		s.insertLocked(node)
+	} else {
+		s.touchLocked(node)
+	}
+	prev := node.Version
+	node.ZSet[member] = score
+	node.Version = nextVersion()
+	s.resizeLocked(node)
+	s.logOpLocked(node, prev, aofRecord{Op: aofZAdd, Scores: map[string]float64{member: score}})
+	return score, nil
+}
+
+// ZRange returns the members ranked start..stop (inclusive, negative
+// indexes count from the end) ordered by ascending score, or descending
+// when rev is set.
+func (lru *LRU) ZRange(key string, start, stop int, rev bool) ([]ScoredMember, error) {
+	ranked, err := lru.ranked(key, rev)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := listBounds(len(ranked), start, stop)
+	return ranked[lo:hi], nil
+}
+
+// ZRangeByScore returns the members with min <= score <= max ordered by
+// ascending score, or descending when rev is set.
+func (lru *LRU) ZRangeByScore(key string, min, max float64, rev bool) ([]ScoredMember, error) {
+	ranked, err := lru.ranked(key, rev)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ScoredMember, 0)
+	for _, sm := range ranked {
+		if sm.Score >= min && sm.Score <= max {
+			out = append(out, sm)
+		}
+	}
+	return out, nil
+}
+
+// ZRank returns the 0-based rank and score of member in the sorted set at
+// key, by ascending score or descending when rev is set.
+func (lru *LRU) ZRank(key, member string, rev bool) (int, float64, error) {
+	ranked, err := lru.ranked(key, rev)
+	if err != nil {
+		return 0, 0, err
+	}
+	for i, sm := range ranked {
+		if sm.Member == member {
+			return i, sm.Score, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("member %s of key %s %w", member, key, ErrNotFound)
+}
+
+// ranked copies the sorted set at key out of the shard and sorts it by
+// score, breaking ties by member. Sorting happens outside the shard lock.
+func (lru *LRU) ranked(key string, rev bool) ([]ScoredMember, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	node, err := s.liveKindLocked(key, kindZSet)
+	if err != nil || node == nil {
+		s.mu.Unlock()
+		if err == nil {
+			err = fmt.Errorf("value for the key %s %w", key, ErrNotFound)
+		}
+		return nil, err
+	}
+	s.touchLocked(node)
+	ranked := make([]ScoredMember, 0, len(node.ZSet))
+	for m, score := range node.ZSet {
+		ranked = append(ranked, ScoredMember{Member: m, Score: score})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Score != ranked[j].Score {
+			return ranked[i].Score < ranked[j].Score != rev
+		}
+		return ranked[i].Member < ranked[j].Member != rev
+	})
+	return ranked, nil
+}
+
+func setMembers(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for m := range set {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func copyScores(scores map[string]float64) map[string]float64 {
+	out := make(map[string]float64, len(scores))
+	for m, score := range scores {
+		out[m] = score
+	}
+	return out
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot file is a header followed by blocks and an end marker:
+//
+//	header:  "DCSNAP" | version (1 byte) | flags (1 byte)
+//	block:   payload length (uint32) | CRC-32C of payload (uint32) | payload
+//	end:     a block header with length 0
+//
+// Each payload is a gob-encoded []entryRecord, gzip-compressed when the
+// header says so. A file without the end marker was cut short and is
+// rejected, as is a block whose checksum does not match.
+const (
+	snapshotMagic        = "DCSNAP"
+	snapshotVersion      = 1
+	snapshotFlagGzip     = 1 << 0
+	snapshotBlockEntries = 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errLegacySnapshot marks a file written before the block format existed.
+var errLegacySnapshot = errors.New("not a block snapshot")
+
+// SnapshotOptions controls how snapshots are written.
+type SnapshotOptions struct {
+	Compress bool // gzip each block
+	Keep     int  // older snapshots kept as <path>.1 ... <path>.N
+}
+
+// entryRecord is one cache entry as stored on disk, by snapshots and the
+// append-only file alike.
+type entryRecord struct {
+	Key     string
+	Kind    valueKind
+	Value   string
+	Hash    map[string]string
+	List    []string
+	Set     []string
+	ZSet    map[string]float64
+	Version uint64
+	Tags    []string
+	Expiry  time.Time // zero if the key never expires; includes the grace period
+	Sliding time.Duration
+
+	Grace     time.Duration
+	Recompute time.Duration
+}
+
+// recordLocked copies node, with its expiry, into an entryRecord that stays
+// valid after s.mu is released. Caller must hold s.mu.
+func (s *lruShard) recordLocked(node *Node) entryRecord {
+	rec := entryRecord{
+		Key:     node.Key,
+		Kind:    node.Kind,
+		Value:   node.Value,
+		Version: node.Version,
+		Tags:    append([]string(nil), node.Tags...),
+		Sliding: node.Sliding,
+
+		Grace:     node.Grace,
+		Recompute: node.Recompute,
+	}
+	switch node.Kind {
+	case kindHash:
+		rec.Hash = copyFields(node.Hash)
+	case kindList:
+		rec.List = append([]string(nil), node.List...)
+	case kindSet:
+		rec.Set = setMembers(node.Set)
+	case kindZSet:
+		rec.ZSet = copyScores(node.ZSet)
+	}
+	if exp, ok := s.expiry.get(node.Key); ok {
+		rec.Expiry = exp
+	}
+	return rec
+}
+
+// node rebuilds the cache entry described by rec, without its expiry.
+func (rec entryRecord) node() *Node {
+	node := &Node{
+		Key:     rec.Key,
+		Kind:    rec.Kind,
+		Value:   rec.Value,
+		Hash:    rec.Hash,
+		List:    rec.List,
+		ZSet:    rec.ZSet,
+		Version: rec.Version,
+		Sliding: rec.Sliding,
+
+		Grace:     rec.Grace,
+		Recompute: rec.Recompute,
+	}
+	if rec.Kind == kindSet {
+		node.Set = make(map[string]struct{}, len(rec.Set))
+		for _, m := range rec.Set {
+			node.Set[m] = struct{}{}
+		}
+	}
+	return node
+}
+
+// SetSnapshotOptions configures compression and retention of snapshots.
+func (lru *LRU) SetSnapshotOptions(opts SnapshotOptions) {
+	lru.snapshotOpts = opts
+}
+
+// saveToDisk writes every live entry to a new snapshot. Shards are streamed
+// one at a time and each lock is held for at most one block of entries, so
+// neither memory use nor request latency grows with the size of the cache.
+// The file is written next to the current one and renamed over it once
+// complete and synced, so a crash mid-write never damages the existing
+// snapshot.
+func (lru *LRU) saveToDisk() (bool, error) {
+	lru.saveMu.Lock()
+	defer lru.saveMu.Unlock()
+
+	start := time.Now()
+	entries := 0
+	size, err := writeSnapshotFile(lru.filepath, lru.snapshotOpts, func(sw *snapshotWriter) error {
+		for i := range lru.shards {
+			n, err := lru.shards[i].writeTo(sw)
+			entries += n
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	lru.lastSnapshot.duration.Store(int64(time.Since(start)))
+	lru.lastSnapshot.bytes.Store(size)
+	lru.lastSnapshot.entries.Store(int64(entries))
+	log.Println("saved at: ", lru.filepath)
+	return true, nil
+}
+
+// snapshotStats describes the last snapshot written.
+type snapshotStats struct {
+	duration atomic.Int64 // nanoseconds
+	bytes    atomic.Int64
+	entries  atomic.Int64
+}
+
+// SnapshotStats returns how long the last snapshot took, its size in bytes
+// and how many entries it held.
+func (lru *LRU) SnapshotStats() (time.Duration, int64, int64) {
+	st := &lru.lastSnapshot
+	return time.Duration(st.duration.Load()), st.bytes.Load(), st.entries.Load()
+}
+
+// writeTo streams the live entries of the shard to sw in recency order and
+// returns how many it wrote. The key order is copied first; entries are then
+// copied one block at a time, skipping keys removed in between.
+func (s *lruShard) writeTo(sw *snapshotWriter) (int, error) {
+	s.mu.Lock()
+	keys := make([]string, 0, len(s.bucket))
+	for curr := s.dll.Head; curr != nil; curr = curr.Next {
+		keys = append(keys, curr.Key)
+	}
+	s.mu.Unlock()
+
+	written := 0
+	block := make([]entryRecord, 0, snapshotBlockEntries)
+	for len(keys) > 0 {
+		n := snapshotBlockEntries
+		if n > len(keys) {
+			n = len(keys)
+		}
+		now := time.Now()
+		s.mu.Lock()
+		for _, key := range keys[:n] {
+			if node, ok := s.bucket[key]; ok && !s.expiredLocked(key, now) {
+				block = append(block, s.recordLocked(node))
+			}
+		}
+		s.mu.Unlock()
+		keys = keys[n:]
+
+		if len(block) > 0 {
+			if err := sw.writeBlock(block); err != nil {
+				return written, err
+			}
+			written += len(block)
+			block = block[:0]
+		}
+	}
+	return written, nil
+}
+
+// writeSnapshotFile writes a snapshot to path via a temporary file, filled
+// in by fill, keeps up to opts.Keep previous snapshots and returns the size
+// of the new file.
+func writeSnapshotFile(path string, opts SnapshotOptions, fill func(*snapshotWriter) error) (int64, error) {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	fail := func(err error) (int64, error) {
+		file.Close()
+		os.Remove(tmp)
+		return 0, err
+	}
+	sw := newSnapshotWriter(file, opts.Compress)
+	if err := fill(sw); err != nil {
+		return fail(err)
+	}
+	if err := sw.close(); err != nil {
+		return fail(err)
+	}
+	if err := file.Sync(); err != nil {
+		return fail(err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fail(err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	if opts.Keep > 0 {
+		for i := opts.Keep; i > 1; i-- {
+			if err := os.Rename(retainedSnapshot(path, i-1), retainedSnapshot(path, i)); err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		// Link rather than rename, so path stays valid until the new file
+		// replaces it.
+		os.Remove(retainedSnapshot(path, 1))
+		if err := os.Link(path, retainedSnapshot(path, 1)); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return 0, err
+	}
+	return info.Size(), syncDir(filepath.Dir(path))
+}
+
+// retainedSnapshot names the i-th most recent snapshot before the current
+// one.
+func retainedSnapshot(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// syncDir makes renames within dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// snapshotWriter writes the snapshot format one block at a time.
+type snapshotWriter struct {
+	bw       *bufio.Writer
+	compress bool
+}
+
+func newSnapshotWriter(w io.Writer, compress bool) *snapshotWriter {
+	sw := &snapshotWriter{bw: bufio.NewWriter(w), compress: compress}
+	var flags byte
+	if compress {
+		flags |= snapshotFlagGzip
+	}
+	sw.bw.WriteString(snapshotMagic)
+	sw.bw.WriteByte(snapshotVersion)
+	sw.bw.WriteByte(flags)
+	return sw
+}
+
+// writeBlock encodes entries as one checksummed block.
+func (sw *snapshotWriter) writeBlock(entries []entryRecord) error {
+	var payload bytes.Buffer
+	if sw.compress {
+		zw := gzip.NewWriter(&payload)
+		if err := gob.NewEncoder(zw).Encode(entries); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	} else if err := gob.NewEncoder(&payload).Encode(entries); err != nil {
+		return err
+	}
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(payload.Len()))
+	binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload.Bytes(), crcTable))
+	if _, err := sw.bw.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := sw.bw.Write(payload.Bytes())
+	return err
+}
+
+// close writes the end marker and flushes the snapshot.
+func (sw *snapshotWriter) close() error {
+	var end [8]byte
+	sw.bw.Write(end[:])
+	return sw.bw.Flush()
+}
+
+// readSnapshot decodes a whole snapshot, verifying every block. It returns
+// errLegacySnapshot, having consumed nothing useful, if r does not start
+// with the snapshot header.
+func readSnapshot(r io.Reader) ([]entryRecord, error) {
+	var entries []entryRecord
+	err := readSnapshotBlocks(r, func(recs []entryRecord) error {
+		entries = append(entries, recs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readSnapshotBlocks hands each block of a snapshot to fn as soon as it has
+// been verified. Blocks before a damaged one have already been handed over
+// when it returns an error.
+func readSnapshotBlocks(r io.Reader, fn func([]entryRecord) error) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return errLegacySnapshot
+	}
+	if v := header[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", v)
+	}
+	compressed := header[len(snapshotMagic)+1]&snapshotFlagGzip != 0
+
+	for block := 0; ; block++ {
+		var bh [8]byte
+		if _, err := io.ReadFull(br, bh[:]); err != nil {
+			return fmt.Errorf("snapshot truncated before block %d: %w", block, err)
+		}
+		size, sum := binary.BigEndian.Uint32(bh[:4]), binary.BigEndian.Uint32(bh[4:])
+		if size == 0 {
+			return nil
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return fmt.Errorf("snapshot truncated in block %d: %w", block, err)
+		}
+		if crc32.Checksum(payload, crcTable) != sum {
+			return fmt.Errorf("snapshot block %d: checksum mismatch", block)
+		}
+
+		var src io.Reader = bytes.NewReader(payload)
+		if compressed {
+			zr, err := gzip.NewReader(src)
+			if err != nil {
+				return fmt.Errorf("snapshot block %d: %w", block, err)
+			}
+			src = zr
+		}
+		var recs []entryRecord
+		if err := gob.NewDecoder(src).Decode(&recs); err != nil {
+			return fmt.Errorf("snapshot block %d: %w", block, err)
+		}
+		if err := fn(recs); err != nil {
+			return err
+		}
+	}
+}
+
+// loadFromDisk restores the newest snapshot that reads back intact, falling
+// back to retained older ones if the current file is damaged or missing.
+// Having no snapshot at all is not an error.
+func (lru *LRU) loadFromDisk() (bool, error) {
+	candidates := []string{lru.filepath}
+	for i := 1; i <= lru.snapshotOpts.Keep; i++ {
+		candidates = append(candidates, retainedSnapshot(lru.filepath, i))
+	}
+
+	var firstErr error
+	for _, path := range candidates {
+		entries, err := readSnapshotFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			log.Printf("snapshot %s unusable: %v", path, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if path != lru.filepath {
+			log.Printf("restored from older snapshot %s", path)
+		}
+		lru.restore(entries)
+		return true, nil
+	}
+	if firstErr != nil {
+		return false, firstErr
+	}
+	return true, nil
+}
+
+func readSnapshotFile(path string) ([]entryRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries, err := readSnapshot(file)
+	if errors.Is(err, errLegacySnapshot) {
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return readLegacySnapshot(file)
+	}
+	return entries, err
+}
+
+// restore adds entries loaded from disk to the cache in the order given,
+// skipping the ones that expired while the node was down. An entry already
+// in the cache is replaced only by a newer version. Snapshots list each
+// shard's entries from most to least recently used, so appending them in
+// file order rebuilds the recency order the node had when it saved. If the
+// shard's capacity, or a namespace quota, has shrunk since then, the least
+// recently used entries are the ones left out. Entries copied from another
+// node go through importRecords instead.
+func (lru *LRU) restore(entries []entryRecord) {
+	// Group entries by shard to acquire each lock once.
+	var groups [numShards][]entryRecord
+	now := time.Now()
+	for _, rec := range entries {
+		if !rec.Expiry.IsZero() && now.After(rec.Expiry) {
+			continue
+		}
+		if rec.Version == 0 {
+			rec.Version = nextVersion() // snapshot predates versioning
+		}
+		idx := shardIndex(rec.Key)
+		groups[idx] = append(groups[idx], rec)
+	}
+
+	for i := range lru.shards {
+		if len(groups[i]) == 0 {
+			continue
+		}
+		s := &lru.shards[i]
+		s.mu.Lock()
+		for _, rec := range groups[i] {
+			if node, ok := s.bucket[rec.Key]; ok {
+				if node.Version >= rec.Version {
+					continue
+				}
+				s.removeLocked(node)
+			}
+			if len(s.bucket) >= s.capacity {
+				break
+			}
+			node := rec.node()
+			s.dll.Append(node)
+			s.bucket[node.Key] = node
+			s.index.insert(node.Key)
+			s.trackLocked(node)
+			if s.overQuotaLocked(node) {
+				s.removeLocked(node)
+				continue
+			}
+			s.setTagsLocked(node, rec.Tags)
+			if !rec.Expiry.IsZero() {
+				s.expiry.set(node.Key, rec.Expiry)
+			}
+			s.logWriteLocked(node)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// diskSnapshot is the snapshot format written before the block format: one
+// gob value holding every entry. It is still read so existing nodes can be
+// upgraded in place; the next save rewrites the file in the new format.
+type diskSnapshot struct {
+	Data     map[string]string
+	Hashes   map[string]map[string]string
+	Lists    map[string][]string
+	Sets     map[string][]string
+	ZSets    map[string]map[string]float64
+	Expiry   map[string]time.Time
+	Versions map[string]uint64
+	Tags     map[string][]string
+	Sliding  map[string]time.Duration
+}
+
+func readLegacySnapshot(r io.Reader) ([]entryRecord, error) {
+	var snap diskSnapshot
+	if err := gob.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, err
+	}
+
+	var entries []entryRecord
+	add := func(rec entryRecord) {
+		rec.Version = snap.Versions[rec.Key]
+		rec.Expiry = snap.Expiry[rec.Key]
+		rec.Tags = snap.Tags[rec.Key]
+		rec.Sliding = snap.Sliding[rec.Key]
+		entries = append(entries, rec)
+	}
+	for k, v := range snap.Data {
+		add(entryRecord{Key: k, Value: v})
+	}
+	for k, fields := range snap.Hashes {
+		add(entryRecord{Key: k, Kind: kindHash, Hash: fields})
+	}
+	for k, list := range snap.Lists {
+		add(entryRecord{Key: k, Kind: kindList, List: list})
+	}
+	for k, members := range snap.Sets {
+		add(entryRecord{Key: k, Kind: kindSet, Set: members})
+	}
+	for k, scores := range snap.ZSets {
+		add(entryRecord{Key: k, Kind: kindZSet, ZSet: scores})
+	}
+	return entries, nil
+}
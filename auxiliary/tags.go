@@ -0,0 +1,57 @@
+package main
+
+import "sort"
+
+// setTagsLocked replaces the tags of node, keeping the shard's tag index in
+// step. Passing nil drops the node from the index. Caller must hold s.mu.
+func (s *lruShard) setTagsLocked(node *Node, tags []string) {
+	for _, tag := range node.Tags {
+		if keys := s.tags[tag]; keys != nil {
+			delete(keys, node.Key)
+			if len(keys) == 0 {
+				delete(s.tags, tag)
+			}
+		}
+	}
+	node.Tags = nil
+	if len(tags) == 0 {
+		return
+	}
+
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		node.Tags = append(node.Tags, tag)
+		if s.tags[tag] == nil {
+			s.tags[tag] = make(map[string]struct{})
+		}
+		s.tags[tag][node.Key] = struct{}{}
+	}
+}
+
+// InvalidateTag removes every key carrying tag and returns the keys removed.
+// Tags are namespaced like keys, and the keys are returned without their
+// namespace.
+// Each shard's index is read under its lock and the keys are then removed in
+// batches, as with DeleteMatching.
+func (lru *LRU) InvalidateTag(tag string) []string {
+	removed := make([]string, 0)
+	for i := range lru.shards {
+		s := &lru.shards[i]
+		s.mu.Lock()
+		keys := make([]string, 0, len(s.tags[tag]))
+		for key := range s.tags[tag] {
+			keys = append(keys, key)
+		}
+		s.mu.Unlock()
+		for _, key := range s.removeKeys(keys) {
+			_, k := splitKey(key)
+			removed = append(removed, k)
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
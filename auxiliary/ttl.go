@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// NoExpiry is the TTL reported for keys that never expire.
+const NoExpiry time.Duration = -1
+
+// Expire sets key to expire after ttl. With sliding set the expiry is a
+// window: every Get or Touch of the key restarts it. Any previous expiry,
+// sliding or not, is replaced. Like any write it gives the key a new
+// version, so a copy of the entry replaces older copies on other nodes.
+func (lru *LRU) Expire(key string, ttl time.Duration, sliding bool) error {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.liveLocked(key)
+	if node == nil {
+		return fmt.Errorf("key %s %w", key, ErrNotFound)
+	}
+	node.Sliding = 0
+	if sliding {
+		node.Sliding = ttl
+	}
+	s.expiry.set(key, time.Now().Add(ttl+node.Grace))
+	node.Version = nextVersion()
+	s.logExpireLocked(node)
+	return nil
+}
+
+// Persist removes key's expiry and reports whether it had one. The key gets
+// a new version, as with Expire.
+func (lru *LRU) Persist(key string) (bool, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.liveLocked(key)
+	if node == nil {
+		return false, fmt.Errorf("key %s %w", key, ErrNotFound)
+	}
+	had := s.expiry.remove(key)
+	node.Sliding = 0
+	node.Version = nextVersion()
+	s.logExpireLocked(node)
+	return had, nil
+}
+
+// TTL returns how long key has left to live, or NoExpiry, and whether its
+// expiry is sliding. It does not count as a use of the key.
+func (lru *LRU) TTL(key string) (time.Duration, bool, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.liveLocked(key)
+	if node == nil {
+		return 0, false, fmt.Errorf("key %s %w", key, ErrNotFound)
+	}
+	return s.ttlLocked(node), node.Sliding > 0, nil
+}
+
+// Touch marks key as recently used and restarts its sliding expiry, if it
+// has one, without reading the value. It returns the key's TTL afterwards.
+func (lru *LRU) Touch(key string) (time.Duration, bool, error) {
+	s := lru.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.liveLocked(key)
+	if node == nil {
+		return 0, false, fmt.Errorf("key %s %w", key, ErrNotFound)
+	}
+	s.touchLocked(node)
+	s.refreshLocked(node)
+	return s.ttlLocked(node), node.Sliding > 0, nil
+}
+
+// refreshLocked restarts node's sliding expiry. Keys with a fixed expiry, or
+// none, are left alone. Caller must hold s.mu.
+func (s *lruShard) refreshLocked(node *Node) {
+	if node.Sliding > 0 {
+		s.expiry.set(node.Key, time.Now().Add(node.Sliding+node.Grace))
+	}
+}
+
+// ttlLocked returns the time node has left to live, or NoExpiry. A value
+// within its grace period has 0 left. Caller must hold s.mu.
+func (s *lruShard) ttlLocked(node *Node) time.Duration {
+	exp, ok := s.expiry.get(node.Key)
+	if !ok {
+		return NoExpiry
+	}
+	if ttl := time.Until(exp) - node.Grace; ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+// ttlSeconds rounds a remaining TTL up to whole seconds, so a key that is
+// still live never reports 0. NoExpiry is reported as -1.
+func ttlSeconds(ttl time.Duration) int {
+	if ttl == NoExpiry {
+		return -1
+	}
+	return int((ttl + time.Second - 1) / time.Second)
+}
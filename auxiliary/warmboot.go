@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// RangeTransfer is a range a joining node will own, with the nodes that
+// hold its keys today, as reported by the master.
+type RangeTransfer struct {
+	HashRange
+	Sources []string `json:"sources"`
+}
+
+// Ready answers 200 once the node has finished warming up and registered
+// with the master, and 503 before that.
+func (aux *Auxiliary) Ready(w http.ResponseWriter, r *http.Request) {
+	if !aux.ready.Load() {
+		http.Error(w, "warming up", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// warmBootClient is used for the transfers of a warm boot, which can take
+// much longer than a regular request.
+var warmBootClient = &http.Client{Timeout: 5 * time.Minute}
+
+// WarmBoot asks the master which hash ranges selfAddr will own once it
+// joins the ring and copies their keys from the nodes holding them today,
+// so a replacement node starts with a warm cache instead of an empty one.
+// Each range is fetched from its first source, falling back to the others
+// if that fails. It returns how many entries were copied; ranges that no
+// source could provide are reported in the error.
+func (aux *Auxiliary) WarmBoot(masterAddr, selfAddr string) (int, error) {
+	resp, err := warmBootClient.Get(fmt.Sprintf("http://%s/nodes/%s/ranges", masterAddr, url.PathEscape(selfAddr)))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("master returned %d for the ranges of %s", resp.StatusCode, selfAddr)
+	}
+	var pending []RangeTransfer
+	if err := json.NewDecoder(resp.Body).Decode(&pending); err != nil {
+		return 0, err
+	}
+
+	total, lost := 0, 0
+	for attempt := 0; len(pending) > 0; attempt++ {
+		// Group the ranges still missing by the source to try next.
+		bySource := make(map[string][]RangeTransfer)
+		var order []string
+		for _, tr := range pending {
+			if attempt >= len(tr.Sources) {
+				lost++
+				continue
+			}
+			src := tr.Sources[attempt]
+			if _, ok := bySource[src]; !ok {
+				order = append(order, src)
+			}
+			bySource[src] = append(bySource[src], tr)
+		}
+
+		pending = nil
+		for _, src := range order {
+			ranges := make([]HashRange, len(bySource[src]))
+			for i, tr := range bySource[src] {
+				ranges[i] = tr.HashRange
+			}
+			n, err := aux.copyRanges(src, ranges)
+			total += n
+			if err != nil {
+				log.Printf("warm boot: copying %d ranges from %s failed after %d entries: %v", len(ranges), src, n, err)
+				pending = append(pending, bySource[src]...)
+				continue
+			}
+			log.Printf("warm boot: copied %d entries from %s", n, src)
+		}
+	}
+	if lost > 0 {
+		return total, fmt.Errorf("%d ranges could not be copied from any replica", lost)
+	}
+	return total, nil
+}
+
+// copyRanges imports the entries of ranges held by node, one export page
+// at a time.
+func (aux *Auxiliary) copyRanges(node string, ranges []HashRange) (int, error) {
+	body, err := json.Marshal(ranges)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for cursor := "0"; ; {
+		n, next, err := aux.copyPage(node, body, cursor)
+		total += n
+		if err != nil || next == "" || next == "0" {
+			return total, err
+		}
+		cursor = next
+	}
+}
+
+// copyPage imports the export page of node at cursor and returns how many
+// entries it holds and the cursor of the next page.
+func (aux *Auxiliary) copyPage(node string, ranges []byte, cursor string) (int, string, error) {
+	addr := fmt.Sprintf("http://%s/export?cursor=%s", node, url.QueryEscape(cursor))
+	resp, err := warmBootClient.Post(addr, "application/json", bytes.NewReader(ranges))
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, "", fmt.Errorf("%s returned %d", node, resp.StatusCode)
+	}
+	held, _, err := aux.LRU.ImportSnapshot(resp.Body)
+	return held, resp.Header.Get(exportCursorHeader), err
+}
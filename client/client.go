@@ -1,6 +1,15 @@
 // Package cache provides a Go client for the distributed cache system.
 // It communicates with the master node (typically via the nginx load balancer)
-// and exposes Set, Get, Delete, BulkSet, and BulkGet operations.
+// and exposes Set, Get, Delete, DeleteMatching, BulkSet, and BulkGet
+// operations, plus expiry management (Expire, ExpireSliding, Persist, TTL,
+// Touch), stampede protection (SetWithRefresh), tag-based invalidation
+// (SetTagged, InvalidateTag),
+// conditional writes (SetNX, SetXX, CompareAndSwap), atomic counters,
+// hashes (HSet, HGet, HDel, HGetAll, HIncrBy), lists (LPush, RPush, LPop,
+// RPop, BLPop, BRPop, LRange, LTrim), sets (SAdd, SRem, SMembers, SIsMember,
+// SCard), sorted sets (ZAdd, ZIncrBy, ZRange, ZRangeByScore, ZRank) and a
+// cluster-wide key Scan. WithNamespace isolates a client's keys from other
+// tenants sharing the cluster.
 package cache
 
 import (
@@ -11,16 +20,75 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 )
 
 // ErrNotFound is returned by Get and Delete when the key does not exist.
 var ErrNotFound = errors.New("key not found")
 
+// ErrConflict is returned by conditional writes whose condition did not hold.
+var ErrConflict = errors.New("write condition not met")
+
+// ErrWrongType is returned when an operation targets a key holding a
+// different data type, e.g. HGet on a plain string.
+var ErrWrongType = errors.New("key holds the wrong kind of value")
+
+// Item is a cached value together with the version it was written at.
+// Pass Version to CompareAndSwap to update the key only if it is unchanged.
+//
+// For keys written with SetWithRefresh, Stale reports that the value is past
+// its TTL and served from its grace period, and Refresh that this caller is
+// the one that should rebuild the value and write it back.
+type Item struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Version uint64 `json:"version"`
+	Stale   bool   `json:"stale,omitempty"`
+	Refresh bool   `json:"refresh,omitempty"`
+}
+
+// RefreshPolicy protects a key from a stampede of callers rebuilding it at
+// once when it expires. The server works in whole seconds for TTL and
+// Grace; both are rounded up.
+type RefreshPolicy struct {
+	TTL time.Duration
+	// Grace keeps serving the value, marked stale, for this long after the
+	// TTL while one caller refreshes it.
+	Grace time.Duration
+	// Recompute is how long rebuilding the value takes. When set, one
+	// caller is asked to refresh the value at a random point shortly before
+	// the TTL runs out; the longer the rebuild, the earlier.
+	Recompute time.Duration
+}
+
+// ZMember is one element of a sorted set.
+type ZMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+// keyVal is the wire format of a write.
+type keyVal struct {
+	Key       string   `json:"key"`
+	Value     string   `json:"value"`
+	Cond      string   `json:"cond,omitempty"`
+	IfVersion uint64   `json:"if_version,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	TTL       int      `json:"ttl,omitempty"`
+	Grace     int      `json:"grace,omitempty"`
+	Recompute int      `json:"recompute_ms,omitempty"`
+}
+
+// NamespaceHeader carries the namespace of a request; see WithNamespace.
+const NamespaceHeader = "X-Cache-Namespace"
+
 // Client is a client for the distributed cache. It is safe for concurrent use.
 type Client struct {
-	baseURL string
-	http    *http.Client
+	baseURL   string
+	http      *http.Client
+	namespace string
 }
 
 // Option configures a Client.
@@ -33,6 +101,15 @@ func WithTimeout(d time.Duration) Option {
 	}
 }
 
+// WithNamespace scopes every request to namespace ns. Keys, tags, scans and
+// quotas of different namespaces are fully separate; without this option
+// the client uses the "default" namespace.
+func WithNamespace(ns string) Option {
+	return func(c *Client) {
+		c.namespace = ns
+	}
+}
+
 // WithHTTPClient replaces the underlying HTTP client entirely.
 func WithHTTPClient(hc *http.Client) Option {
 	return func(c *Client) {
@@ -61,14 +138,62 @@ func New(addr string, opts ...Option) *Client {
 
 // Set stores key with value in the cache. It overwrites any existing value.
 func (c *Client) Set(ctx context.Context, key, value string) error {
-	body, err := json.Marshal(struct {
-		Key   string `json:"key"`
-		Value string `json:"value"`
-	}{key, value})
+	return c.put(ctx, "set", keyVal{Key: key, Value: value})
+}
+
+// SetTagged stores key like Set and attaches tags to it, replacing any tags
+// it had. InvalidateTag later removes every key carrying a given tag.
+func (c *Client) SetTagged(ctx context.Context, key, value string, tags ...string) error {
+	return c.put(ctx, "set", keyVal{Key: key, Value: value, Tags: tags})
+}
+
+// SetWithRefresh stores key with the expiry and stampede protection of p.
+// Readers use GetItem and, when Item.Refresh is set, rebuild the value and
+// store it again with SetWithRefresh.
+func (c *Client) SetWithRefresh(ctx context.Context, key, value string, p RefreshPolicy) error {
+	ttl := int((p.TTL + time.Second - 1) / time.Second)
+	if ttl <= 0 {
+		return fmt.Errorf("set %q: ttl must be positive", key)
+	}
+	if p.Grace < 0 || p.Recompute < 0 {
+		return fmt.Errorf("set %q: grace and recompute time must not be negative", key)
+	}
+	return c.put(ctx, "set", keyVal{
+		Key:       key,
+		Value:     value,
+		TTL:       ttl,
+		Grace:     int((p.Grace + time.Second - 1) / time.Second),
+		Recompute: int((p.Recompute + time.Millisecond - 1) / time.Millisecond),
+	})
+}
+
+// SetNX stores key only if it does not already exist.
+// Returns ErrConflict if the key is present.
+func (c *Client) SetNX(ctx context.Context, key, value string) error {
+	return c.put(ctx, "setnx", keyVal{Key: key, Value: value, Cond: "nx"})
+}
+
+// SetXX stores key only if it already exists.
+// Returns ErrConflict if the key is absent.
+func (c *Client) SetXX(ctx context.Context, key, value string) error {
+	return c.put(ctx, "setxx", keyVal{Key: key, Value: value, Cond: "xx"})
+}
+
+// CompareAndSwap stores value only if key is still at version, as returned
+// by GetItem. Returns ErrConflict if the key was changed or removed since.
+func (c *Client) CompareAndSwap(ctx context.Context, key, value string, version uint64) error {
+	if version == 0 {
+		return fmt.Errorf("cas %q: version must be non-zero", key)
+	}
+	return c.put(ctx, "cas", keyVal{Key: key, Value: value, IfVersion: version})
+}
+
+func (c *Client) put(ctx context.Context, op string, kv keyVal) error {
+	body, err := json.Marshal(kv)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/data", bytes.NewReader(body))
+	req, err := c.newRequest(ctx, http.MethodPost, "/data", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -78,42 +203,100 @@ func (c *Client) Set(ctx context.Context, key, value string) error {
 		return err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusConflict {
+		return ErrConflict
+	}
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("set %q: server returned %s", key, resp.Status)
+		return fmt.Errorf("%s %q: server returned %s", op, kv.Key, resp.Status)
 	}
 	return nil
 }
 
 // Get retrieves the value for key. Returns ErrNotFound if the key does not exist.
 func (c *Client) Get(ctx context.Context, key string) (string, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/data/"+key, nil)
+	item, err := c.GetItem(ctx, key)
 	if err != nil {
 		return "", err
 	}
+	return item.Value, nil
+}
+
+// GetItem retrieves the value for key along with its version.
+// Returns ErrNotFound if the key does not exist.
+func (c *Client) GetItem(ctx context.Context, key string) (*Item, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/data/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
 	resp, err := c.http.Do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode == http.StatusNotFound {
-		return "", ErrNotFound
+		return nil, ErrNotFound
 	}
 	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("get %q: server returned %s", key, resp.Status)
+		return nil, fmt.Errorf("get %q: server returned %s", key, resp.Status)
 	}
-	var result struct {
+	var item Item
+	if err := json.NewDecoder(resp.Body).Decode(&item); err != nil {
+		return nil, fmt.Errorf("get %q: decode response: %w", key, err)
+	}
+	return &item, nil
+}
+
+// Incr atomically increments the integer at key by 1 and returns the new value.
+// A missing key is treated as 0.
+func (c *Client) Incr(ctx context.Context, key string) (int64, error) {
+	return c.IncrBy(ctx, key, 1, 0)
+}
+
+// Decr atomically decrements the integer at key by 1 and returns the new value.
+// A missing key is treated as 0.
+func (c *Client) Decr(ctx context.Context, key string) (int64, error) {
+	return c.IncrBy(ctx, key, -1, 0)
+}
+
+// IncrBy atomically adds delta (which may be negative) to the integer at key
+// and returns the new value. If the key does not exist it is created with
+// value delta and, when ttl > 0, expires after ttl. An existing key keeps its
+// expiry.
+func (c *Client) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	body, err := json.Marshal(struct {
 		Key   string `json:"key"`
-		Value string `json:"value"`
+		Delta int64  `json:"delta"`
+		TTL   int    `json:"ttl,omitempty"`
+	}{key, delta, int(ttl / time.Second)})
+	if err != nil {
+		return 0, err
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/data/incr", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("incr %q: server returned %s: %s", key, resp.Status, bytes.TrimSpace(b))
+	}
+	var result struct {
+		Value int64 `json:"value"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return "", fmt.Errorf("get %q: decode response: %w", key, err)
+		return 0, fmt.Errorf("incr %q: decode response: %w", key, err)
 	}
 	return result.Value, nil
 }
 
 // Delete removes key from the cache. Returns ErrNotFound if the key does not exist.
 func (c *Client) Delete(ctx context.Context, key string) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, c.baseURL+"/data/"+key, nil)
+	req, err := c.newRequest(ctx, http.MethodDelete, "/data/"+key, nil)
 	if err != nil {
 		return err
 	}
@@ -131,6 +314,113 @@ func (c *Client) Delete(ctx context.Context, key string) error {
 	return nil
 }
 
+// DeleteOptions selects the keys removed by DeleteMatching. At least one of
+// Prefix and Match must be set; when both are, a key must satisfy both.
+type DeleteOptions struct {
+	Prefix string // keys starting with Prefix
+	Match  string // keys matching this glob pattern (see ScanOptions.Match)
+	DryRun bool   // only count the matching keys
+}
+
+// DeleteMatching removes every key selected by opts across the cluster and
+// returns how many distinct keys were removed (or would be, for a dry run).
+func (c *Client) DeleteMatching(ctx context.Context, opts DeleteOptions) (int, error) {
+	if opts.Prefix == "" && opts.Match == "" {
+		return 0, errors.New("delete matching: prefix or match is required")
+	}
+	q := url.Values{}
+	if opts.Prefix != "" {
+		q.Set("prefix", opts.Prefix)
+	}
+	if opts.Match != "" {
+		q.Set("match", opts.Match)
+	}
+	if opts.DryRun {
+		q.Set("dry_run", "true")
+	}
+	var result struct {
+		Count int `json:"count"`
+	}
+	if err := c.do(ctx, "delete matching", http.MethodDelete, "/data?"+q.Encode(), nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+// InvalidateTag removes every key carrying tag across the cluster and
+// returns how many were removed.
+func (c *Client) InvalidateTag(ctx context.Context, tag string) (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+	if err := c.do(ctx, "invalidate tag", http.MethodDelete, "/tags/"+url.PathEscape(tag), nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+// NoExpiry is the TTL reported for keys that never expire.
+const NoExpiry time.Duration = -1
+
+// ttlInfo is the wire format of the expiry operations.
+type ttlInfo struct {
+	TTL     int  `json:"ttl"`
+	Sliding bool `json:"sliding,omitempty"`
+}
+
+// Expire sets key to expire after ttl, replacing any previous expiry. The
+// server works in whole seconds; ttl is rounded up. Returns ErrNotFound if
+// the key does not exist.
+func (c *Client) Expire(ctx context.Context, key string, ttl time.Duration) error {
+	return c.expire(ctx, key, ttl, false)
+}
+
+// ExpireSliding sets key to expire once it has gone unread for ttl: every
+// Get restarts the countdown. Returns ErrNotFound if the key does not exist.
+func (c *Client) ExpireSliding(ctx context.Context, key string, ttl time.Duration) error {
+	return c.expire(ctx, key, ttl, true)
+}
+
+func (c *Client) expire(ctx context.Context, key string, ttl time.Duration, sliding bool) error {
+	secs := int((ttl + time.Second - 1) / time.Second)
+	if secs <= 0 {
+		return fmt.Errorf("expire %q: ttl must be positive", key)
+	}
+	in := ttlInfo{TTL: secs, Sliding: sliding}
+	return c.do(ctx, "expire", http.MethodPost, "/data/"+url.PathEscape(key)+"/expire", in, nil)
+}
+
+// Persist removes the expiry of key and reports whether it had one.
+// Returns ErrNotFound if the key does not exist.
+func (c *Client) Persist(ctx context.Context, key string) (bool, error) {
+	var result struct {
+		Persisted bool `json:"persisted"`
+	}
+	if err := c.do(ctx, "persist", http.MethodPost, "/data/"+url.PathEscape(key)+"/persist", nil, &result); err != nil {
+		return false, err
+	}
+	return result.Persisted, nil
+}
+
+// TTL returns how long key has left to live, in whole seconds, or NoExpiry.
+// Returns ErrNotFound if the key does not exist.
+func (c *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	var result ttlInfo
+	if err := c.do(ctx, "ttl", http.MethodGet, "/data/"+url.PathEscape(key)+"/ttl", nil, &result); err != nil {
+		return 0, err
+	}
+	if result.TTL < 0 {
+		return NoExpiry, nil
+	}
+	return time.Duration(result.TTL) * time.Second, nil
+}
+
+// Touch marks key as used without reading it, restarting a sliding expiry.
+// Returns ErrNotFound if the key does not exist.
+func (c *Client) Touch(ctx context.Context, key string) error {
+	return c.do(ctx, "touch", http.MethodPost, "/data/"+url.PathEscape(key)+"/touch", nil, nil)
+}
+
 // BulkSet stores all key-value pairs in a single request.
 func (c *Client) BulkSet(ctx context.Context, entries map[string]string) error {
 	type kv struct {
@@ -145,7 +435,7 @@ func (c *Client) BulkSet(ctx context.Context, entries map[string]string) error {
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/data/bulk", bytes.NewReader(body))
+	req, err := c.newRequest(ctx, http.MethodPost, "/data/bulk", bytes.NewReader(body))
 	if err != nil {
 		return err
 	}
@@ -168,7 +458,7 @@ func (c *Client) BulkGet(ctx context.Context, keys []string) (map[string]string,
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/data/bulk/get", bytes.NewReader(body))
+	req, err := c.newRequest(ctx, http.MethodPost, "/data/bulk/get", bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
@@ -189,9 +479,467 @@ func (c *Client) BulkGet(ctx context.Context, keys []string) (map[string]string,
 	return result, nil
 }
 
+// HSet sets fields on the hash at key, creating it if needed, and returns how
+// many fields were newly added.
+func (c *Client) HSet(ctx context.Context, key string, fields map[string]string) (int, error) {
+	var result struct {
+		Added int `json:"added"`
+	}
+	in := struct {
+		Fields map[string]string `json:"fields"`
+	}{fields}
+	if err := c.do(ctx, "hset", http.MethodPost, "/hash/"+url.PathEscape(key), in, &result); err != nil {
+		return 0, err
+	}
+	return result.Added, nil
+}
+
+// HGet returns one field of the hash at key. Returns ErrNotFound if the key
+// or field does not exist.
+func (c *Client) HGet(ctx context.Context, key, field string) (string, error) {
+	var result struct {
+		Value string `json:"value"`
+	}
+	path := "/hash/" + url.PathEscape(key) + "/" + url.PathEscape(field)
+	if err := c.do(ctx, "hget", http.MethodGet, path, nil, &result); err != nil {
+		return "", err
+	}
+	return result.Value, nil
+}
+
+// HGetAll returns every field of the hash at key. Returns ErrNotFound if the
+// key does not exist.
+func (c *Client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	var result struct {
+		Fields map[string]string `json:"fields"`
+	}
+	if err := c.do(ctx, "hgetall", http.MethodGet, "/hash/"+url.PathEscape(key), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Fields, nil
+}
+
+// HDel removes fields from the hash at key and returns how many existed.
+// The key is deleted once its last field is removed.
+func (c *Client) HDel(ctx context.Context, key string, fields ...string) (int, error) {
+	q := url.Values{"field": fields}
+	var result struct {
+		Removed int `json:"removed"`
+	}
+	if err := c.do(ctx, "hdel", http.MethodDelete, "/hash/"+url.PathEscape(key)+"?"+q.Encode(), nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Removed, nil
+}
+
+// HIncrBy atomically adds delta to the integer in field of the hash at key
+// and returns the new value. Missing keys and fields start at 0.
+func (c *Client) HIncrBy(ctx context.Context, key, field string, delta int64) (int64, error) {
+	var result struct {
+		Value int64 `json:"value"`
+	}
+	in := struct {
+		Delta int64 `json:"delta"`
+	}{delta}
+	path := "/hash/" + url.PathEscape(key) + "/" + url.PathEscape(field) + "/incr"
+	if err := c.do(ctx, "hincrby", http.MethodPost, path, in, &result); err != nil {
+		return 0, err
+	}
+	return result.Value, nil
+}
+
+// LPush prepends values to the list at key, creating it if needed, and
+// returns the new length.
+func (c *Client) LPush(ctx context.Context, key string, values ...string) (int, error) {
+	return c.push(ctx, "lpush", key, values)
+}
+
+// RPush appends values to the list at key, creating it if needed, and
+// returns the new length.
+func (c *Client) RPush(ctx context.Context, key string, values ...string) (int, error) {
+	return c.push(ctx, "rpush", key, values)
+}
+
+func (c *Client) push(ctx context.Context, op, key string, values []string) (int, error) {
+	var result struct {
+		Length int `json:"length"`
+	}
+	in := struct {
+		Values []string `json:"values"`
+	}{values}
+	if err := c.do(ctx, op, http.MethodPost, "/list/"+url.PathEscape(key)+"/"+op, in, &result); err != nil {
+		return 0, err
+	}
+	return result.Length, nil
+}
+
+// LPop removes and returns the first element of the list at key.
+// Returns ErrNotFound if the list is empty or missing.
+func (c *Client) LPop(ctx context.Context, key string) (string, error) {
+	return c.pop(ctx, "lpop", key, 0)
+}
+
+// RPop removes and returns the last element of the list at key.
+// Returns ErrNotFound if the list is empty or missing.
+func (c *Client) RPop(ctx context.Context, key string) (string, error) {
+	return c.pop(ctx, "rpop", key, 0)
+}
+
+// BLPop is LPop, but waits up to timeout (capped by the server at 10s) for
+// an element to arrive. Returns ErrNotFound if none arrived in time.
+func (c *Client) BLPop(ctx context.Context, key string, timeout time.Duration) (string, error) {
+	return c.pop(ctx, "lpop", key, timeout)
+}
+
+// BRPop is RPop, but waits up to timeout (capped by the server at 10s) for
+// an element to arrive. Returns ErrNotFound if none arrived in time.
+func (c *Client) BRPop(ctx context.Context, key string, timeout time.Duration) (string, error) {
+	return c.pop(ctx, "rpop", key, timeout)
+}
+
+func (c *Client) pop(ctx context.Context, op, key string, timeout time.Duration) (string, error) {
+	path := "/list/" + url.PathEscape(key) + "/" + op
+	hc := c.http
+	if timeout > 0 {
+		path += "?timeout=" + strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+		// Leave room for the server-side wait on top of the usual timeout.
+		if hc.Timeout > 0 {
+			extended := *hc
+			extended.Timeout += timeout
+			hc = &extended
+		}
+	}
+	var result struct {
+		Value string `json:"value"`
+	}
+	if err := c.doWith(ctx, hc, op, http.MethodPost, path, nil, &result); err != nil {
+		return "", err
+	}
+	return result.Value, nil
+}
+
+// LRange returns the elements of the list at key between start and stop,
+// inclusive. Negative indexes count from the end, so LRange(ctx, key, 0, -1)
+// returns the whole list.
+func (c *Client) LRange(ctx context.Context, key string, start, stop int) ([]string, error) {
+	q := url.Values{"start": {strconv.Itoa(start)}, "stop": {strconv.Itoa(stop)}}
+	var result struct {
+		Values []string `json:"values"`
+	}
+	if err := c.do(ctx, "lrange", http.MethodGet, "/list/"+url.PathEscape(key)+"?"+q.Encode(), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Values, nil
+}
+
+// LTrim keeps only the elements of the list at key between start and stop
+// (indexed as in LRange). An empty result deletes the key.
+func (c *Client) LTrim(ctx context.Context, key string, start, stop int) error {
+	in := struct {
+		Start int `json:"start"`
+		Stop  int `json:"stop"`
+	}{start, stop}
+	return c.do(ctx, "ltrim", http.MethodPost, "/list/"+url.PathEscape(key)+"/trim", in, nil)
+}
+
+// SAdd adds members to the set at key and returns how many were new.
+func (c *Client) SAdd(ctx context.Context, key string, members ...string) (int, error) {
+	var result struct {
+		Added int `json:"added"`
+	}
+	in := struct {
+		Members []string `json:"members"`
+	}{members}
+	if err := c.do(ctx, "sadd", http.MethodPost, "/set/"+url.PathEscape(key)+"/add", in, &result); err != nil {
+		return 0, err
+	}
+	return result.Added, nil
+}
+
+// SRem removes members from the set at key and returns how many were present.
+func (c *Client) SRem(ctx context.Context, key string, members ...string) (int, error) {
+	var result struct {
+		Removed int `json:"removed"`
+	}
+	in := struct {
+		Members []string `json:"members"`
+	}{members}
+	if err := c.do(ctx, "srem", http.MethodPost, "/set/"+url.PathEscape(key)+"/remove", in, &result); err != nil {
+		return 0, err
+	}
+	return result.Removed, nil
+}
+
+// SMembers returns the members of the set at key in lexical order.
+// Returns ErrNotFound if the key does not exist.
+func (c *Client) SMembers(ctx context.Context, key string) ([]string, error) {
+	var result struct {
+		Members []string `json:"members"`
+	}
+	if err := c.do(ctx, "smembers", http.MethodGet, "/set/"+url.PathEscape(key), nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Members, nil
+}
+
+// SIsMember reports whether member belongs to the set at key.
+func (c *Client) SIsMember(ctx context.Context, key, member string) (bool, error) {
+	var result struct {
+		IsMember bool `json:"is_member"`
+	}
+	path := "/set/" + url.PathEscape(key) + "/members/" + url.PathEscape(member)
+	if err := c.do(ctx, "sismember", http.MethodGet, path, nil, &result); err != nil {
+		return false, err
+	}
+	return result.IsMember, nil
+}
+
+// SCard returns the number of members in the set at key.
+func (c *Client) SCard(ctx context.Context, key string) (int, error) {
+	var result struct {
+		Cardinality int `json:"cardinality"`
+	}
+	if err := c.do(ctx, "scard", http.MethodGet, "/set/"+url.PathEscape(key)+"/card", nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Cardinality, nil
+}
+
+// ZAdd sets the scores of members in the sorted set at key and returns how
+// many members were new.
+func (c *Client) ZAdd(ctx context.Context, key string, members map[string]float64) (int, error) {
+	var result struct {
+		Added int `json:"added"`
+	}
+	in := struct {
+		Members map[string]float64 `json:"members"`
+	}{members}
+	if err := c.do(ctx, "zadd", http.MethodPost, "/zset/"+url.PathEscape(key)+"/add", in, &result); err != nil {
+		return 0, err
+	}
+	return result.Added, nil
+}
+
+// ZIncrBy adds delta to the score of member in the sorted set at key and
+// returns the new score.
+func (c *Client) ZIncrBy(ctx context.Context, key, member string, delta float64) (float64, error) {
+	var result ZMember
+	in := struct {
+		Member string  `json:"member"`
+		Delta  float64 `json:"delta"`
+	}{member, delta}
+	if err := c.do(ctx, "zincrby", http.MethodPost, "/zset/"+url.PathEscape(key)+"/incr", in, &result); err != nil {
+		return 0, err
+	}
+	return result.Score, nil
+}
+
+// ZRange returns the members ranked start..stop (inclusive; negative indexes
+// count from the end) by ascending score, or by descending score if rev is
+// set — ZRange(ctx, key, 0, 9, true) is a top-10 leaderboard.
+func (c *Client) ZRange(ctx context.Context, key string, start, stop int, rev bool) ([]ZMember, error) {
+	q := url.Values{"start": {strconv.Itoa(start)}, "stop": {strconv.Itoa(stop)}}
+	if rev {
+		q.Set("rev", "true")
+	}
+	return c.zmembers(ctx, "zrange", "/zset/"+url.PathEscape(key)+"?"+q.Encode())
+}
+
+// ZRangeByScore returns the members with min <= score <= max, by ascending
+// score or descending if rev is set. Use math.Inf for open bounds.
+func (c *Client) ZRangeByScore(ctx context.Context, key string, min, max float64, rev bool) ([]ZMember, error) {
+	q := url.Values{
+		"min": {strconv.FormatFloat(min, 'g', -1, 64)},
+		"max": {strconv.FormatFloat(max, 'g', -1, 64)},
+	}
+	if rev {
+		q.Set("rev", "true")
+	}
+	return c.zmembers(ctx, "zrangebyscore", "/zset/"+url.PathEscape(key)+"/byscore?"+q.Encode())
+}
+
+func (c *Client) zmembers(ctx context.Context, op, path string) ([]ZMember, error) {
+	var result struct {
+		Members []ZMember `json:"members"`
+	}
+	if err := c.do(ctx, op, http.MethodGet, path, nil, &result); err != nil {
+		return nil, err
+	}
+	return result.Members, nil
+}
+
+// ZRank returns the 0-based rank and score of member in the sorted set at
+// key, by ascending score or descending if rev is set. Returns ErrNotFound
+// if the key or member does not exist.
+func (c *Client) ZRank(ctx context.Context, key, member string, rev bool) (int, float64, error) {
+	path := "/zset/" + url.PathEscape(key) + "/rank/" + url.PathEscape(member)
+	if rev {
+		path += "?rev=true"
+	}
+	var result struct {
+		Rank  int     `json:"rank"`
+		Score float64 `json:"score"`
+	}
+	if err := c.do(ctx, "zrank", http.MethodGet, path, nil, &result); err != nil {
+		return 0, 0, err
+	}
+	return result.Rank, result.Score, nil
+}
+
+// ScanOptions filters a Scan. The zero value scans every key.
+type ScanOptions struct {
+	// Match is a glob pattern keys must match: * any run of characters,
+	// ? one character, [abc] or [a-z] a class, \ escapes.
+	Match string
+	// Type restricts the scan to "string", "hash", "list", "set" or "zset".
+	Type string
+	// Count hints how many keys each server round trip examines (default 100).
+	Count int
+}
+
+// ScanIterator walks the keys of the whole cluster a page at a time.
+//
+//	it := c.Scan(ctx, cache.ScanOptions{Match: "user:*"})
+//	for it.Next() {
+//		fmt.Println(it.Key())
+//	}
+//	if err := it.Err(); err != nil { ... }
+//
+// Keys that exist for the whole scan are returned exactly once; keys added
+// or removed while it runs may or may not be.
+type ScanIterator struct {
+	c      *Client
+	ctx    context.Context
+	opts   ScanOptions
+	cursor string
+	page   []string
+	key    string
+	done   bool
+	err    error
+}
+
+// Scan returns an iterator over the keys matching opts.
+func (c *Client) Scan(ctx context.Context, opts ScanOptions) *ScanIterator {
+	return &ScanIterator{c: c, ctx: ctx, opts: opts, cursor: "0"}
+}
+
+// Next advances to the next key, fetching pages as needed. It returns false
+// when the scan is complete or an error occurred; check Err.
+func (it *ScanIterator) Next() bool {
+	for len(it.page) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+		it.fetch()
+	}
+	it.key, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+func (it *ScanIterator) fetch() {
+	q := url.Values{"cursor": {it.cursor}}
+	if it.opts.Match != "" {
+		q.Set("match", it.opts.Match)
+	}
+	if it.opts.Type != "" {
+		q.Set("type", it.opts.Type)
+	}
+	if it.opts.Count > 0 {
+		q.Set("count", strconv.Itoa(it.opts.Count))
+	}
+	var page struct {
+		Cursor string   `json:"cursor"`
+		Keys   []string `json:"keys"`
+	}
+	if err := it.c.do(it.ctx, "scan", http.MethodGet, "/scan?"+q.Encode(), nil, &page); err != nil {
+		it.err = err
+		return
+	}
+	it.page, it.cursor = page.Keys, page.Cursor
+	it.done = page.Cursor == "0" || page.Cursor == ""
+}
+
+// Key returns the key at the iterator's current position.
+func (it *ScanIterator) Key() string { return it.key }
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error { return it.err }
+
+// FlushNamespace removes every key of namespace ns across the cluster and
+// returns how many were removed.
+func (c *Client) FlushNamespace(ctx context.Context, ns string) (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+	if err := c.do(ctx, "flush namespace", http.MethodDelete, "/namespaces/"+url.PathEscape(ns), nil, &result); err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+// newRequest builds a request to path, tagged with the client's namespace.
+func (c *Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.namespace != "" {
+		req.Header.Set(NamespaceHeader, c.namespace)
+	}
+	return req, nil
+}
+
+// do sends in (if non-nil) as JSON and decodes the response into out,
+// mapping error statuses to ErrNotFound, ErrConflict and ErrWrongType.
+func (c *Client) do(ctx context.Context, op, method, path string, in, out interface{}) error {
+	return c.doWith(ctx, c.http, op, method, path, in, out)
+}
+
+func (c *Client) doWith(ctx context.Context, hc *http.Client, op, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusUnprocessableEntity:
+		return ErrWrongType
+	default:
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: server returned %s: %s", op, resp.Status, bytes.TrimSpace(b))
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s: decode response: %w", op, err)
+	}
+	return nil
+}
+
 // Health returns nil if the master is reachable and healthy.
 func (c *Client) Health(ctx context.Context) error {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/health", nil)
+	req, err := c.newRequest(ctx, http.MethodGet, "/health", nil)
 	if err != nil {
 		return err
 	}
@@ -2,10 +2,13 @@ package cache_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	cache "distributed-cache/client"
 )
@@ -67,6 +70,441 @@ func TestGet_NotFound(t *testing.T) {
 	}
 }
 
+func TestGetItem(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"hello","value":"world","version":42}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+
+	item, err := c.GetItem(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("GetItem: unexpected error: %v", err)
+	}
+	if item.Value != "world" || item.Version != 42 {
+		t.Fatalf("GetItem: got %+v", item)
+	}
+}
+
+func TestSetWithRefresh(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			TTL       int `json:"ttl"`
+			Grace     int `json:"grace"`
+			Recompute int `json:"recompute_ms"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.TTL != 60 || body.Grace != 10 || body.Recompute != 250 {
+			http.Error(w, "unexpected policy", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/data/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"key":"hello","value":"world","version":7,"stale":true,"refresh":true}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+
+	p := cache.RefreshPolicy{TTL: time.Minute, Grace: 10 * time.Second, Recompute: 250 * time.Millisecond}
+	if err := c.SetWithRefresh(context.Background(), "hello", "world", p); err != nil {
+		t.Fatalf("SetWithRefresh: unexpected error: %v", err)
+	}
+	if err := c.SetWithRefresh(context.Background(), "hello", "world", cache.RefreshPolicy{}); err == nil {
+		t.Fatal("SetWithRefresh without a TTL: expected an error")
+	}
+
+	item, err := c.GetItem(context.Background(), "hello")
+	if err != nil {
+		t.Fatalf("GetItem: unexpected error: %v", err)
+	}
+	if !item.Stale || !item.Refresh {
+		t.Fatalf("GetItem: got %+v, want a stale item to refresh", item)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			IfVersion uint64 `json:"if_version"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.IfVersion != 42 {
+			http.Error(w, "write condition not met", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+
+	if err := c.CompareAndSwap(context.Background(), "hello", "new", 42); err != nil {
+		t.Fatalf("CompareAndSwap: unexpected error: %v", err)
+	}
+	err := c.CompareAndSwap(context.Background(), "hello", "new", 41)
+	if !errors.Is(err, cache.ErrConflict) {
+		t.Fatalf("CompareAndSwap stale version: want ErrConflict, got %v", err)
+	}
+}
+
+func TestSetNX_Conflict(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Cond string `json:"cond"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Cond != "nx" {
+			t.Errorf("SetNX: got cond %q, want %q", body.Cond, "nx")
+		}
+		http.Error(w, "write condition not met", http.StatusConflict)
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+
+	err := c.SetNX(context.Background(), "hello", "world")
+	if !errors.Is(err, cache.ErrConflict) {
+		t.Fatalf("SetNX existing key: want ErrConflict, got %v", err)
+	}
+}
+
+func TestIncrBy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data/incr", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Key   string `json:"key"`
+			Delta int64  `json:"delta"`
+			TTL   int    `json:"ttl"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Delta != -3 || body.TTL != 60 {
+			t.Errorf("IncrBy: unexpected request %+v", body)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"hits","value":7}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+
+	val, err := c.IncrBy(context.Background(), "hits", -3, time.Minute)
+	if err != nil {
+		t.Fatalf("IncrBy: unexpected error: %v", err)
+	}
+	if val != 7 {
+		t.Fatalf("IncrBy: got %d, want 7", val)
+	}
+}
+
+func TestHashOps(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hash/user:1", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodPost:
+			w.Write([]byte(`{"added":2}`))
+		case http.MethodGet:
+			w.Write([]byte(`{"key":"user:1","fields":{"name":"alice","age":"30"}}`))
+		case http.MethodDelete:
+			if got := r.URL.Query()["field"]; len(got) != 2 {
+				t.Errorf("HDel: got fields %v", got)
+			}
+			w.Write([]byte(`{"removed":1}`))
+		}
+	})
+	mux.HandleFunc("/hash/user:1/name", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"user:1","field":"name","value":"alice"}`))
+	})
+	mux.HandleFunc("/hash/user:1/age/incr", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"value":31}`))
+	})
+	mux.HandleFunc("/hash/plain", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "wrong kind of value", http.StatusUnprocessableEntity)
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+	ctx := context.Background()
+
+	if added, err := c.HSet(ctx, "user:1", map[string]string{"name": "alice", "age": "30"}); err != nil || added != 2 {
+		t.Fatalf("HSet: got %d err=%v", added, err)
+	}
+	if val, err := c.HGet(ctx, "user:1", "name"); err != nil || val != "alice" {
+		t.Fatalf("HGet: got %q err=%v", val, err)
+	}
+	if all, err := c.HGetAll(ctx, "user:1"); err != nil || all["age"] != "30" {
+		t.Fatalf("HGetAll: got %v err=%v", all, err)
+	}
+	if n, err := c.HIncrBy(ctx, "user:1", "age", 1); err != nil || n != 31 {
+		t.Fatalf("HIncrBy: got %d err=%v", n, err)
+	}
+	if removed, err := c.HDel(ctx, "user:1", "name", "missing"); err != nil || removed != 1 {
+		t.Fatalf("HDel: got %d err=%v", removed, err)
+	}
+	if _, err := c.HGetAll(ctx, "plain"); !errors.Is(err, cache.ErrWrongType) {
+		t.Fatalf("HGetAll on string: want ErrWrongType, got %v", err)
+	}
+}
+
+func TestListOps(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/list/jobs/rpush", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"length":2}`))
+	})
+	mux.HandleFunc("/list/jobs/lpop", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("timeout") == "" {
+			t.Errorf("BLPop: missing timeout parameter")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"jobs","value":"job-1"}`))
+	})
+	mux.HandleFunc("/list/jobs/rpop", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "value for the key jobs not found", http.StatusNotFound)
+	})
+	mux.HandleFunc("/list/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("start") != "0" || r.URL.Query().Get("stop") != "-1" {
+			t.Errorf("LRange: unexpected query %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"jobs","values":["job-1","job-2"]}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+	ctx := context.Background()
+
+	if n, err := c.RPush(ctx, "jobs", "job-1", "job-2"); err != nil || n != 2 {
+		t.Fatalf("RPush: got %d err=%v", n, err)
+	}
+	if vals, err := c.LRange(ctx, "jobs", 0, -1); err != nil || len(vals) != 2 {
+		t.Fatalf("LRange: got %v err=%v", vals, err)
+	}
+	if val, err := c.BLPop(ctx, "jobs", time.Second); err != nil || val != "job-1" {
+		t.Fatalf("BLPop: got %q err=%v", val, err)
+	}
+	if _, err := c.RPop(ctx, "jobs"); !errors.Is(err, cache.ErrNotFound) {
+		t.Fatalf("RPop on empty list: want ErrNotFound, got %v", err)
+	}
+}
+
+func TestSetOps(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set/tags/add", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"added":2}`))
+	})
+	mux.HandleFunc("/set/tags/members/go", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"member":"go","is_member":true}`))
+	})
+	mux.HandleFunc("/set/tags/card", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"cardinality":2}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+	ctx := context.Background()
+
+	if n, err := c.SAdd(ctx, "tags", "go", "cache"); err != nil || n != 2 {
+		t.Fatalf("SAdd: got %d err=%v", n, err)
+	}
+	if ok, err := c.SIsMember(ctx, "tags", "go"); err != nil || !ok {
+		t.Fatalf("SIsMember: got %v err=%v", ok, err)
+	}
+	if n, err := c.SCard(ctx, "tags"); err != nil || n != 2 {
+		t.Fatalf("SCard: got %d err=%v", n, err)
+	}
+}
+
+func TestSortedSetOps(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/zset/board", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("rev") != "true" {
+			t.Errorf("ZRange: expected rev=true, got %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"board","members":[{"member":"bob","score":20},{"member":"alice","score":10}]}`))
+	})
+	mux.HandleFunc("/zset/board/rank/alice", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"member":"alice","rank":1,"score":10}`))
+	})
+	mux.HandleFunc("/zset/board/incr", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"member":"alice","score":15}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+	ctx := context.Background()
+
+	top, err := c.ZRange(ctx, "board", 0, 9, true)
+	if err != nil || len(top) != 2 || top[0].Member != "bob" {
+		t.Fatalf("ZRange: got %v err=%v", top, err)
+	}
+	if rank, score, err := c.ZRank(ctx, "board", "alice", true); err != nil || rank != 1 || score != 10 {
+		t.Fatalf("ZRank: got %d/%v err=%v", rank, score, err)
+	}
+	if score, err := c.ZIncrBy(ctx, "board", "alice", 5); err != nil || score != 15 {
+		t.Fatalf("ZIncrBy: got %v err=%v", score, err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	pages := map[string]string{
+		"0":  `{"cursor":"c1","keys":["user:1","user:2"]}`,
+		"c1": `{"cursor":"c2","keys":[]}`,
+		"c2": `{"cursor":"0","keys":["user:3"]}`,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("match") != "user:*" || q.Get("type") != "string" {
+			t.Errorf("Scan: unexpected query %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(pages[q.Get("cursor")]))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+
+	var keys []string
+	it := c.Scan(context.Background(), cache.ScanOptions{Match: "user:*", Type: "string"})
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Scan: %v", err)
+	}
+	if strings.Join(keys, ",") != "user:1,user:2,user:3" {
+		t.Errorf("Scan: got %v", keys)
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Method != http.MethodDelete || q.Get("prefix") != "user:42:" || q.Get("dry_run") != "true" {
+			t.Errorf("DeleteMatching: unexpected request %s %s", r.Method, r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"count":12,"dry_run":true}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+
+	n, err := c.DeleteMatching(context.Background(), cache.DeleteOptions{Prefix: "user:42:", DryRun: true})
+	if err != nil || n != 12 {
+		t.Fatalf("DeleteMatching: got %d err=%v wanted 12", n, err)
+	}
+	if _, err := c.DeleteMatching(context.Background(), cache.DeleteOptions{}); err == nil {
+		t.Error("DeleteMatching: expected an error without prefix or match")
+	}
+}
+
+func TestTags(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Key  string   `json:"key"`
+			Tags []string `json:"tags"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.Key != "page:/home" || len(body.Tags) != 2 || body.Tags[1] != "product:2" {
+			t.Errorf("SetTagged: unexpected body %+v", body)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/tags/product:1", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("InvalidateTag: unexpected method %s", r.Method)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"tag":"product:1","count":3}`))
+	})
+	c, teardown := newTestServer(mux)
+	defer teardown()
+	ctx := context.Background()
+
+	if err := c.SetTagged(ctx, "page:/home", "<html>", "product:1", "product:2"); err != nil {
+		t.Fatalf("SetTagged: %v", err)
+	}
+	if n, err := c.InvalidateTag(ctx, "product:1"); err != nil || n != 3 {
+		t.Fatalf("InvalidateTag: got %d err=%v wanted 3", n, err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data/hello", func(w http.ResponseWriter, r *http.Request) {
+		if ns := r.Header.Get(cache.NamespaceHeader); ns != "search" {
+			t.Errorf("Get: namespace header = %q wanted search", ns)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"hello","value":"world"}`))
+	})
+	mux.HandleFunc("/namespaces/search", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"namespace":"search","count":7}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c := cache.New(srv.Listener.Addr().String(), cache.WithNamespace("search"))
+	ctx := context.Background()
+
+	if val, err := c.Get(ctx, "hello"); err != nil || val != "world" {
+		t.Fatalf("Get: got %q err=%v", val, err)
+	}
+	if n, err := c.FlushNamespace(ctx, "search"); err != nil || n != 7 {
+		t.Fatalf("FlushNamespace: got %d err=%v wanted 7", n, err)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/data/session/expire", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			TTL     int  `json:"ttl"`
+			Sliding bool `json:"sliding"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		if body.TTL != 2 || !body.Sliding {
+			t.Errorf("ExpireSliding: got ttl=%d sliding=%v wanted 2 true", body.TTL, body.Sliding)
+		}
+		w.Write([]byte(`{"key":"session","ttl":2,"sliding":true}`))
+	})
+	mux.HandleFunc("/data/session/ttl", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"key":"session","ttl":-1}`))
+	})
+	mux.HandleFunc("/data/session/persist", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"key":"session","persisted":true}`))
+	})
+	mux.HandleFunc("/data/missing/touch", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c := cache.New(srv.Listener.Addr().String())
+	ctx := context.Background()
+
+	if err := c.ExpireSliding(ctx, "session", 1500*time.Millisecond); err != nil {
+		t.Fatalf("ExpireSliding: %v", err)
+	}
+	if had, err := c.Persist(ctx, "session"); err != nil || !had {
+		t.Fatalf("Persist: got %v err=%v", had, err)
+	}
+	if ttl, err := c.TTL(ctx, "session"); err != nil || ttl != cache.NoExpiry {
+		t.Fatalf("TTL: got %v err=%v wanted NoExpiry", ttl, err)
+	}
+	if err := c.Touch(ctx, "missing"); !errors.Is(err, cache.ErrNotFound) {
+		t.Fatalf("Touch: got %v wanted ErrNotFound", err)
+	}
+}
+
 func TestDelete(t *testing.T) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/data/hello", func(w http.ResponseWriter, r *http.Request) {
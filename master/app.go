@@ -7,12 +7,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -26,16 +28,117 @@ func Start() {
 
 	m := NewMaster(role, standby)
 
+	// Read-through: READ_THROUGH_ORIGINS="default=http://origin:8000/items/{key}"
+	if raw := os.Getenv("READ_THROUGH_ORIGINS"); raw != "" {
+		origins, err := parseOrigins(raw)
+		if err != nil {
+			log.Fatalf("invalid READ_THROUGH_ORIGINS: %v", err)
+		}
+		m.SetLoader(NewHTTPLoader(origins, envSeconds("READ_THROUGH_TTL", 300)), envSeconds("READ_THROUGH_NEGATIVE_TTL", 30))
+	}
+
+	// Backing store: WRITE_MODE=through|behind, WRITE_SINK_URL=http://store:8000/changes
+	switch mode := os.Getenv("WRITE_MODE"); mode {
+	case "":
+	case WriteThrough, WriteBehind:
+		sinkURL := os.Getenv("WRITE_SINK_URL")
+		if sinkURL == "" {
+			log.Fatalf("WRITE_MODE=%s needs WRITE_SINK_URL", mode)
+		}
+		if mode == WriteThrough {
+			m.EnableWriteThrough(NewHTTPSink(sinkURL))
+			break
+		}
+		path := os.Getenv("WRITE_BEHIND_PATH")
+		if path == "" {
+			path = WriteBehindQueuePath
+		}
+		batch := 100
+		if n, err := strconv.Atoi(os.Getenv("WRITE_BEHIND_BATCH")); err == nil && n > 0 {
+			batch = n
+		}
+		if err := m.EnableWriteBehind(NewHTTPSink(sinkURL), path, batch); err != nil {
+			log.Fatalf("failed to open write-behind queue %s: %v", path, err)
+		}
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "master_write_behind_backlog",
+			Help: "Changes queued for the backing store",
+		}, func() float64 { return float64(m.WriteBehindBacklog()) }))
+	default:
+		log.Fatalf("unknown WRITE_MODE %q", mode)
+	}
+
+	// Hot keys: HOT_KEY_THRESHOLD reads per second (0 disables), copied to
+	// HOT_KEY_EXTRA_REPLICAS more nodes
+	threshold := 1000.0
+	if val := os.Getenv("HOT_KEY_THRESHOLD"); val != "" {
+		if n, err := strconv.ParseFloat(val, 64); err == nil && n >= 0 {
+			threshold = n
+		}
+	}
+	if threshold > 0 {
+		topK, extra := 32, 2
+		if n, err := strconv.Atoi(os.Getenv("HOT_KEY_TOP_K")); err == nil && n > 0 {
+			topK = n
+		}
+		if n, err := strconv.Atoi(os.Getenv("HOT_KEY_EXTRA_REPLICAS")); err == nil && n >= 0 {
+			extra = n
+		}
+		m.TrackHotKeys(threshold, topK, extra)
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "master_hot_keys",
+			Help: "Keys currently read often enough to be copied to extra nodes",
+		}, func() float64 { return float64(len(m.hot.hotKeys())) }))
+	}
+
 	r := mux.NewRouter()
 	r.Use(mux.CORSMethodMiddleware(r))
+	r.Use(validateNamespace)
+	r.Use(validateKey)
 
 	r.HandleFunc("/data/bulk", m.BulkPut).Methods("POST")
 	r.HandleFunc("/data/bulk/get", m.BulkGet).Methods("POST")
+	r.HandleFunc("/data/incr", m.Incr).Methods("POST")
 	r.HandleFunc("/data", m.Put).Methods("POST")
 	r.HandleFunc("/data/{key}", m.Get).Methods("GET")
 	r.HandleFunc("/data/{key}", m.Delete).Methods("DELETE")
+	r.HandleFunc("/data", m.DeleteMatching).Methods("DELETE")
+	r.HandleFunc("/data/{key}/expire", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/data/{key}/persist", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/data/{key}/touch", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/data/{key}/ttl", m.TypedRead).Methods("GET")
+	r.HandleFunc("/tags/{tag}", m.InvalidateTag).Methods("DELETE")
+	r.HandleFunc("/namespaces/{ns}", m.FlushNamespace).Methods("DELETE")
+	r.HandleFunc("/hash/{key}", m.TypedWrite).Methods("POST", "DELETE")
+	r.HandleFunc("/hash/{key}", m.TypedRead).Methods("GET")
+	r.HandleFunc("/hash/{key}/{field}", m.TypedRead).Methods("GET")
+	r.HandleFunc("/hash/{key}/{field}/incr", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/list/{key}", m.TypedRead).Methods("GET")
+	r.HandleFunc("/list/{key}/lpush", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/list/{key}/rpush", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/list/{key}/lpop", m.ListPop).Methods("POST")
+	r.HandleFunc("/list/{key}/rpop", m.ListPop).Methods("POST")
+	r.HandleFunc("/list/{key}/trim", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/set/{key}", m.TypedRead).Methods("GET")
+	r.HandleFunc("/set/{key}/card", m.TypedRead).Methods("GET")
+	r.HandleFunc("/set/{key}/members/{member}", m.TypedRead).Methods("GET")
+	r.HandleFunc("/set/{key}/add", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/set/{key}/remove", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/zset/{key}", m.TypedRead).Methods("GET")
+	r.HandleFunc("/zset/{key}/byscore", m.TypedRead).Methods("GET")
+	r.HandleFunc("/zset/{key}/rank/{member}", m.TypedRead).Methods("GET")
+	r.HandleFunc("/zset/{key}/add", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/zset/{key}/incr", m.TypedWrite).Methods("POST")
+	r.HandleFunc("/scan", m.Scan).Methods("GET")
+	r.HandleFunc("/hotkeys", m.HotKeysHandler).Methods("GET")
+	r.HandleFunc("/latency", m.LatencyHandler).Methods("GET")
 	r.HandleFunc("/rebalance-dead-aux", m.RebalanceDeadAuxServer).Methods("POST")
 	r.HandleFunc("/nodes", m.AddNodeHandler).Methods("POST")
+	r.HandleFunc("/nodes/{addr}/ranges", m.NodeRangesHandler).Methods("GET")
+	r.HandleFunc("/rebalance/jobs", m.RebalanceJobsHandler).Methods("GET")
+	r.HandleFunc("/rebalance/jobs/{id}", m.RebalanceJobHandler).Methods("GET")
+	r.HandleFunc("/rebalance/jobs/{id}/{action:pause|resume|cancel}", m.RebalanceJobActionHandler).Methods("POST")
+	r.HandleFunc("/rebalance/rate", m.RebalanceRateHandler).Methods("GET", "PUT")
 	r.HandleFunc("/health", m.HealthHandler).Methods("GET")
 	r.HandleFunc("/role", m.RoleHandler).Methods("GET")
 	r.HandleFunc("/state", m.StateHandler).Methods("GET")
@@ -119,6 +222,7 @@ func Start() {
 			if err := srv.Shutdown(ctx); err != nil {
 				log.Printf("error: %s\n", err)
 			}
+			m.DrainWriteBehind(envSeconds("WRITE_BEHIND_DRAIN_TIMEOUT", 30))
 			return
 
 		case <-promoteChan:
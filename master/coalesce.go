@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// readResult is the outcome of reading one key from its replicas, shared by
+// every request that was coalesced onto the read.
+type readResult struct {
+	status  int
+	body    []byte
+	etag    string
+	value   string // bulk reads only carry the value
+	found   bool
+	refresh bool // aux reported the value due a refresh
+
+	recompute time.Duration // how long the value takes to rebuild, if due a refresh
+}
+
+// flight is a read in progress. done is closed once res is set.
+type flight struct {
+	done chan struct{}
+	res  readResult
+}
+
+// flightGroup coalesces concurrent reads of the same key: the first request
+// for a key reads it from aux, and requests arriving while that read is in
+// flight wait for its result instead of issuing their own. A request that
+// joins a read begun before a write was acknowledged gets the value the
+// write replaced, so reads can lag writes by one aux round-trip.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// join returns the read in flight for key, or registers a new one. The
+// caller that gets leader == true must complete it with finish.
+func (g *flightGroup) join(key string) (f *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	f = &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// finish publishes res to every request waiting on f.
+func (g *flightGroup) finish(key string, f *flight, res readResult) {
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	f.res = res
+	close(f.done)
+}
+
+// do runs read once for all concurrent callers with the same key. shared
+// reports whether the result came from another caller's read.
+func (g *flightGroup) do(key string, read func() readResult) (res readResult, shared bool) {
+	f, leader := g.join(key)
+	if !leader {
+		<-f.done
+		return f.res, true
+	}
+	defer func() { g.finish(key, f, res) }()
+	return read(), false
+}
+
+// withoutRefresh clears the refresh flag in a Get body, for requests that
+// do not hold the value's refresh lease.
+func withoutRefresh(body []byte) []byte {
+	var kv KeyVal
+	if json.Unmarshal(body, &kv) != nil {
+		return body
+	}
+	kv.Refresh = false
+	out, err := json.Marshal(kv)
+	if err != nil {
+		return body
+	}
+	return out
+}
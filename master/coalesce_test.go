@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGet_CoalescesConcurrentReads(t *testing.T) {
+	var upstream atomic.Int32
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.Add(1)
+		w.Write([]byte(`{"key":"k","value":"v"}`))
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+
+	// Hold a read of k in flight so every Get below joins it.
+	f, leader := m.getFlights.join(routingKey(DefaultNamespace, "k"))
+	require.True(t, leader)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 5)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"}))
+			codes[i] = w.Code
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	m.getFlights.finish(routingKey(DefaultNamespace, "k"), f, readResult{status: http.StatusOK, body: []byte(`{"key":"k","value":"v"}`), found: true})
+	wg.Wait()
+
+	for _, code := range codes {
+		assert.Equal(t, http.StatusOK, code)
+	}
+	assert.Equal(t, int32(0), upstream.Load(), "coalesced Gets reached aux")
+
+	// With nothing in flight, a Get reads from aux again.
+	w := httptest.NewRecorder()
+	m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"}))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(1), upstream.Load())
+}
+
+func TestGet_OnlyLeaseHolderIsAskedToRefresh(t *testing.T) {
+	// Like aux, report every read of the value as due a refresh.
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"key":"k","value":"v","ttl":60,"refresh":true,"recompute_ms":10}`))
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	get := func() KeyVal {
+		var kv KeyVal
+		w := httptest.NewRecorder()
+		m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"}))
+		json.Unmarshal(w.Body.Bytes(), &kv)
+		return kv
+	}
+
+	var wg sync.WaitGroup
+	bodies := make([]KeyVal, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = get()
+		}(i)
+	}
+	wg.Wait()
+
+	refresh := 0
+	for _, kv := range bodies {
+		assert.Equal(t, "v", kv.Value)
+		if kv.Refresh {
+			refresh++
+		}
+	}
+	assert.Equal(t, 1, refresh, "callers asked to refresh")
+	assert.False(t, get().Refresh, "a later read was asked to refresh during the lease")
+
+	// Writing the key ends the lease.
+	w := httptest.NewRecorder()
+	m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v2","ttl":60}`)))
+	assert.True(t, get().Refresh, "the lease outlived a write of the key")
+}
+
+func TestBulkGet_WaitsForKeysInFlight(t *testing.T) {
+	var requested []string
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var keys []string
+		json.NewDecoder(r.Body).Decode(&keys)
+		requested = append(requested, keys...)
+		json.NewEncoder(w).Encode(map[string]string{"a": "1"})
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+
+	f, leader := m.bulkFlights.join(routingKey(DefaultNamespace, "b"))
+	require.True(t, leader)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		m.BulkGet(w, httptest.NewRequest(http.MethodPost, "/data/bulk/get", strings.NewReader(`["a","b"]`)))
+		done <- w
+	}()
+	time.Sleep(50 * time.Millisecond)
+	m.bulkFlights.finish(routingKey(DefaultNamespace, "b"), f, readResult{value: "2", found: true})
+
+	w := <-done
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"a":"1","b":"2"}`, w.Body.String())
+	assert.Equal(t, []string{"a"}, requested, "key in flight read again")
+}
@@ -9,6 +9,7 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"sync"
@@ -20,12 +21,17 @@ import (
 )
 
 const (
-	BackupFilePath = "/data/backupCache.dat"
+	BackupFilePath       = "/data/backupCache.dat"
+	WriteBehindQueuePath = "/data/write-behind.log"
 )
 
 var (
 	masterRequests     *prometheus.CounterVec
 	masterResponseTime *prometheus.HistogramVec
+	masterCoalesced    *prometheus.CounterVec
+	masterLoads        *prometheus.CounterVec
+	masterSinkOps      *prometheus.CounterVec
+	masterHedged       *prometheus.CounterVec
 	metricsOnce        sync.Once
 )
 
@@ -35,7 +41,7 @@ func initMetrics() {
 			prometheus.CounterOpts{
 				Name: "master_request_total",
 				Help: "Total number of requests to the master node",
-			}, []string{"method"},
+			}, []string{"method", "namespace"},
 		)
 		masterResponseTime = prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
@@ -43,9 +49,33 @@ func initMetrics() {
 				Help:    "Distribution of the response time processed by the master server",
 				Buckets: prometheus.ExponentialBuckets(0.001, 2, 16),
 			},
-			[]string{"method"},
+			[]string{"method", "namespace"},
 		)
-		prometheus.MustRegister(masterRequests, masterResponseTime)
+		masterCoalesced = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "master_coalesced_reads_total",
+				Help: "Key reads served from another request's read already in flight",
+			}, []string{"op"},
+		)
+		masterLoads = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "master_read_through_total",
+				Help: "Read-through loads from the origin, by outcome",
+			}, []string{"namespace", "result"},
+		)
+		masterSinkOps = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "master_write_sink_ops_total",
+				Help: "Changes forwarded to the backing store, by write mode and outcome",
+			}, []string{"mode", "result"},
+		)
+		masterHedged = prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "master_hedged_reads_total",
+				Help: "Reads sent to a second replica because the first was slower than its p95, and how many of those answered first",
+			}, []string{"result"},
+		)
+		prometheus.MustRegister(masterRequests, masterResponseTime, masterCoalesced, masterLoads, masterSinkOps, masterHedged)
 	})
 }
 
@@ -70,6 +100,54 @@ type Master struct {
 
 	// replicaSem limits total concurrent outgoing writes to aux nodes.
 	replicaSem chan struct{}
+
+	// lastVersion is the most recent version stamp handed out by nextVersion.
+	lastVersion atomic.Uint64
+
+	// jobs tracks rebalances caused by membership changes.
+	jobs *jobManager
+
+	// migrating holds the ranges being copied to new owners, whose reads
+	// fall back to the previous owners on a miss.
+	migrating *migrationTable
+
+	// dualWrite also applies writes of migrating keys to their previous
+	// owners, so a cancelled or failed migration leaves them current.
+	dualWrite bool
+
+	// copyMu serialises copying entries to replicas, striped by key, see
+	// copyEntry.
+	copyMu [64]sync.Mutex
+
+	// getFlights and bulkFlights coalesce concurrent reads of the same key.
+	getFlights  *flightGroup
+	bulkFlights *flightGroup
+	coalesced   *prometheus.CounterVec
+
+	// leases picks the one caller asked to refresh a value due a refresh.
+	leases *refreshLeases
+
+	// loader fetches missing keys in read-through mode; nil disables it.
+	loader   Loader
+	negative *negativeCache
+	loads    *prometheus.CounterVec
+
+	// sink is the backing store of write-through and write-behind mode.
+	sink       Sink
+	writeMode  string // "", WriteThrough or WriteBehind
+	writeQueue *writeQueue
+	sinkOps    *prometheus.CounterVec
+
+	// hot finds the most read keys; nil disables it. Hot keys are copied to
+	// hotExtra more nodes, which serve reads alongside the replicas.
+	hot      *hotKeyTracker
+	hotExtra int
+
+	// latency times reads per aux node. With hedge set, a read the first
+	// replica has not answered within its p95 is also sent to another.
+	latency *latencyTracker
+	hedge   bool
+	hedged  *prometheus.CounterVec
 }
 
 func NewMaster(role, standby string) *Master {
@@ -88,6 +166,17 @@ func NewMaster(role, standby string) *Master {
 		}
 	}
 
+	// Keys per second all rebalances together may move; 0 is unlimited.
+	rate := 0
+	if val := os.Getenv("REBALANCE_RATE"); val != "" {
+		if n, err := strconv.Atoi(val); err == nil && n >= 0 {
+			rate = n
+		}
+	}
+
+	dualWrite := os.Getenv("MIGRATION_DUAL_WRITE") == "true"
+	hedge := os.Getenv("HEDGED_READS") != "false"
+
 	m := &Master{
 		client:            client,
 		hashring:          NewHashRing(150),
@@ -100,15 +189,73 @@ func NewMaster(role, standby string) *Master {
 		standby:           standby,
 		replicationFactor: rf,
 		replicaSem:        make(chan struct{}, 64),
+		jobs:              newJobManager(rate),
+		migrating:         newMigrationTable(),
+		getFlights:        newFlightGroup(),
+		bulkFlights:       newFlightGroup(),
+		leases:            newRefreshLeases(),
+		coalesced:         masterCoalesced,
+		loads:             masterLoads,
+		sinkOps:           masterSinkOps,
+		dualWrite:         dualWrite,
+		latency:           newLatencyTracker(),
+		hedge:             hedge,
+		hedged:            masterHedged,
 	}
 	m.isPrimary.Store(role == "primary")
 	return m
 }
 
 type KeyVal struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
-	TTL   int    `json:"ttl,omitempty"` // seconds; 0 means no expiry
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	TTL     int    `json:"ttl,omitempty"`     // seconds; 0 means no expiry
+	Version uint64 `json:"version,omitempty"` // assigned by the master on write
+
+	// Optional write conditions, evaluated by each replica under its shard lock.
+	Cond      string `json:"cond,omitempty"`       // "nx" (only if absent) or "xx" (only if present)
+	IfVersion uint64 `json:"if_version,omitempty"` // compare-and-swap against this version
+
+	// Tags group unrelated keys so they can be invalidated together.
+	Tags []string `json:"tags,omitempty"`
+
+	// Sliding makes TTL a window that every read restarts.
+	Sliding bool `json:"sliding,omitempty"`
+
+	// Stampede protection. Grace keeps serving the value for that many
+	// seconds past its TTL while a caller refreshes it; Recompute, the time
+	// in milliseconds it takes to rebuild the value, lets a refresh be
+	// suggested shortly before the TTL runs out.
+	Grace     int `json:"grace,omitempty"`
+	Recompute int `json:"recompute_ms,omitempty"`
+
+	// Set by aux on reads: the value is past its TTL, and this caller is
+	// the one asked to refresh it.
+	Stale   bool `json:"stale,omitempty"`
+	Refresh bool `json:"refresh,omitempty"`
+}
+
+// nextVersion returns a strictly increasing version stamp for a write. It is
+// derived from the wall clock so a promoted standby keeps issuing newer versions.
+func (m *Master) nextVersion() uint64 {
+	for {
+		last := m.lastVersion.Load()
+		v := uint64(time.Now().UnixNano())
+		if v <= last {
+			v = last + 1
+		}
+		if m.lastVersion.CompareAndSwap(last, v) {
+			return v
+		}
+	}
+}
+
+// Increment is the body of an INCR/DECR request.
+type Increment struct {
+	Key     string `json:"key"`
+	Delta   int64  `json:"delta"`
+	TTL     int    `json:"ttl,omitempty"`     // applied only when the counter is created
+	Version uint64 `json:"version,omitempty"` // assigned by the master on write
 }
 
 type RingUpdate struct {
@@ -120,57 +267,144 @@ func (m *Master) Put(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
 	var kv KeyVal
-	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&kv); err != nil || !validEntry(kv) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	if kv.Cond != "" && kv.Cond != "nx" && kv.Cond != "xx" {
+		http.Error(w, fmt.Sprintf("unknown write condition %q", kv.Cond), http.StatusBadRequest)
+		return
+	}
+	kv.Version = m.nextVersion()
 
-	nodes, err := m.hashring.GetNodes(kv.Key, m.replicationFactor)
+	ns := namespaceOf(r)
+	m.forgetMissing(ns, kv.Key)
+	// Copies of a hot key are remade once the write lands.
+	defer m.invalidateHotKey(ns, kv.Key)()
+	nodes, err := m.hashring.GetNodes(routingKey(ns, kv.Key), m.replicationFactor)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
+	// Only the cache can evaluate a write condition, so a conditional write
+	// reaches a write-through store after the cache accepted it.
+	conditional := kv.Cond != "" || kv.IfVersion != 0
+	if !conditional {
+		if err := m.writeThrough(putOp(ns, kv)); err != nil {
+			http.Error(w, fmt.Sprintf("backing store rejected the write: %v", err), http.StatusBadGateway)
+			return
+		}
+	}
+
 	postBody, err := json.Marshal(kv)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	// Write to all replicas in parallel; succeed if at least one write lands.
-	errs := make(chan error, len(nodes))
+	if conditional {
+		// The primary replica alone decides whether the condition holds, so
+		// two writers racing on the same key cannot both win on different
+		// replicas. The write it accepts is copied to the others as is.
+		path := "/data"
+		if m.writeMode == WriteThrough {
+			path += "?previous=true" // lets the write be undone below
+		}
+		res := m.send(ns, nodes[0], http.MethodPost, path, postBody)
+		switch {
+		case res.err != nil:
+			log.Printf("Put: primary replica %s unavailable: %v", nodes[0], res.err)
+			http.Error(w, "primary replica unavailable", http.StatusServiceUnavailable)
+			return
+		case res.status == http.StatusConflict:
+			http.Error(w, fmt.Sprintf("write condition not met for key %s", kv.Key), http.StatusConflict)
+			return
+		case !res.ok():
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if err := m.writeThrough(putOp(ns, kv)); err != nil {
+			// Put the primary back to what it held before, unless another
+			// write has replaced this one since. The other replicas were
+			// not written yet.
+			revert := m.send(ns, nodes[0], http.MethodPost, "/data/"+url.PathEscape(kv.Key)+"/revert", res.body)
+			if !revert.ok() {
+				log.Printf("Put: failed to revert key %s on %s: %v %s", kv.Key, nodes[0], revert.err, revert.body)
+			}
+			http.Error(w, fmt.Sprintf("backing store rejected the write: %v", err), http.StatusBadGateway)
+			return
+		}
+		accepted := kv
+		accepted.Cond, accepted.IfVersion = "", 0
+		if postBody, err = json.Marshal(accepted); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		m.putReplicas(ns, nodes[1:], postBody)
+	} else if m.putReplicas(ns, nodes, postBody) == 0 {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	m.writeBehind(putOp(ns, kv))
+	if m.dualWrite {
+		mirrored := kv
+		mirrored.Cond, mirrored.IfVersion = "", 0
+		if body, err := json.Marshal(mirrored); err == nil {
+			m.mirrorWrite(ns, kv.Key, nodes, http.MethodPost, "/data", body)
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	elapsedTime := time.Since(startTime).Seconds()
+	m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+}
+
+// putReplicas writes an unconditional KeyVal body to nodes in parallel and
+// returns how many accepted it.
+func (m *Master) putReplicas(ns string, nodes []string, body []byte) int {
+	results := make(chan bool, len(nodes))
 	for _, node := range nodes {
 		go func(node string) {
 			m.replicaSem <- struct{}{}
-			defer func() { <-m.replicaSem }()
-			resp, err := m.client.Post(fmt.Sprintf("http://%s/data", node), "application/json", bytes.NewBuffer(postBody))
-			if err != nil {
-				errs <- err
-				return
+			res := m.send(ns, node, http.MethodPost, "/data", body)
+			<-m.replicaSem
+			if res.err != nil {
+				log.Printf("Put: replica write to %s failed: %v", node, res.err)
+			} else if !res.ok() {
+				log.Printf("Put: replica %s rejected the write: status %d", node, res.status)
 			}
-			resp.Body.Close()
-			errs <- nil
+			results <- res.ok()
 		}(node)
 	}
-
 	succeeded := 0
 	for range nodes {
-		if err := <-errs; err != nil {
-			log.Printf("Put: replica write to failed: %v", err)
-		} else {
+		if <-results {
 			succeeded++
 		}
 	}
+	return succeeded
+}
 
-	if succeeded == 0 {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+// Incr applies an increment on the counter's primary replica, copies the
+// resulting value and version to the other replicas, and returns the new
+// value.
+func (m *Master) Incr(w http.ResponseWriter, r *http.Request) {
+	var inc Increment
+	if err := json.NewDecoder(r.Body).Decode(&inc); err != nil || inc.Key == "" || !validKey(inc.Key) {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	inc.Version = m.nextVersion()
 
-	w.WriteHeader(http.StatusOK)
-	elapsedTime := time.Since(startTime).Seconds()
-	m.requests.WithLabelValues(r.Method).Inc()
-	m.responseTime.WithLabelValues(r.Method).Observe(elapsedTime)
+	body, err := json.Marshal(inc)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	m.forwardWrite(w, r, inc.Key, "/incr", body)
 }
 
 func (m *Master) Get(w http.ResponseWriter, r *http.Request) {
@@ -183,38 +417,79 @@ func (m *Master) Get(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodes, err := m.hashring.GetNodes(key, m.replicationFactor)
-	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
+	// Concurrent Gets of the same key share one read from aux.
+	ns := namespaceOf(r)
+	m.recordRead(ns, key)
+	// In read-through mode a miss is loaded from the origin within the same
+	// read, so a burst of misses reaches the origin once.
+	res, shared := m.getFlights.do(routingKey(ns, key), func() readResult {
+		return m.readOrLoad(ns, key)
+	})
+	if shared {
+		m.coalesced.WithLabelValues("get").Inc()
+	}
+	// Only the request that led the read, and only if no other caller holds
+	// the key's lease, is asked to refresh.
+	if res.refresh && (shared || !m.leases.grant(routingKey(ns, key), time.Now(), res.recompute)) {
+		res.body = withoutRefresh(res.body)
 	}
 
-	// Shuffle replicas so reads are spread across all replicas, not always hitting node[0].
-	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
-	for _, node := range nodes {
-		resp, err := m.client.Get(fmt.Sprintf("http://%s/data/%s", node, key))
-		if err != nil {
-			log.Printf("Get: replica %s unavailable: %v", node, err)
-			continue
-		}
-		if resp.StatusCode != http.StatusOK {
-			resp.Body.Close()
-			continue
-		}
+	switch res.status {
+	case http.StatusOK:
 		w.Header().Set("Content-Type", "application/json")
+		if res.etag != "" {
+			w.Header().Set("ETag", res.etag)
+		}
 		w.WriteHeader(http.StatusOK)
-		io.Copy(w, resp.Body)
-		resp.Body.Close()
-		elapsedTime := time.Since(startTime).Seconds()
-		m.requests.WithLabelValues(r.Method).Inc()
-		m.responseTime.WithLabelValues(r.Method).Observe(elapsedTime)
+		w.Write(res.body)
+	case http.StatusUnprocessableEntity:
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+	case http.StatusInternalServerError:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
+	case http.StatusBadGateway:
+		http.Error(w, fmt.Sprintf("loading key %s from the origin failed", key), http.StatusBadGateway)
+	default:
+		http.Error(w, fmt.Sprintf("key %s not found", key), http.StatusNotFound)
 	}
 
 	elapsedTime := time.Since(startTime).Seconds()
-	m.requests.WithLabelValues(r.Method).Inc()
-	m.responseTime.WithLabelValues(r.Method).Observe(elapsedTime)
-	http.Error(w, fmt.Sprintf("key %s not found", key), http.StatusNotFound)
+	m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+}
+
+// readKey reads key from the first replica that has it, hedging a replica
+// slower than usual. Its status is 200, 404, 422 if the key holds another
+// data type, or 500 if the ring is empty.
+func (m *Master) readKey(ns, key string) readResult {
+	nodes, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
+	if err != nil {
+		return readResult{status: http.StatusInternalServerError}
+	}
+
+	// Shuffle replicas so reads are spread across all replicas, not always hitting node[0].
+	// A hot key's copies share its reads. While the key's range migrates,
+	// its previous owners are tried last.
+	candidates := append(append([]string(nil), nodes...), m.hotCopies(ns, key, nodes)...)
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	res, ok := m.hedgedRead(ns, candidates, m.readFallback(ns, key, nodes), "/data/"+url.PathEscape(key), func(res replicaResponse) bool {
+		return res.err == nil && (res.status == http.StatusOK || res.status == http.StatusUnprocessableEntity)
+	})
+	if !ok {
+		return readResult{status: http.StatusNotFound}
+	}
+	if res.status == http.StatusUnprocessableEntity {
+		// The key holds another data type; every replica would say the same.
+		return readResult{status: res.status, body: res.body}
+	}
+
+	// The read restarted a sliding expiry on this replica only.
+	var kv KeyVal
+	if json.Unmarshal(res.body, &kv) == nil && kv.Sliding {
+		go m.touchReplicas(ns, key, nodes, res.node)
+	}
+	return readResult{status: http.StatusOK, body: res.body, etag: res.header.Get("ETag"), value: kv.Value, found: true, refresh: kv.Refresh, recompute: time.Duration(kv.Recompute) * time.Millisecond}
 }
 
 func (m *Master) Delete(w http.ResponseWriter, r *http.Request) {
@@ -225,20 +500,26 @@ func (m *Master) Delete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	nodes, err := m.hashring.GetNodes(key, m.replicationFactor)
+	ns := namespaceOf(r)
+	nodes, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
 	if err != nil {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	// Delete from all replicas; 200 if at least one had the key.
+	defer m.invalidateHotKey(ns, key)()
+	op := deleteOp(ns, key, m.nextVersion())
+	if err := m.writeThrough(op); err != nil {
+		http.Error(w, fmt.Sprintf("backing store rejected the delete: %v", err), http.StatusBadGateway)
+		return
+	}
+
+	// Delete from all replicas; 200 if at least one had the key. While the
+	// key's range migrates, its previous owners lose it too, or a read
+	// falling back to them would bring it back.
 	deleted := false
-	for _, node := range nodes {
-		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s/data/%s", node, key), nil)
-		if err != nil {
-			continue
-		}
-		resp, err := m.client.Do(req)
+	for _, node := range append(nodes, m.readFallback(ns, key, nodes)...) {
+		resp, err := m.auxRequest(ns, http.MethodDelete, fmt.Sprintf("http://%s/data/%s", node, url.PathEscape(key)), nil)
 		if err != nil {
 			continue
 		}
@@ -248,6 +529,8 @@ func (m *Master) Delete(w http.ResponseWriter, r *http.Request) {
 		resp.Body.Close()
 	}
 
+	// The store may hold the key even if the cache did not.
+	m.writeBehind(op)
 	if !deleted {
 		http.Error(w, fmt.Sprintf("key %s not found", key), http.StatusNotFound)
 		return
@@ -255,17 +538,43 @@ func (m *Master) Delete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// BulkPut writes a batch of entries, one request per aux node holding any of
+// them. Like Put it succeeds once every entry landed on at least one
+// replica. Otherwise the first refusal from an aux node (400 for an invalid
+// entry) is relayed, or 500 if none answered. Entries any replica applied
+// are queued for the backing store in write-behind mode either way.
 func (m *Master) BulkPut(w http.ResponseWriter, r *http.Request) {
 	var entries []KeyVal
 	if err := json.NewDecoder(r.Body).Decode(&entries); err != nil {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	for _, kv := range entries {
+		if !validEntry(kv) {
+			http.Error(w, fmt.Sprintf("invalid key %q", kv.Key), http.StatusBadRequest)
+			return
+		}
+	}
 
 	// Group entries by target nodes; each entry goes to all its replicas.
+	ns := namespaceOf(r)
+	after := make([]func(), 0, len(entries))
+	for _, kv := range entries {
+		after = append(after, m.invalidateHotKey(ns, kv.Key))
+	}
+	defer func() {
+		for _, f := range after {
+			f()
+		}
+	}()
 	groups := make(map[string][]KeyVal)
+	mirrored := make(map[string][]KeyVal) // previous owners of migrating keys
+	ops := make([]SinkOp, 0, len(entries))
 	for _, kv := range entries {
-		nodes, err := m.hashring.GetNodes(kv.Key, m.replicationFactor)
+		kv.Version = m.nextVersion()
+		ops = append(ops, putOp(ns, kv))
+		m.forgetMissing(ns, kv.Key)
+		nodes, err := m.hashring.GetNodes(routingKey(ns, kv.Key), m.replicationFactor)
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
@@ -273,34 +582,76 @@ func (m *Master) BulkPut(w http.ResponseWriter, r *http.Request) {
 		for _, node := range nodes {
 			groups[node] = append(groups[node], kv)
 		}
+		if m.dualWrite {
+			for _, node := range m.readFallback(ns, kv.Key, nodes) {
+				mirrored[node] = append(mirrored[node], kv)
+			}
+		}
+	}
+	if err := m.writeThrough(ops...); err != nil {
+		http.Error(w, fmt.Sprintf("backing store rejected the writes: %v", err), http.StatusBadGateway)
+		return
 	}
 
 	// Fan out to each node in parallel.
-	errs := make(chan error, len(groups))
+	results := make(chan replicaResponse, len(groups))
 	for node, batch := range groups {
 		go func(node string, batch []KeyVal) {
 			m.replicaSem <- struct{}{}
 			defer func() { <-m.replicaSem }()
 			body, err := json.Marshal(batch)
 			if err != nil {
-				errs <- err
+				results <- replicaResponse{node: node, err: err}
 				return
 			}
-			resp, err := m.client.Post(fmt.Sprintf("http://%s/bulk", node), "application/json", bytes.NewBuffer(body))
-			if err != nil {
-				errs <- err
-				return
-			}
-			resp.Body.Close()
-			errs <- nil
+			results <- m.send(ns, node, http.MethodPost, "/bulk", body)
 		}(node, batch)
 	}
 
+	applied := make(map[string]bool, len(entries))
+	var rejected replicaResponse // the first refusal, relayed if a key landed nowhere
 	for range groups {
-		if err := <-errs; err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		res := <-results
+		if !res.ok() {
+			log.Printf("BulkPut: replica write to %s failed: status=%d err=%v", res.node, res.status, res.err)
+			if res.err == nil && rejected.status == 0 {
+				rejected = res
+			}
+			continue
+		}
+		for _, kv := range groups[res.node] {
+			applied[kv.Key] = true
+		}
+	}
+	// A write any replica applied reaches the store, even if others failed.
+	queued := make([]SinkOp, 0, len(ops))
+	for _, op := range ops {
+		if applied[op.Key] {
+			queued = append(queued, op)
+		}
+	}
+	m.writeBehind(queued...)
+	for _, kv := range entries {
+		if applied[kv.Key] {
+			continue
+		}
+		if rejected.status != 0 {
+			w.Header().Set("Content-Type", rejected.header.Get("Content-Type"))
+			w.WriteHeader(rejected.status)
+			w.Write(rejected.body)
 			return
 		}
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	for node, batch := range mirrored {
+		body, err := json.Marshal(batch)
+		if err != nil {
+			continue
+		}
+		if res := m.send(ns, node, http.MethodPost, "/bulk", body); !res.ok() {
+			log.Printf("migration: mirroring %d writes to previous owner %s failed: status=%d err=%v", len(batch), node, res.status, res.err)
+		}
 	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -311,14 +662,63 @@ func (m *Master) BulkGet(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	for _, key := range keys {
+		if !validKey(key) {
+			http.Error(w, fmt.Sprintf("invalid key %q", key), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Keys another bulk get is already reading are waited for rather than
+	// read again; this request reads the rest.
+	ns := namespaceOf(r)
+	led := make(map[string]*flight)
+	waiting := make(map[string]*flight)
+	var toRead []string
+	for _, key := range keys {
+		if led[key] != nil || waiting[key] != nil {
+			continue
+		}
+		if f, leader := m.bulkFlights.join(routingKey(ns, key)); leader {
+			led[key] = f
+			toRead = append(toRead, key)
+		} else {
+			waiting[key] = f
+		}
+	}
+
+	merged, err := m.bulkRead(ns, toRead)
+	for key, f := range led {
+		value, found := merged[key]
+		m.bulkFlights.finish(routingKey(ns, key), f, readResult{value: value, found: found})
+	}
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
+	if len(waiting) > 0 {
+		m.coalesced.WithLabelValues("bulk_get").Add(float64(len(waiting)))
+	}
+	for key, f := range waiting {
+		<-f.done
+		if f.res.found {
+			merged[key] = f.res.value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(merged)
+}
+
+// bulkRead reads keys in one batch per replica and returns the values found.
+func (m *Master) bulkRead(ns string, keys []string) (map[string]string, error) {
 	// Group keys by a randomly chosen replica so hot keys spread across replicas.
 	groups := make(map[string][]string)
 	for _, key := range keys {
-		nodes, err := m.hashring.GetNodes(key, m.replicationFactor)
+		nodes, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+			return nil, err
 		}
 		chosen := nodes[rand.Intn(len(nodes))]
 		groups[chosen] = append(groups[chosen], key)
@@ -337,7 +737,7 @@ func (m *Master) BulkGet(w http.ResponseWriter, r *http.Request) {
 				resultCh <- nodeResult{err: err}
 				return
 			}
-			resp, err := m.client.Post(fmt.Sprintf("http://%s/bulk/get", node), "application/json", bytes.NewBuffer(body))
+			resp, err := m.auxRequest(ns, http.MethodPost, fmt.Sprintf("http://%s/bulk/get", node), bytes.NewBuffer(body))
 			if err != nil {
 				resultCh <- nodeResult{err: err}
 				return
@@ -362,89 +762,34 @@ func (m *Master) BulkGet(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// Second pass: for keys not found on their primary, try secondary replicas.
-	if m.replicationFactor > 1 {
-		for _, key := range keys {
-			if _, found := merged[key]; found {
-				continue
-			}
-			nodes, err := m.hashring.GetNodes(key, m.replicationFactor)
+	// Second pass: for keys not found on their primary, try secondary
+	// replicas, then the previous owners of a migrating range.
+	for _, key := range keys {
+		if _, found := merged[key]; found {
+			continue
+		}
+		nodes, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
+		if err != nil {
+			continue
+		}
+		for _, node := range append(nodes[1:], m.readFallback(ns, key, nodes)...) {
+			resp, err := m.auxRequest(ns, http.MethodGet, fmt.Sprintf("http://%s/data/%s", node, url.PathEscape(key)), nil)
 			if err != nil {
 				continue
 			}
-			for _, node := range nodes[1:] {
-				resp, err := m.client.Get(fmt.Sprintf("http://%s/data/%s", node, key))
-				if err != nil {
-					continue
-				}
-				if resp.StatusCode == http.StatusOK {
-					var kv KeyVal
-					if err := json.NewDecoder(resp.Body).Decode(&kv); err == nil {
-						merged[key] = kv.Value
-					}
-					resp.Body.Close()
-					break
+			if resp.StatusCode == http.StatusOK {
+				var kv KeyVal
+				if err := json.NewDecoder(resp.Body).Decode(&kv); err == nil {
+					merged[key] = kv.Value
 				}
 				resp.Body.Close()
+				break
 			}
+			resp.Body.Close()
 		}
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(merged)
-}
-
-func (m *Master) rebalance(keyvals map[string]string) {
-	if len(keyvals) == 0 {
-		return
-	}
-
-	startTime := time.Now()
-
-	numOfWorkers := 16
-	if len(keyvals) < numOfWorkers {
-		numOfWorkers = len(keyvals)
-	}
-
-	log.Printf("rebalancing %d keys with %d workers", len(keyvals), numOfWorkers)
-
-	keyvalChan := make(chan KeyVal)
-	var wg sync.WaitGroup
-
-	for i := 0; i < numOfWorkers; i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for keyval := range keyvalChan {
-				nodes, err := m.hashring.GetNodes(keyval.Key, m.replicationFactor)
-				if err != nil {
-					log.Printf("failed to remap key %s: %v", keyval.Key, err)
-					continue
-				}
-				postBody, err := json.Marshal(keyval)
-				if err != nil {
-					log.Printf("failed to marshal key-value pair: %v", err)
-					continue
-				}
-				for _, node := range nodes {
-					resp, err := m.client.Post(fmt.Sprintf("http://%s/data", node), "application/json", bytes.NewBuffer(postBody))
-					if err != nil {
-						log.Printf("failed to send key %s to aux server %s: %v", keyval.Key, node, err)
-						continue
-					}
-					resp.Body.Close()
-				}
-			}
-		}()
-	}
-
-	for k, v := range keyvals {
-		keyvalChan <- KeyVal{Key: k, Value: v}
-	}
-	close(keyvalChan)
-	wg.Wait()
-
-	log.Printf("rebalanced %d keys in %.3fs", len(keyvals), time.Since(startTime).Seconds())
+	m.loadMissing(ns, keys, merged)
+	return merged, nil
 }
 
 func (m *Master) backupCacheToDisk(keyvals map[string]string) error {
@@ -475,12 +820,17 @@ func (m *Master) RestoreCacheFromDisk() error {
 		return fmt.Errorf("failed to decode mappings from file %s: %v", m.filepath, err)
 	}
 
-	m.rebalance(mappings)
+	m.rebalance(m.jobs.start("restore from backup"), mappings)
 
 	return nil
 }
 
-// Aux sends mappings to this route before dying
+// RebalanceDeadAuxServer removes an aux node that is shutting down. The
+// node posts its plain values, kept as the backup file, and keeps serving
+// until this request returns. Meanwhile its ranges are copied to their new
+// owners like any migration: from the node itself or another replica,
+// through export and import, so every data type and namespace moves with
+// its version, expiry and tags.
 func (m *Master) RebalanceDeadAuxServer(w http.ResponseWriter, r *http.Request) {
 	var auxMappings map[string]string
 
@@ -498,15 +848,25 @@ func (m *Master) RebalanceDeadAuxServer(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	log.Printf("Remapping %d keys from server %s", len(auxMappings), auxServer)
+	log.Printf("Moving the ranges of server %s", auxServer)
 	m.auxMu.Lock()
+	before := m.hashring.clone()
 	m.activeAuxServers[auxServer] = false
 	m.hashring.RemoveNode(auxServer)
+	moves := diffRings(before, m.hashring, m.replicationFactor)
+	for i := range moves {
+		// The node is going away; dropping its copy would only race its
+		// shutdown.
+		moves[i].Drops = missingFrom(moves[i].Drops, []string{auxServer})
+	}
+	job := m.jobs.start("remove " + auxServer)
+	m.migrating.add(job.id, moves)
 	m.auxMu.Unlock()
 	go m.pushRingUpdate("remove", auxServer)
-	m.rebalance(auxMappings)
+	m.migrate(job, moves)
+	m.migrating.remove(job.id)
 
-	// Persist the redistributed mappings so they survive a full restart.
+	// Persist the node's mappings so they survive a full restart.
 	go func() {
 		if err := m.backupCacheToDisk(auxMappings); err != nil {
 			log.Println(err)
@@ -679,65 +1039,16 @@ func (m *Master) handleDeadAuxServer(deadAux string) {
 	log.Printf("heart of %s has stopped beating... ", deadAux)
 }
 
-func (m *Master) getDistinctNodesToRebalance(node string) []string {
-	distinctNodes := make(map[string]bool)
-
-	for i := 0; i < m.hashring.replica; i++ {
-		replicaNode := fmt.Sprintf("%s:%d", node, i)
-		mappedNode, err := m.hashring.GetNode(replicaNode)
-
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
-		distinctNodes[mappedNode] = true
-	}
-
-	result := make([]string, 0, len(distinctNodes))
-	for k := range distinctNodes {
-		result = append(result, k)
-	}
-	return result
-
-}
-
 func (m *Master) handleAliveAuxServer(aliveAux string) {
 	m.auxMu.Lock()
 	defer m.auxMu.Unlock()
 	if val, ok := m.activeAuxServers[aliveAux]; ok && !val {
-
-		distinctNodesToRebalance := m.getDistinctNodesToRebalance(aliveAux)
-
+		before := m.hashring.clone()
 		m.hashring.AddNode(aliveAux)
 		go m.pushRingUpdate("add", aliveAux)
 
-		for _, node := range distinctNodesToRebalance {
-			go func(node string) {
-
-				resp, err := m.client.Get(fmt.Sprintf("http://%s/mappings", node))
-				if err != nil {
-					log.Printf("failed to get mappings from aux server %s: %v", node, err)
-					return
-				}
-				defer resp.Body.Close()
-
-				data, err := io.ReadAll(resp.Body)
-				if err != nil {
-					log.Printf("failed to read mappings from the response: %v", err)
-					return
-				}
-
-				var mappings map[string]string
-				if err := json.Unmarshal(data, &mappings); err != nil {
-					log.Printf("failed to parse the response body: %v", err)
-					return
-				}
-
-				m.rebalance(mappings)
-
-			}(node)
-		}
+		// Move the ranges the returning node owns again back onto it.
+		m.startMigration("return "+aliveAux, diffRings(before, m.hashring, m.replicationFactor))
 	}
 	m.activeAuxServers[aliveAux] = true
 	log.Printf("heart of %s is beating... ", aliveAux)
@@ -766,31 +1077,14 @@ func (m *Master) AddNodeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	m.auxServers = append(m.auxServers, req.Addr)
 	m.activeAuxServers[req.Addr] = true
-	// Compute ring neighbors before adding so we know whose keys will migrate.
-	neighbors := m.getDistinctNodesToRebalance(req.Addr)
+	before := m.hashring.clone()
 	m.hashring.AddNode(req.Addr)
+	// Stream the ranges the new node now owns from their previous owners.
+	m.startMigration("add "+req.Addr, diffRings(before, m.hashring, m.replicationFactor))
 	m.auxMu.Unlock()
 
 	go m.pushRingUpdate("add", req.Addr)
 
-	// Rebalance keys from ring neighbors that now belong to the new node.
-	for _, node := range neighbors {
-		go func(node string) {
-			resp, err := m.client.Get(fmt.Sprintf("http://%s/mappings", node))
-			if err != nil {
-				log.Printf("AddNode: failed to get mappings from %s: %v", node, err)
-				return
-			}
-			defer resp.Body.Close()
-			var mappings map[string]string
-			if err := json.NewDecoder(resp.Body).Decode(&mappings); err != nil {
-				log.Printf("AddNode: failed to decode mappings from %s: %v", node, err)
-				return
-			}
-			m.rebalance(mappings)
-		}(node)
-	}
-
 	// Start health monitoring for the new node if HealthCheck is running.
 	if m.healthDone != nil {
 		m.startAuxMonitor(req.Addr, 5*time.Second)
@@ -800,6 +1094,19 @@ func (m *Master) AddNodeHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// NodeRangesHandler tells a joining aux node which hash ranges it will own
+// and which nodes hold their keys today, so it can copy them before it
+// registers and come up warm.
+func (m *Master) NodeRangesHandler(w http.ResponseWriter, r *http.Request) {
+	addr := mux.Vars(r)["addr"]
+	transfers := m.hashring.JoinRanges(addr, m.replicationFactor)
+	if transfers == nil {
+		transfers = []RangeTransfer{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(transfers)
+}
+
 // startAuxMonitor spawns a single health-polling goroutine for aux.
 // Must only be called after HealthCheck has initialized the shared channels.
 func (m *Master) startAuxMonitor(aux string, duration time.Duration) {
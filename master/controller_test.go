@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPut_AllReplicasConflict(t *testing.T) {
+	conflict := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "write condition not met", http.StatusConflict)
+	}))
+	defer conflict.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(conflict.URL, "http://"))
+
+	req := httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v","cond":"nx"}`))
+	w := httptest.NewRecorder()
+
+	m.Put(w, req)
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestGet_TouchesReplicasOfSlidingKey(t *testing.T) {
+	touched := make(chan string, 2)
+	newAux := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				touched <- r.URL.Path
+				w.Write([]byte(`{"key":"session","ttl":60,"sliding":true}`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"key":"session","value":"s","ttl":60,"sliding":true}`))
+		}))
+	}
+	a, b := newAux(), newAux()
+	defer a.Close()
+	defer b.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(a.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(b.URL, "http://"))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/session", nil), map[string]string{"key": "session"})
+	w := httptest.NewRecorder()
+	m.Get(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	select {
+	case path := <-touched:
+		assert.Equal(t, "/data/session/touch", path)
+	case <-time.After(time.Second):
+		t.Fatal("the replica not read from was never touched")
+	}
+	select {
+	case path := <-touched:
+		t.Fatalf("the replica read from was touched again: %s", path)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestPut_ConditionEvaluatedOnPrimaryOnly(t *testing.T) {
+	var mu sync.Mutex
+	writes := make(map[string][]KeyVal)
+	conflict := false
+	newAux := func() *httptest.Server {
+		var srv *httptest.Server
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var kv KeyVal
+			json.NewDecoder(r.Body).Decode(&kv)
+			mu.Lock()
+			defer mu.Unlock()
+			if conflict && (kv.Cond != "" || kv.IfVersion != 0) {
+				http.Error(w, "write condition not met", http.StatusConflict)
+				return
+			}
+			node := strings.TrimPrefix(srv.URL, "http://")
+			writes[node] = append(writes[node], kv)
+		}))
+		return srv
+	}
+	a, b := newAux(), newAux()
+	defer a.Close()
+	defer b.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(a.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(b.URL, "http://"))
+	nodes, err := m.hashring.GetNodes("k", 2)
+	require.NoError(t, err)
+	put := func() int {
+		w := httptest.NewRecorder()
+		m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v2","if_version":7}`)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, put())
+	require.Len(t, writes[nodes[0]], 1)
+	assert.Equal(t, uint64(7), writes[nodes[0]][0].IfVersion, "the primary evaluates the condition")
+	require.Len(t, writes[nodes[1]], 1)
+	assert.Zero(t, writes[nodes[1]][0].IfVersion, "other replicas apply the accepted write as is")
+	assert.Equal(t, "v2", writes[nodes[1]][0].Value)
+	assert.Equal(t, writes[nodes[0]][0].Version, writes[nodes[1]][0].Version)
+
+	conflict = true
+	assert.Equal(t, http.StatusConflict, put())
+	assert.Len(t, writes[nodes[1]], 1, "a write the primary rejected reached another replica")
+}
+
+func TestGetAndDelete_EscapeKeyInPath(t *testing.T) {
+	paths := make(chan string, 2)
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.Method + " " + r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"a b?c#d","value":"v"}`))
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	vars := map[string]string{"key": "a b?c#d"}
+
+	w := httptest.NewRecorder()
+	m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/x", nil), vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "GET /data/a b?c#d", <-paths)
+
+	w = httptest.NewRecorder()
+	m.Delete(w, mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/data/x", nil), vars))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "DELETE /data/a b?c#d", <-paths)
+}
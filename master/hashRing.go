@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"sort"
+	"strings"
 	"sync"
 )
 
@@ -72,8 +73,12 @@ func (hr *HashRing) GetNodes(key string, n int) ([]string, error) {
 	if len(hr.sortedHash) == 0 {
 		return nil, fmt.Errorf("hash ring is empty")
 	}
+	return hr.nodesForHash(crc32.ChecksumIEEE([]byte(key)), n), nil
+}
 
-	hash := crc32.ChecksumIEEE([]byte(key))
+// nodesForHash returns up to n distinct nodes owning hash. Caller must hold
+// hr.mu and the ring must not be empty.
+func (hr *HashRing) nodesForHash(hash uint32, n int) []string {
 	start := sort.Search(len(hr.sortedHash), func(i int) bool {
 		return hr.sortedHash[i] >= hash
 	})
@@ -91,5 +96,114 @@ func (hr *HashRing) GetNodes(key string, n int) ([]string, error) {
 			nodes = append(nodes, node)
 		}
 	}
-	return nodes, nil
+	return nodes
+}
+
+// HashRange is an arc of the ring: the key hashes h with Start < h <= End,
+// wrapping past zero when Start >= End.
+type HashRange struct {
+	Start uint32 `json:"start"`
+	End   uint32 `json:"end"`
+}
+
+// Contains reports whether hash falls in the range.
+func (r HashRange) Contains(hash uint32) bool {
+	if r.Start < r.End {
+		return hash > r.Start && hash <= r.End
+	}
+	return hash > r.Start || hash <= r.End
+}
+
+// ownsAny reports whether node is one of the n owners of any hash in r.
+func (hr *HashRing) ownsAny(node string, r HashRange, n int) bool {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	if len(hr.sortedHash) == 0 {
+		return false
+	}
+	// Every arc of r ends at a ring point inside r, except the last, which
+	// is owned like r.End.
+	if containsNode(hr.nodesForHash(r.End, n), node) {
+		return true
+	}
+	for _, h := range hr.sortedHash {
+		if r.Contains(h) && containsNode(hr.nodesForHash(h, n), node) {
+			return true
+		}
+	}
+	return false
+}
+
+// RangeTransfer is a range a joining node will own, with the nodes that
+// hold its keys today.
+type RangeTransfer struct {
+	HashRange
+	Sources []string `json:"sources"`
+}
+
+// JoinRanges returns the ranges node will hold as one of the n replicas of
+// its keys once it joins the ring, each with the nodes that currently hold
+// them. Adjacent ranges with the same sources are merged.
+func (hr *HashRing) JoinRanges(node string, n int) []RangeTransfer {
+	future := hr.clone()
+	future.RemoveNode(node)
+	future.AddNode(node)
+
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	if len(hr.sortedHash) == 0 {
+		return nil
+	}
+
+	var transfers []RangeTransfer
+	for i, end := range future.sortedHash {
+		start := future.sortedHash[(i+len(future.sortedHash)-1)%len(future.sortedHash)]
+		if !containsNode(future.nodesForHash(end, n), node) {
+			continue
+		}
+		// Every arc of the future ring lies within one arc of the current
+		// ring, so its end names the current owners of all of it.
+		var sources []string
+		for _, owner := range hr.nodesForHash(end, n) {
+			if owner != node {
+				sources = append(sources, owner)
+			}
+		}
+		if len(sources) == 0 {
+			continue
+		}
+		if last := len(transfers) - 1; last >= 0 && transfers[last].End == start &&
+			strings.Join(transfers[last].Sources, ",") == strings.Join(sources, ",") {
+			transfers[last].End = end
+			continue
+		}
+		transfers = append(transfers, RangeTransfer{HashRange{Start: start, End: end}, sources})
+	}
+	return transfers
+}
+
+func containsNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// Nodes returns the distinct physical nodes on the ring in sorted order.
+func (hr *HashRing) Nodes() []string {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	nodes := make([]string, 0)
+	for _, node := range hr.hashmap {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many recent reads per aux node the percentiles are
+// computed over.
+const latencySamples = 256
+
+// hedgeMinSamples is how many reads of a node must be timed before its p95
+// is trusted; until then defaultHedgeDelay is used.
+const hedgeMinSamples = 20
+
+const (
+	defaultHedgeDelay = 50 * time.Millisecond
+	minHedgeDelay     = time.Millisecond
+)
+
+// nodeLatency holds the latest read latencies of one aux node in a ring
+// buffer, with percentiles recomputed every few samples.
+type nodeLatency struct {
+	samples       [latencySamples]time.Duration
+	n             int // samples held, at most latencySamples
+	next          int // where the next sample goes
+	fresh         int // samples since the percentiles were computed
+	p50, p95, p99 time.Duration
+}
+
+func (l *nodeLatency) add(d time.Duration) {
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % latencySamples
+	if l.n < latencySamples {
+		l.n++
+	}
+	if l.fresh++; l.fresh >= 16 || l.n <= hedgeMinSamples {
+		sorted := make([]time.Duration, l.n)
+		copy(sorted, l.samples[:l.n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		at := func(q float64) time.Duration { return sorted[int(q*float64(l.n-1))] }
+		l.p50, l.p95, l.p99 = at(0.50), at(0.95), at(0.99)
+		l.fresh = 0
+	}
+}
+
+// LatencyStat reports the read latency percentiles of one aux node.
+type LatencyStat struct {
+	Samples int     `json:"samples"`
+	P50     float64 `json:"p50_ms"`
+	P95     float64 `json:"p95_ms"`
+	P99     float64 `json:"p99_ms"`
+}
+
+// latencyTracker times the reads sent to each aux node.
+type latencyTracker struct {
+	mu    sync.Mutex
+	nodes map[string]*nodeLatency
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{nodes: make(map[string]*nodeLatency)}
+}
+
+func (t *latencyTracker) observe(node string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.nodes[node]
+	if !ok {
+		l = &nodeLatency{}
+		t.nodes[node] = l
+	}
+	l.add(d)
+}
+
+// hedgeDelay returns how long to wait for node before asking another
+// replica: its p95 read latency.
+func (t *latencyTracker) hedgeDelay(node string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.nodes[node]
+	if !ok || l.n < hedgeMinSamples {
+		return defaultHedgeDelay
+	}
+	if l.p95 < minHedgeDelay {
+		return minHedgeDelay
+	}
+	return l.p95
+}
+
+func (t *latencyTracker) stats(nodes []string) map[string]LatencyStat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	out := make(map[string]LatencyStat, len(nodes))
+	for _, node := range nodes {
+		if l, ok := t.nodes[node]; ok {
+			out[node] = LatencyStat{Samples: l.n, P50: ms(l.p50), P95: ms(l.p95), P99: ms(l.p99)}
+		}
+	}
+	return out
+}
+
+// hedgedRead sends a GET of path to nodes in order until one gives an
+// answer accept takes. If the node asked first has not answered within its
+// p95 latency, the next node is asked too and whichever accepted answer
+// comes first wins; the other request is cancelled. A read is hedged at
+// most once, so a slow cluster sees at most twice the reads. An answer
+// accept rejects moves on to the next node at once. Only once every node
+// has answered without an accepted answer are the fallback nodes (previous
+// owners of a migrating range) tried, one at a time and never hedged.
+func (m *Master) hedgedRead(ns string, nodes, fallback []string, path string, accept func(replicaResponse) bool) (replicaResponse, bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	read := func(node string) replicaResponse {
+		start := time.Now()
+		res := m.sendContext(ctx, ns, node, http.MethodGet, path, nil)
+		switch {
+		case res.err == nil:
+			m.latency.observe(node, time.Since(start))
+		case errors.Is(res.err, context.Canceled):
+			// Lost to a faster replica: it took at least this long.
+			m.latency.observe(node, time.Since(start))
+		default:
+			log.Printf("read: replica %s unavailable: %v", node, res.err)
+		}
+		return res
+	}
+
+	results := make(chan replicaResponse, len(nodes))
+	next, inflight := 0, 0
+	hedgedTo := ""
+	var timer *time.Timer // fires when the latest request is due a hedge
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	launch := func() {
+		node := nodes[next]
+		next++
+		inflight++
+		go func() { results <- read(node) }()
+		if timer != nil {
+			timer.Stop()
+			timer = nil
+		}
+		if m.hedge && hedgedTo == "" && next < len(nodes) {
+			timer = time.NewTimer(m.latency.hedgeDelay(node))
+		}
+	}
+
+	if len(nodes) > 0 {
+		launch()
+	}
+	for inflight > 0 {
+		var timeout <-chan time.Time
+		if timer != nil {
+			timeout = timer.C
+		}
+		select {
+		case res := <-results:
+			inflight--
+			if accept(res) {
+				if res.node == hedgedTo {
+					m.hedged.WithLabelValues("won").Inc()
+				}
+				return res, true
+			}
+			if inflight == 0 && next < len(nodes) {
+				launch()
+			}
+		case <-timeout:
+			timer = nil
+			hedgedTo = nodes[next]
+			m.hedged.WithLabelValues("sent").Inc()
+			launch()
+		}
+	}
+
+	for _, node := range fallback {
+		if res := read(node); accept(res) {
+			return res, true
+		}
+	}
+	return replicaResponse{}, false
+}
+
+// LatencyHandler reports the read latency percentiles of the aux nodes on
+// the ring.
+func (m *Master) LatencyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.latency.stats(m.hashring.Nodes()))
+}
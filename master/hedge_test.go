@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGet_HedgesSlowReplica(t *testing.T) {
+	var slowReads, cancelled atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowReads.Add(1)
+		select {
+		case <-r.Context().Done():
+			cancelled.Add(1)
+		case <-time.After(2 * time.Second):
+			w.Write([]byte(`{"key":"k","value":"slow"}`))
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"key":"k","value":"fast"}`))
+	}))
+	defer fast.Close()
+
+	m := NewMaster("primary", "")
+	m.replicationFactor = 2
+	m.hedge = true
+	for _, srv := range []*httptest.Server{slow, fast} {
+		addr := strings.TrimPrefix(srv.URL, "http://")
+		m.hashring.AddNode(addr)
+		// Both usually answer within a few milliseconds.
+		for i := 0; i < hedgeMinSamples; i++ {
+			m.latency.observe(addr, 5*time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"}))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"key":"k","value":"fast"}`, w.Body.String())
+		assert.Less(t, time.Since(start), time.Second, "read waited for the slow replica")
+	}
+
+	// Every read the slow replica got was cancelled once the other answered,
+	// and counted in its latency as taking at least that long.
+	assert.Eventually(t, func() bool { return cancelled.Load() == slowReads.Load() }, time.Second, 10*time.Millisecond)
+	slowAddr := strings.TrimPrefix(slow.URL, "http://")
+	assert.Eventually(t, func() bool {
+		return m.latency.stats([]string{slowAddr})[slowAddr].Samples == hedgeMinSamples+int(slowReads.Load())
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHedgedRead_FallbackOnlyAfterReplicasMiss(t *testing.T) {
+	var missedAt, fallbackAt atomic.Int64
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		missedAt.Store(time.Now().UnixNano())
+		http.NotFound(w, r)
+	}))
+	defer replica.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackAt.Store(time.Now().UnixNano())
+		w.Write([]byte(`{"key":"k","value":"old owner"}`))
+	}))
+	defer fallback.Close()
+
+	m := NewMaster("primary", "")
+	m.hedge = true
+	res, ok := m.hedgedRead(DefaultNamespace,
+		[]string{strings.TrimPrefix(replica.URL, "http://")},
+		[]string{strings.TrimPrefix(fallback.URL, "http://")},
+		"/data/k", func(res replicaResponse) bool { return res.ok() })
+
+	require.True(t, ok)
+	assert.Equal(t, `{"key":"k","value":"old owner"}`, string(res.body))
+	assert.Greater(t, fallbackAt.Load(), missedAt.Load(), "a previous owner was read before the replica missed")
+}
+
+func TestLatencyTracker(t *testing.T) {
+	tr := newLatencyTracker()
+	assert.Equal(t, defaultHedgeDelay, tr.hedgeDelay("aux1:3001"), "unknown node")
+
+	for i := 1; i <= 100; i++ {
+		tr.observe("aux1:3001", time.Duration(i)*time.Millisecond)
+	}
+	stats := tr.stats([]string{"aux1:3001", "aux2:3002"})
+	require.Len(t, stats, 1)
+	assert.Equal(t, LatencyStat{Samples: 100, P50: 50, P95: 95, P99: 99}, stats["aux1:3001"])
+	assert.Equal(t, 95*time.Millisecond, tr.hedgeDelay("aux1:3001"))
+
+	// Only the latest samples count.
+	for i := 0; i < latencySamples; i++ {
+		tr.observe("aux1:3001", 2*time.Millisecond)
+	}
+	assert.Equal(t, 2*time.Millisecond, tr.hedgeDelay("aux1:3001"))
+
+	for i := 0; i < hedgeMinSamples-1; i++ {
+		tr.observe("aux2:3002", time.Microsecond)
+	}
+	assert.Equal(t, defaultHedgeDelay, tr.hedgeDelay("aux2:3002"), "too few samples")
+	tr.observe("aux2:3002", time.Microsecond)
+	assert.Equal(t, minHedgeDelay, tr.hedgeDelay("aux2:3002"))
+}
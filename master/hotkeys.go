@@ -0,0 +1,532 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"hash/crc32"
+	"hash/fnv"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hotKeyWindow is how often read rates are measured and hot copies renewed.
+const hotKeyWindow = 10 * time.Second
+
+// hotCopyTTL bounds how long a copy of a hot key outlives the master's
+// interest in it. Copies are renewed every window while the key stays hot,
+// so one a crashed master left behind disappears on its own.
+const hotCopyTTL = 3 * hotKeyWindow
+
+// Size of the count-min sketch of each tracker shard. With 4 rows of 2048
+// counters an estimate exceeds the true count by more than 0.13% of the
+// shard's reads in the window with probability under 2%.
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// countMinSketch estimates how often each key was read in a fixed amount of
+// memory. Estimates can exceed the true count, never fall short of it.
+type countMinSketch struct {
+	rows [sketchDepth][sketchWidth]uint32
+}
+
+// add counts one read of key and returns its estimated count.
+func (s *countMinSketch) add(key string) uint32 {
+	h1 := crc32.ChecksumIEEE([]byte(key))
+	h2 := crc32.Checksum([]byte(key), castagnoli) | 1
+	est := uint32(math.MaxUint32)
+	for i := range s.rows {
+		c := &s.rows[i][(h1+uint32(i)*h2)%sketchWidth]
+		if *c < math.MaxUint32 {
+			*c++
+		}
+		if *c < est {
+			est = *c
+		}
+	}
+	return est
+}
+
+// hotCandidate is one of the most read keys of the current window.
+type hotCandidate struct {
+	rk, ns, key string
+	reads       uint32
+	pos         int // index in its shard's candidate heap
+}
+
+// candidateHeap is a min-heap of candidates by reads, so the coldest one,
+// the next to be replaced, is always at the root.
+type candidateHeap []*hotCandidate
+
+func (h candidateHeap) Len() int           { return len(h) }
+func (h candidateHeap) Less(i, j int) bool { return h[i].reads < h[j].reads }
+func (h candidateHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+func (h *candidateHeap) Push(x any) {
+	c := x.(*hotCandidate)
+	c.pos = len(*h)
+	*h = append(*h, c)
+}
+func (h *candidateHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// hotKey is a key read often enough to be copied to extra nodes.
+type hotKey struct {
+	ns, key string
+	rate    float64  // reads per second in the last window
+	extras  []string // nodes holding a copy, read alongside the replicas
+	spread  bool     // the copies hold the current value
+	gen     uint64   // bumped by every write to the key
+}
+
+// HotKeyStat reports one of the most read keys of the last window.
+type HotKeyStat struct {
+	Namespace      string   `json:"namespace"`
+	Key            string   `json:"key"`
+	ReadsPerSecond float64  `json:"reads_per_second"`
+	Hot            bool     `json:"hot"`
+	Copies         []string `json:"copies,omitempty"` // extra nodes serving reads
+}
+
+// hotKeyShards is how many independently locked parts the tracker is split
+// into, so concurrent reads of different keys rarely wait for each other.
+const hotKeyShards = 16
+
+// hotKeyShard tracks the keys whose routing key hashes to it. Each shard
+// keeps its own top-K, so the K most read keys overall are always among
+// the candidates of their shards.
+type hotKeyShard struct {
+	mu     sync.Mutex
+	sketch countMinSketch
+	top    candidateHeap
+	byKey  map[string]*hotCandidate // top, by routing key
+	hot    map[string]*hotKey       // by routing key
+}
+
+// hotKeyTracker finds the most read keys with a count-min sketch and a
+// top-K list per shard. At the end of each window the candidates read at
+// least threshold times per second become hot; a hot key cools down once
+// it is read less than half that often, so a key near the threshold does
+// not flap.
+type hotKeyTracker struct {
+	threshold float64
+	topK      int
+	shards    [hotKeyShards]hotKeyShard
+	wake      chan struct{} // a hot key lost its copies
+
+	mu      sync.Mutex // guards last and started
+	last    []HotKeyStat
+	started time.Time
+}
+
+func newHotKeyTracker(threshold float64, topK int) *hotKeyTracker {
+	t := &hotKeyTracker{
+		threshold: threshold,
+		topK:      topK,
+		started:   time.Now(),
+		wake:      make(chan struct{}, 1),
+	}
+	for i := range t.shards {
+		t.shards[i].byKey = make(map[string]*hotCandidate)
+		t.shards[i].hot = make(map[string]*hotKey)
+	}
+	return t
+}
+
+// shard returns the shard tracking routing key rk. It hashes with FNV
+// rather than the sketch's CRCs, so the keys of one shard still spread over
+// every counter of its sketch.
+func (t *hotKeyTracker) shard(rk string) *hotKeyShard {
+	h := fnv.New32a()
+	h.Write([]byte(rk))
+	return &t.shards[h.Sum32()%hotKeyShards]
+}
+
+// record counts a read of key in namespace ns.
+func (t *hotKeyTracker) record(ns, key string) {
+	rk := routingKey(ns, key)
+	sh := t.shard(rk)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	n := sh.sketch.add(rk)
+	if c, ok := sh.byKey[rk]; ok {
+		c.reads = n
+		heap.Fix(&sh.top, c.pos)
+		return
+	}
+	if len(sh.top) < t.topK {
+		c := &hotCandidate{rk: rk, ns: ns, key: key, reads: n}
+		heap.Push(&sh.top, c)
+		sh.byKey[rk] = c
+		return
+	}
+	// Replace the coldest candidate.
+	if coldest := sh.top[0]; n > coldest.reads {
+		delete(sh.byKey, coldest.rk)
+		*coldest = hotCandidate{rk: rk, ns: ns, key: key, reads: n}
+		sh.byKey[rk] = coldest
+		heap.Fix(&sh.top, 0)
+	}
+}
+
+// rotate ends the current window at now and starts a new one. It returns
+// the keys that cooled down, whose copies should be removed.
+func (t *hotKeyTracker) rotate(now time.Time) (cooled []*hotKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	secs := now.Sub(t.started).Seconds()
+	if secs <= 0 {
+		return nil
+	}
+
+	var last []HotKeyStat
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.mu.Lock()
+		rates := make(map[string]float64, len(sh.top))
+		for _, c := range sh.top {
+			rate := float64(c.reads) / secs
+			rates[c.rk] = rate
+			h, isHot := sh.hot[c.rk]
+			switch {
+			case !isHot && rate >= t.threshold:
+				sh.hot[c.rk] = &hotKey{ns: c.ns, key: c.key, rate: rate}
+			case isHot:
+				h.rate = rate
+			}
+			last = append(last, HotKeyStat{Namespace: c.ns, Key: c.key, ReadsPerSecond: rate})
+		}
+		for rk, h := range sh.hot {
+			if rates[rk] < t.threshold/2 {
+				delete(sh.hot, rk)
+				cooled = append(cooled, h)
+			}
+		}
+		sh.sketch = countMinSketch{}
+		sh.top = nil
+		sh.byKey = make(map[string]*hotCandidate)
+		sh.mu.Unlock()
+	}
+	sort.Slice(last, func(i, j int) bool { return last[i].ReadsPerSecond > last[j].ReadsPerSecond })
+	if len(last) > t.topK {
+		last = last[:t.topK]
+	}
+	t.last = last
+	t.started = now
+	return cooled
+}
+
+// hotKeys returns the keys that are hot now.
+func (t *hotKeyTracker) hotKeys() []*hotKey {
+	return t.collect(func(*hotKey) bool { return true })
+}
+
+// unspread returns the hot keys whose copies were invalidated.
+func (t *hotKeyTracker) unspread() []*hotKey {
+	return t.collect(func(h *hotKey) bool { return !h.spread })
+}
+
+// collect returns the hot keys of every shard that keep accepts.
+func (t *hotKeyTracker) collect(keep func(*hotKey) bool) []*hotKey {
+	var out []*hotKey
+	for i := range t.shards {
+		sh := &t.shards[i]
+		sh.mu.Lock()
+		for _, h := range sh.hot {
+			if keep(h) {
+				out = append(out, h)
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return out
+}
+
+// generation returns the write generation of a hot key, and false if the
+// key is no longer hot.
+func (t *hotKeyTracker) generation(rk string) (uint64, bool) {
+	sh := t.shard(rk)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	h, ok := sh.hot[rk]
+	if !ok {
+		return 0, false
+	}
+	return h.gen, true
+}
+
+// markSpread records that extras hold the value of a hot key read at
+// generation gen. It returns false if the key was written or cooled down
+// since, in which case the copies just made are out of date.
+func (t *hotKeyTracker) markSpread(rk string, gen uint64, extras []string) bool {
+	sh := t.shard(rk)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	h, ok := sh.hot[rk]
+	if !ok || h.gen != gen {
+		return false
+	}
+	h.extras, h.spread = extras, len(extras) > 0
+	return true
+}
+
+// copies returns the extra nodes that serve reads of a hot key.
+func (t *hotKeyTracker) copies(rk string) []string {
+	sh := t.shard(rk)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if h, ok := sh.hot[rk]; ok && h.spread {
+		return h.extras
+	}
+	return nil
+}
+
+// invalidate takes the copies of a key out of the read rotation and
+// returns the nodes holding them. It also bumps the key's generation, so a
+// copy being made at the time is discarded rather than marked current.
+func (t *hotKeyTracker) invalidate(rk string) []string {
+	sh := t.shard(rk)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	h, ok := sh.hot[rk]
+	if !ok {
+		return nil
+	}
+	h.gen++
+	h.spread = false
+	extras := h.extras
+	h.extras = nil
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return extras
+}
+
+// report returns the most read keys of the last window, hottest first.
+func (t *hotKeyTracker) report() []HotKeyStat {
+	t.mu.Lock()
+	out := make([]HotKeyStat, len(t.last))
+	copy(out, t.last)
+	t.mu.Unlock()
+	for i := range out {
+		rk := routingKey(out[i].Namespace, out[i].Key)
+		sh := t.shard(rk)
+		sh.mu.Lock()
+		if h, ok := sh.hot[rk]; ok {
+			out[i].Hot = true
+			if h.spread {
+				out[i].Copies = h.extras
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return out
+}
+
+// TrackHotKeys turns on hot-key detection: the topK most read keys are
+// tracked, and a key read at least threshold times per second is copied
+// to up to extra more nodes, whose copies serve reads until it cools down.
+func (m *Master) TrackHotKeys(threshold float64, topK, extra int) {
+	m.hot = newHotKeyTracker(threshold, topK)
+	m.hotExtra = extra
+	go m.watchHotKeys()
+}
+
+// watchHotKeys ends a window every hotKeyWindow, renewing the copies of hot
+// keys and removing those of keys that cooled down. In between it copies
+// hot keys again as soon as a write invalidated their copies.
+func (m *Master) watchHotKeys() {
+	ticker := time.NewTicker(hotKeyWindow)
+	defer ticker.Stop()
+	for {
+		var keys []*hotKey
+		select {
+		case now := <-ticker.C:
+			for _, h := range m.hot.rotate(now) {
+				m.dropCopies(h.ns, h.key, h.extras)
+			}
+			keys = m.hot.hotKeys()
+		case <-m.hot.wake:
+			keys = m.hot.unspread()
+		}
+		for _, h := range keys {
+			m.spreadHotKey(h.ns, h.key)
+		}
+	}
+}
+
+// recordRead counts a Get of key for hot-key detection.
+func (m *Master) recordRead(ns, key string) {
+	if m.hot != nil {
+		m.hot.record(ns, key)
+	}
+}
+
+// hotCopies returns the extra nodes serving reads of key if it is hot,
+// leaving out the nodes in current.
+func (m *Master) hotCopies(ns, key string, current []string) []string {
+	if m.hot == nil {
+		return nil
+	}
+	var out []string
+	for _, node := range m.hot.copies(routingKey(ns, key)) {
+		if !containsNode(current, node) {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+// spreadHotKey copies a hot key from one of its replicas to the next
+// m.hotExtra nodes on the ring. Only plain values are copied; the copies
+// expire after hotCopyTTL unless renewed.
+func (m *Master) spreadHotKey(ns, key string) {
+	rk := routingKey(ns, key)
+	gen, ok := m.hot.generation(rk)
+	if !ok || m.hotExtra <= 0 {
+		return
+	}
+	nodes, err := m.hashring.GetNodes(rk, m.replicationFactor+m.hotExtra)
+	if err != nil || len(nodes) <= m.replicationFactor {
+		return
+	}
+	owners, extras := nodes[:m.replicationFactor], nodes[m.replicationFactor:]
+
+	kv, ok := m.readForCopy(ns, key, owners)
+	if !ok {
+		return
+	}
+	body, err := json.Marshal(kv)
+	if err != nil {
+		return
+	}
+	var landed []string
+	for _, res := range m.sendAll(ns, extras, http.MethodPost, "/data", body) {
+		if res.ok() {
+			landed = append(landed, res.node)
+		} else {
+			log.Printf("hot keys: copying %s to %s failed: status=%d err=%v", key, res.node, res.status, res.err)
+		}
+	}
+	if !m.hot.markSpread(rk, gen, landed) {
+		// A write raced the copy, which may now hold an older value.
+		m.dropCopies(ns, key, landed)
+	}
+}
+
+// readForCopy reads a plain value and its remaining TTL from the first of
+// owners that has it.
+func (m *Master) readForCopy(ns, key string, owners []string) (KeyVal, bool) {
+	path := "/data/" + url.PathEscape(key)
+	for _, node := range owners {
+		res := m.send(ns, node, http.MethodGet, path, nil)
+		if res.err != nil || res.status != http.StatusOK {
+			continue
+		}
+		var kv KeyVal
+		if json.Unmarshal(res.body, &kv) != nil {
+			continue
+		}
+		ttl := m.send(ns, node, http.MethodGet, path+"/ttl", nil)
+		var info struct {
+			TTL int `json:"ttl"`
+		}
+		if ttl.err != nil || ttl.status != http.StatusOK || json.Unmarshal(ttl.body, &info) != nil || info.TTL == 0 {
+			continue
+		}
+		copied := KeyVal{Key: key, Value: kv.Value, Version: kv.Version, TTL: int(hotCopyTTL / time.Second)}
+		if info.TTL > 0 && info.TTL < copied.TTL {
+			copied.TTL = info.TTL
+		}
+		return copied, true
+	}
+	return KeyVal{}, false
+}
+
+// dropCopies removes the copies of a hot key from extras. A node that has
+// become one of the key's replicas since is left alone.
+func (m *Master) dropCopies(ns, key string, extras []string) {
+	if len(extras) == 0 {
+		return
+	}
+	owners, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
+	if err != nil {
+		return
+	}
+	var stale []string
+	for _, node := range extras {
+		if !containsNode(owners, node) {
+			stale = append(stale, node)
+		}
+	}
+	for _, res := range m.sendAll(ns, stale, http.MethodDelete, "/data/"+url.PathEscape(key), nil) {
+		if res.err != nil {
+			log.Printf("hot keys: removing copy of %s from %s failed: %v", key, res.node, res.err)
+		}
+	}
+}
+
+// invalidateHotKey stops reads of key from using its copies and removes
+// them. Writers call it before sending a write, so no read is served from a
+// copy once the new value has landed, and call the returned func after the
+// write: that invalidates again, discarding a copy made from the old value
+// in between. The copies are made again from the new value shortly after.
+func (m *Master) invalidateHotKey(ns, key string) (after func()) {
+	m.dropHotCopies(ns, key)
+	return func() { m.dropHotCopies(ns, key) }
+}
+
+// invalidateHotKeys does invalidateHotKey for every hot key, around writes
+// that may touch any key, such as deleting by tag.
+func (m *Master) invalidateHotKeys() (after func()) {
+	invalidate := func() {
+		if m.hot == nil {
+			return
+		}
+		for _, h := range m.hot.hotKeys() {
+			m.dropHotCopies(h.ns, h.key)
+		}
+	}
+	invalidate()
+	return invalidate
+}
+
+// dropHotCopies takes the copies of key out of the read rotation and
+// removes them.
+func (m *Master) dropHotCopies(ns, key string) {
+	if m.hot == nil {
+		return
+	}
+	if extras := m.hot.invalidate(routingKey(ns, key)); len(extras) > 0 {
+		go m.dropCopies(ns, key, extras)
+	}
+}
+
+// HotKeysHandler reports the most read keys of the last window.
+func (m *Master) HotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	stats := []HotKeyStat{}
+	if m.hot != nil {
+		stats = m.hot.report()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"enabled":        m.hot != nil,
+		"window_seconds": int(hotKeyWindow / time.Second),
+		"keys":           stats,
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotKey_CopiedToExtraNodeUntilWritten(t *testing.T) {
+	type store struct {
+		mu     sync.Mutex
+		values map[string]string
+		reads  atomic.Int32
+		srv    *httptest.Server
+	}
+	newStore := func() *store {
+		s := &store{values: make(map[string]string)}
+		s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			switch {
+			case r.Method == http.MethodPost:
+				var kv KeyVal
+				json.NewDecoder(r.Body).Decode(&kv)
+				s.values[kv.Key] = kv.Value
+			case r.Method == http.MethodDelete:
+				delete(s.values, "k")
+			case r.URL.Path == "/data/k/ttl":
+				w.Write([]byte(`{"key":"k","ttl":-1}`))
+			default:
+				v, ok := s.values["k"]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				s.reads.Add(1)
+				json.NewEncoder(w).Encode(KeyVal{Key: "k", Value: v})
+			}
+		}))
+		return s
+	}
+	value := func(s *store) (string, bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		v, ok := s.values["k"]
+		return v, ok
+	}
+
+	m := NewMaster("primary", "")
+	m.replicationFactor = 2
+	stores := make(map[string]*store)
+	for i := 0; i < 3; i++ {
+		s := newStore()
+		defer s.srv.Close()
+		addr := strings.TrimPrefix(s.srv.URL, "http://")
+		stores[addr] = s
+		m.hashring.AddNode(addr)
+	}
+	nodes, err := m.hashring.GetNodes("k", 3)
+	require.NoError(t, err)
+	extra := stores[nodes[2]]
+	for _, node := range nodes[:2] {
+		stores[node].values["k"] = "v1"
+	}
+
+	m.hot = newHotKeyTracker(10, 8)
+	m.hotExtra = 1
+	for i := 0; i < 100; i++ {
+		m.recordRead(DefaultNamespace, "k")
+	}
+	assert.Empty(t, m.hot.rotate(m.hot.started.Add(time.Second)))
+	m.spreadHotKey(DefaultNamespace, "k")
+	v, ok := value(extra)
+	require.True(t, ok, "hot key not copied to the extra node")
+	assert.Equal(t, "v1", v)
+
+	get := func() string {
+		w := httptest.NewRecorder()
+		m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"}))
+		var kv KeyVal
+		json.Unmarshal(w.Body.Bytes(), &kv)
+		return kv.Value
+	}
+	for i := 0; i < 30; i++ {
+		assert.Equal(t, "v1", get())
+	}
+	assert.Positive(t, extra.reads.Load(), "no read served by the copy")
+
+	// A write takes the copy out of rotation and removes it.
+	w := httptest.NewRecorder()
+	m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v2"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, m.hotCopies(DefaultNamespace, "k", nodes[:2]))
+	assert.Eventually(t, func() bool {
+		_, ok := value(extra)
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "v2", get())
+	}
+
+	w = httptest.NewRecorder()
+	m.HotKeysHandler(w, httptest.NewRequest(http.MethodGet, "/hotkeys", nil))
+	assert.Contains(t, w.Body.String(), `"key":"k","reads_per_second":100,"hot":true`)
+}
+
+func TestHotKeyTracker(t *testing.T) {
+	tr := newHotKeyTracker(50, 2)
+	start := tr.started
+	for i := 0; i < 100; i++ {
+		tr.record(DefaultNamespace, "viral")
+	}
+	tr.record(DefaultNamespace, "a")
+	tr.record(DefaultNamespace, "b")
+	tr.record(DefaultNamespace, "b")
+
+	// b outread a and took its place among the top 2.
+	assert.Empty(t, tr.rotate(start.Add(time.Second)))
+	report := tr.report()
+	require.Len(t, report, 2)
+	assert.Equal(t, HotKeyStat{Namespace: DefaultNamespace, Key: "viral", ReadsPerSecond: 100, Hot: true}, report[0])
+	assert.Equal(t, "b", report[1].Key)
+	assert.False(t, report[1].Hot)
+
+	// Above half the threshold the key stays hot, below it cools down.
+	for i := 0; i < 30; i++ {
+		tr.record(DefaultNamespace, "viral")
+	}
+	assert.Empty(t, tr.rotate(start.Add(2*time.Second)))
+	assert.Len(t, tr.hotKeys(), 1)
+	for i := 0; i < 20; i++ {
+		tr.record(DefaultNamespace, "viral")
+	}
+	cooled := tr.rotate(start.Add(3 * time.Second))
+	require.Len(t, cooled, 1)
+	assert.Equal(t, "viral", cooled[0].key)
+	assert.Empty(t, tr.hotKeys())
+}
+
+func TestHotKey_CopiesLeaveRotationBeforeWrite(t *testing.T) {
+	m := NewMaster("primary", "")
+	m.hot = newHotKeyTracker(10, 8)
+	rk := routingKey(DefaultNamespace, "k")
+	for i := 0; i < 100; i++ {
+		m.recordRead(DefaultNamespace, "k")
+	}
+	m.hot.rotate(m.hot.started.Add(time.Second))
+	gen, ok := m.hot.generation(rk)
+	require.True(t, ok)
+	require.True(t, m.hot.markSpread(rk, gen, []string{"copy:1"}))
+
+	var copiesDuringWrite []string
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		copiesDuringWrite = m.hotCopies(DefaultNamespace, "k", nil)
+		// A copy made from the old value while the write is in flight.
+		gen, _ := m.hot.generation(rk)
+		m.hot.markSpread(rk, gen, []string{"copy:1"})
+		w.Write([]byte(`{"key":"k","value":"v2"}`))
+	}))
+	defer aux.Close()
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+
+	w := httptest.NewRecorder()
+	m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v2"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, copiesDuringWrite, "reads used the copies while the write was sent")
+	assert.Empty(t, m.hotCopies(DefaultNamespace, "k", nil), "a copy of the old value survived the write")
+}
+
+func TestHotKeyTracker_ConcurrentReads(t *testing.T) {
+	tr := newHotKeyTracker(50, 4)
+	start := tr.started
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				tr.record(DefaultNamespace, "viral")
+				tr.record(DefaultNamespace, fmt.Sprintf("cold-%d-%d", g, i))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	tr.rotate(start.Add(time.Second))
+	report := tr.report()
+	require.Len(t, report, 4)
+	assert.Equal(t, "viral", report[0].Key)
+	assert.True(t, report[0].Hot)
+	assert.GreaterOrEqual(t, report[0].ReadsPerSecond, 8000.0)
+}
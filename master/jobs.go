@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rebalance job states.
+const (
+	JobRunning   = "running"
+	JobPaused    = "paused"
+	JobCancelled = "cancelled"
+	JobDone      = "done"
+	JobFailed    = "failed" // finished, but some keys could not be moved
+)
+
+// maxFinishedJobs bounds how many finished jobs are kept for inspection.
+const maxFinishedJobs = 50
+
+var errJobCancelled = errors.New("rebalance job cancelled")
+
+// RebalanceJob tracks the data movement caused by one membership change.
+// Counts of keys are estimates: they are taken from the source nodes when
+// the job starts, and keys written or evicted meanwhile are not recounted.
+type RebalanceJob struct {
+	mu       sync.Mutex
+	resumed  *sync.Cond
+	stopped  chan struct{} // closed on cancel
+	id       string
+	reason   string
+	state    string
+	created  time.Time
+	finished time.Time
+	ranges   int
+	lost     int // ranges that could not be moved
+	total    int
+	moved    int
+	failed   int
+	dropped  int
+	limiter  *rateLimiter
+}
+
+// JobStatus is a RebalanceJob as reported by the API.
+type JobStatus struct {
+	ID            string     `json:"id"`
+	Reason        string     `json:"reason"`
+	State         string     `json:"state"`
+	Created       time.Time  `json:"created"`
+	Finished      *time.Time `json:"finished,omitempty"`
+	Ranges        int        `json:"ranges,omitempty"`
+	RangesFailed  int        `json:"ranges_failed,omitempty"`
+	KeysTotal     int        `json:"keys_total"`
+	KeysMoved     int        `json:"keys_moved"`
+	KeysRemaining int        `json:"keys_remaining"`
+	KeysFailed    int        `json:"keys_failed"`
+	KeysDropped   int        `json:"keys_dropped"`
+}
+
+func (j *RebalanceJob) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st := JobStatus{
+		ID:           j.id,
+		Reason:       j.reason,
+		State:        j.state,
+		Created:      j.created,
+		Ranges:       j.ranges,
+		RangesFailed: j.lost,
+		KeysTotal:    j.total,
+		KeysMoved:    j.moved,
+		KeysFailed:   j.failed,
+		KeysDropped:  j.dropped,
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		st.Finished = &finished
+	}
+	if remaining := j.total - j.moved - j.failed; remaining > 0 && j.state != JobDone {
+		st.KeysRemaining = remaining
+	}
+	return st
+}
+
+// addTotal, addMoved, addFailed and addDropped update the job's counts.
+func (j *RebalanceJob) addTotal(n int)   { j.mu.Lock(); j.total += n; j.mu.Unlock() }
+func (j *RebalanceJob) addMoved(n int)   { j.mu.Lock(); j.moved += n; j.mu.Unlock() }
+func (j *RebalanceJob) addFailed(n int)  { j.mu.Lock(); j.failed += n; j.mu.Unlock() }
+func (j *RebalanceJob) addDropped(n int) { j.mu.Lock(); j.dropped += n; j.mu.Unlock() }
+
+// addLostRange records a range that could not be moved, holding n keys.
+func (j *RebalanceJob) addLostRange(n int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.lost++
+	j.failed += n
+}
+
+// checkpoint is called between batches. It blocks while the job is paused,
+// waits for the rate limiter, and returns errJobCancelled once the job has
+// been cancelled.
+func (j *RebalanceJob) checkpoint() error {
+	j.mu.Lock()
+	for j.state == JobPaused {
+		j.resumed.Wait()
+	}
+	cancelled := j.state == JobCancelled
+	j.mu.Unlock()
+	if cancelled {
+		return errJobCancelled
+	}
+	if !j.limiter.wait(j.stopped) {
+		return errJobCancelled
+	}
+	return nil
+}
+
+// cancelled reports whether the job has been cancelled.
+func (j *RebalanceJob) cancelled() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state == JobCancelled
+}
+
+// setState applies a pause, resume or cancel request.
+func (j *RebalanceJob) setState(action string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state != JobRunning && j.state != JobPaused {
+		return fmt.Errorf("job %s is already %s", j.id, j.state)
+	}
+	switch action {
+	case "pause":
+		j.state = JobPaused
+	case "resume":
+		j.state = JobRunning
+	case "cancel":
+		j.state = JobCancelled
+		close(j.stopped)
+	default:
+		return fmt.Errorf("unknown action %q", action)
+	}
+	j.resumed.Broadcast()
+	return nil
+}
+
+// finish records the end of the job.
+func (j *RebalanceJob) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	switch {
+	case j.state == JobCancelled:
+	case j.failed > 0 || j.lost > 0:
+		j.state = JobFailed
+	default:
+		j.state = JobDone
+	}
+}
+
+// jobManager keeps the rebalance jobs of this master.
+type jobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*RebalanceJob
+	order   []string // oldest first
+	lastID  int
+	limiter *rateLimiter
+}
+
+func newJobManager(rate int) *jobManager {
+	return &jobManager{jobs: make(map[string]*RebalanceJob), limiter: &rateLimiter{rate: rate}}
+}
+
+// start registers a running job.
+func (jm *jobManager) start(reason string) *RebalanceJob {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jm.lastID++
+	j := &RebalanceJob{
+		id:      strconv.Itoa(jm.lastID),
+		reason:  reason,
+		state:   JobRunning,
+		created: time.Now(),
+		stopped: make(chan struct{}),
+		limiter: jm.limiter,
+	}
+	j.resumed = sync.NewCond(&j.mu)
+	jm.jobs[j.id] = j
+	jm.order = append(jm.order, j.id)
+	jm.pruneLocked()
+	return j
+}
+
+// pruneLocked forgets the oldest finished jobs beyond maxFinishedJobs.
+func (jm *jobManager) pruneLocked() {
+	finished := 0
+	for i := len(jm.order) - 1; i >= 0; i-- {
+		id := jm.order[i]
+		if jm.jobs[id].status().Finished == nil {
+			continue
+		}
+		if finished++; finished > maxFinishedJobs {
+			delete(jm.jobs, id)
+			jm.order = append(jm.order[:i], jm.order[i+1:]...)
+		}
+	}
+}
+
+func (jm *jobManager) get(id string) (*RebalanceJob, bool) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	j, ok := jm.jobs[id]
+	return j, ok
+}
+
+// list returns the status of every job, newest first.
+func (jm *jobManager) list() []JobStatus {
+	jm.mu.Lock()
+	jobs := make([]*RebalanceJob, 0, len(jm.order))
+	for _, id := range jm.order {
+		jobs = append(jobs, jm.jobs[id])
+	}
+	jm.mu.Unlock()
+
+	out := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		out = append(out, j.status())
+	}
+	sort.SliceStable(out, func(a, b int) bool { return out[a].Created.After(out[b].Created) })
+	return out
+}
+
+// rateLimiter spaces batches so that at most rate keys per second are moved
+// across all jobs. A rate of zero does not limit.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int
+	next time.Time // when the next batch may start
+}
+
+func (l *rateLimiter) setRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.next = time.Time{}
+}
+
+func (l *rateLimiter) getRate() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// spend accounts for n keys just moved, delaying the next batch.
+func (l *rateLimiter) spend(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+}
+
+// wait blocks until the next batch may start. It returns false if stop is
+// closed first.
+func (l *rateLimiter) wait(stop <-chan struct{}) bool {
+	l.mu.Lock()
+	d := time.Until(l.next)
+	l.mu.Unlock()
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// RebalanceJobsHandler lists rebalance jobs, newest first.
+func (m *Master) RebalanceJobsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.jobs.list())
+}
+
+// RebalanceJobHandler reports one rebalance job.
+func (m *Master) RebalanceJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	j, ok := m.jobs.get(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("job %s not found", id), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j.status())
+}
+
+// RebalanceJobActionHandler pauses, resumes or cancels a rebalance job. A
+// cancelled job stops after its current batch; ranges it did not finish
+// copying stay on their old owners.
+func (m *Master) RebalanceJobActionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	j, ok := m.jobs.get(vars["id"])
+	if !ok {
+		http.Error(w, fmt.Sprintf("job %s not found", vars["id"]), http.StatusNotFound)
+		return
+	}
+	if err := j.setState(vars["action"]); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j.status())
+}
+
+// RebalanceRateHandler reads or changes how many keys per second rebalances
+// may move, across all jobs. Zero means unlimited.
+func (m *Master) RebalanceRateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var req struct {
+			KeysPerSecond *int `json:"keys_per_second"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.KeysPerSecond == nil || *req.KeysPerSecond < 0 {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		m.jobs.limiter.setRate(*req.KeysPerSecond)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"keys_per_second": m.jobs.limiter.getRate()})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebalanceJob_PauseResumeCancel(t *testing.T) {
+	var imports atomic.Int32
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			w.Write(snapshotStream("block-1", "block-2", "block-3"))
+		case "/ranges/count":
+			w.Write([]byte(`{"counts":[3]}`))
+		}
+	}))
+	defer source.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		imports.Add(1)
+		w.Write([]byte(`{"count":1,"received":1}`))
+	}))
+	defer target.Close()
+
+	src, dst := strings.TrimPrefix(source.URL, "http://"), strings.TrimPrefix(target.URL, "http://")
+	m := NewMaster("primary", "")
+	job := m.jobs.start("add " + dst)
+	require.NoError(t, job.setState("pause"))
+
+	done := make(chan struct{})
+	go func() {
+		m.migrate(job, []RangeMove{{HashRange: HashRange{Start: 10, End: 20}, Sources: []string{src}, Targets: []string{dst}, Drops: []string{src}}})
+		close(done)
+	}()
+
+	// Paused jobs move nothing.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), imports.Load())
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/rebalance/jobs/"+job.id, nil), map[string]string{"id": job.id})
+	w := httptest.NewRecorder()
+	m.RebalanceJobHandler(w, req)
+	var st JobStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&st))
+	assert.Equal(t, JobPaused, st.State)
+	assert.Equal(t, 3, st.KeysRemaining)
+
+	req = mux.SetURLVars(httptest.NewRequest(http.MethodPost, "/rebalance/jobs/"+job.id+"/cancel", nil), map[string]string{"id": job.id, "action": "cancel"})
+	w = httptest.NewRecorder()
+	m.RebalanceJobActionHandler(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cancelled job did not stop")
+	}
+	assert.Equal(t, int32(0), imports.Load())
+	assert.Equal(t, JobCancelled, job.status().State)
+
+	// A finished job can no longer change state.
+	w = httptest.NewRecorder()
+	m.RebalanceJobActionHandler(w, req)
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestRebalanceRateHandler(t *testing.T) {
+	m := NewMaster("primary", "")
+	w := httptest.NewRecorder()
+	m.RebalanceRateHandler(w, httptest.NewRequest(http.MethodPut, "/rebalance/rate", strings.NewReader(`{"keys_per_second":250}`)))
+	assert.JSONEq(t, `{"keys_per_second":250}`, w.Body.String())
+	assert.Equal(t, 250, m.jobs.limiter.getRate())
+
+	w = httptest.NewRecorder()
+	m.RebalanceRateHandler(w, httptest.NewRequest(http.MethodPut, "/rebalance/rate", strings.NewReader(`{"keys_per_second":-1}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
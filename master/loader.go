@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadTimeout bounds one call to the origin.
+const loadTimeout = 5 * time.Second
+
+// maxLoadSize bounds the value an origin may return.
+const maxLoadSize = 1 << 20
+
+// maxNegativeEntries bounds how many not-found keys are remembered.
+const maxNegativeEntries = 100000
+
+// ErrNoOrigin is returned by a Loader for a namespace it does not serve.
+var ErrNoOrigin = errors.New("no origin for namespace")
+
+// LoadResult is what a Loader found for a key.
+type LoadResult struct {
+	Found   bool
+	Value   string
+	TTL     time.Duration // 0 means the value does not expire
+	NoStore bool          // the origin forbids caching the value
+}
+
+// Loader fetches keys the cache does not hold, for read-through mode. On a
+// miss the master calls Load once per key, however many clients asked for
+// it, writes the value to the key's replicas and answers with it.
+type Loader interface {
+	Load(ctx context.Context, ns, key string) (LoadResult, error)
+}
+
+// HTTPLoader loads keys from an HTTP origin. Each namespace has a URL
+// template in which {key} is replaced by the escaped key. A 200 answer's
+// body is the value and its cache headers give the TTL; a 404 or 410 means
+// the origin has no such key.
+type HTTPLoader struct {
+	client     *http.Client
+	origins    map[string]string
+	defaultTTL time.Duration // used when the origin sends no cache headers
+}
+
+func NewHTTPLoader(origins map[string]string, defaultTTL time.Duration) *HTTPLoader {
+	return &HTTPLoader{client: &http.Client{}, origins: origins, defaultTTL: defaultTTL}
+}
+
+// parseOrigins parses READ_THROUGH_ORIGINS, e.g.
+// "default=http://origin:8000/items/{key},search=http://search:9000/doc/{key}".
+func parseOrigins(raw string) (map[string]string, error) {
+	origins := make(map[string]string)
+	for _, pair := range strings.Split(raw, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		ns, tmpl, ok := strings.Cut(pair, "=")
+		if !ok || !namespacePattern.MatchString(ns) || !strings.Contains(tmpl, "{key}") {
+			return nil, fmt.Errorf("invalid origin %q", pair)
+		}
+		if _, err := url.Parse(strings.ReplaceAll(tmpl, "{key}", "k")); err != nil {
+			return nil, fmt.Errorf("invalid origin %q: %v", pair, err)
+		}
+		origins[ns] = tmpl
+	}
+	return origins, nil
+}
+
+func (l *HTTPLoader) Load(ctx context.Context, ns, key string) (LoadResult, error) {
+	tmpl, ok := l.origins[ns]
+	if !ok {
+		return LoadResult{}, ErrNoOrigin
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(tmpl, "{key}", url.PathEscape(key)), nil)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return LoadResult{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return LoadResult{}, nil
+	default:
+		return LoadResult{}, fmt.Errorf("origin returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLoadSize+1))
+	if err != nil {
+		return LoadResult{}, err
+	}
+	if len(body) > maxLoadSize {
+		return LoadResult{}, fmt.Errorf("origin value larger than %d bytes", maxLoadSize)
+	}
+	ttl, noStore := cacheTTL(resp.Header, time.Now())
+	if ttl == 0 && !noStore && !hasCacheHeaders(resp.Header) {
+		ttl = l.defaultTTL
+	}
+	return LoadResult{Found: true, Value: string(body), TTL: ttl, NoStore: noStore}, nil
+}
+
+func hasCacheHeaders(h http.Header) bool {
+	return h.Get("Cache-Control") != "" || h.Get("Expires") != ""
+}
+
+// cacheTTL derives how long a response may be cached from its
+// Cache-Control (s-maxage, then max-age, less Age) or Expires header.
+// noStore is set by no-store, no-cache, or a lifetime that has run out.
+func cacheTTL(h http.Header, now time.Time) (ttl time.Duration, noStore bool) {
+	maxAge, sMaxAge := -1, -1
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		name, val, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			if n, err := strconv.Atoi(strings.Trim(val, `"`)); err == nil {
+				maxAge = n
+			}
+		case "s-maxage":
+			if n, err := strconv.Atoi(strings.Trim(val, `"`)); err == nil {
+				sMaxAge = n
+			}
+		}
+	}
+	if sMaxAge >= 0 {
+		maxAge = sMaxAge
+	}
+	if maxAge >= 0 {
+		age, _ := strconv.Atoi(h.Get("Age"))
+		if maxAge -= age; maxAge <= 0 {
+			return 0, true
+		}
+		return time.Duration(maxAge) * time.Second, false
+	}
+	if raw := h.Get("Expires"); raw != "" {
+		expires, err := http.ParseTime(raw)
+		if err != nil || !expires.After(now) {
+			// An invalid Expires means already expired.
+			return 0, true
+		}
+		if date, err := http.ParseTime(h.Get("Date")); err == nil {
+			now = date
+		}
+		return expires.Sub(now), false
+	}
+	return 0, false
+}
+
+// negativeCache remembers keys the origin did not have, so a burst of
+// reads of a missing key does not reach the origin every time.
+type negativeCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	until map[string]time.Time
+}
+
+func newNegativeCache(ttl time.Duration) *negativeCache {
+	return &negativeCache{ttl: ttl, until: make(map[string]time.Time)}
+}
+
+func (c *negativeCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.until[key]
+	if ok && time.Now().After(until) {
+		delete(c.until, key)
+		return false
+	}
+	return ok
+}
+
+func (c *negativeCache) add(key string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.until) >= maxNegativeEntries {
+		now := time.Now()
+		for k, until := range c.until {
+			if now.After(until) {
+				delete(c.until, k)
+			}
+		}
+		if len(c.until) >= maxNegativeEntries {
+			return
+		}
+	}
+	c.until[key] = time.Now().Add(c.ttl)
+}
+
+// forget is called when key is written, so it is not reported missing.
+func (c *negativeCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.until, key)
+}
+
+// SetLoader turns on read-through mode: keys missing from the cache are
+// loaded with l, and keys l did not find are remembered for negativeTTL.
+func (m *Master) SetLoader(l Loader, negativeTTL time.Duration) {
+	m.loader = l
+	m.negative = newNegativeCache(negativeTTL)
+}
+
+// forgetMissing drops key from the negative cache after a write, and ends
+// any refresh lease on it.
+func (m *Master) forgetMissing(ns, key string) {
+	m.leases.release(routingKey(ns, key))
+	if m.negative != nil {
+		m.negative.forget(routingKey(ns, key))
+	}
+}
+
+// loadKey loads a key every replica missed from the origin and writes it to
+// the replicas. The write only creates the key, so it never replaces a
+// value a client wrote while the origin was being asked. Its status is 200,
+// 404, or 502 if the origin failed.
+func (m *Master) loadKey(ns, key string) readResult {
+	if m.loader == nil {
+		return readResult{status: http.StatusNotFound}
+	}
+	rk := routingKey(ns, key)
+	if m.negative.has(rk) {
+		m.loads.WithLabelValues(ns, "negative_hit").Inc()
+		return readResult{status: http.StatusNotFound}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+	defer cancel()
+	res, err := m.loader.Load(ctx, ns, key)
+	switch {
+	case errors.Is(err, ErrNoOrigin):
+		return readResult{status: http.StatusNotFound}
+	case err != nil:
+		log.Printf("read-through: loading %s from the origin of %s failed: %v", key, ns, err)
+		m.loads.WithLabelValues(ns, "error").Inc()
+		return readResult{status: http.StatusBadGateway}
+	case !res.Found:
+		m.negative.add(rk)
+		m.loads.WithLabelValues(ns, "not_found").Inc()
+		return readResult{status: http.StatusNotFound}
+	}
+	m.loads.WithLabelValues(ns, "loaded").Inc()
+
+	kv := KeyVal{Key: key, Value: res.Value, Version: m.nextVersion()}
+	if res.TTL > 0 {
+		kv.TTL = int(math.Ceil(res.TTL.Seconds()))
+	}
+	body, err := json.Marshal(kv)
+	if err != nil {
+		return readResult{status: http.StatusInternalServerError}
+	}
+	if !res.NoStore {
+		stored := kv
+		stored.Cond = "nx"
+		if err := m.storeLoaded(ns, stored); err != nil {
+			log.Printf("read-through: caching %s failed: %v", key, err)
+		}
+	}
+	return readResult{
+		status: http.StatusOK,
+		body:   body,
+		etag:   strconv.Quote(strconv.FormatUint(kv.Version, 10)),
+		value:  kv.Value,
+		found:  true,
+	}
+}
+
+// readOrLoad reads key from its replicas and, if every one misses, loads
+// it from the origin. It is what a Get flight runs.
+func (m *Master) readOrLoad(ns, key string) readResult {
+	res := m.readKey(ns, key)
+	if res.status == http.StatusNotFound {
+		res = m.loadKey(ns, key)
+	}
+	return res
+}
+
+// storeLoaded writes a loaded key to its replicas. A replica that already
+// holds the key (409) counts as stored; any other refusal is logged, and an
+// error is returned if no replica has the key afterwards.
+func (m *Master) storeLoaded(ns string, kv KeyVal) error {
+	nodes, err := m.hashring.GetNodes(routingKey(ns, kv.Key), m.replicationFactor)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(kv)
+	if err != nil {
+		return err
+	}
+	stored := 0
+	for _, res := range m.sendAll(ns, nodes, http.MethodPost, "/data", body) {
+		switch {
+		case res.err != nil:
+			log.Printf("read-through: replica %s unavailable: %v", res.node, res.err)
+		case res.ok() || res.status == http.StatusConflict:
+			stored++
+		default:
+			log.Printf("read-through: replica %s refused %s: status %d %s", res.node, kv.Key, res.status, strings.TrimSpace(string(res.body)))
+		}
+	}
+	if stored == 0 {
+		return fmt.Errorf("no replica of %d stored it", len(nodes))
+	}
+	return nil
+}
+
+// loadMissing loads the keys a bulk read did not find into found, a few
+// at a time. Each load joins the key's Get flight, so a bulk read and Gets
+// missing the same key ask the origin once.
+func (m *Master) loadMissing(ns string, keys []string, found map[string]string) {
+	if m.loader == nil {
+		return
+	}
+	var missing []string
+	for _, key := range keys {
+		if _, ok := found[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, 16)
+	for _, key := range missing {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key string) {
+			defer func() { <-sem; wg.Done() }()
+			res, shared := m.getFlights.do(routingKey(ns, key), func() readResult {
+				return m.readOrLoad(ns, key)
+			})
+			if shared {
+				m.coalesced.WithLabelValues("bulk_get").Inc()
+			}
+			if res.found {
+				mu.Lock()
+				found[key] = res.value
+				mu.Unlock()
+			}
+		}(key)
+	}
+	wg.Wait()
+}
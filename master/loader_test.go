@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGet_ReadThrough(t *testing.T) {
+	var originCalls atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originCalls.Add(1)
+		if r.URL.Path != "/items/k" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.Write([]byte("from-origin"))
+	}))
+	defer origin.Close()
+
+	var mu sync.Mutex
+	var stored []KeyVal
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var kv KeyVal
+			json.NewDecoder(r.Body).Decode(&kv)
+			mu.Lock()
+			stored = append(stored, kv)
+			mu.Unlock()
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	m.SetLoader(NewHTTPLoader(map[string]string{DefaultNamespace: origin.URL + "/items/{key}"}, time.Minute), time.Minute)
+	get := func(key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/"+key, nil), map[string]string{"key": key}))
+		return w
+	}
+
+	w := get("k")
+	require.Equal(t, http.StatusOK, w.Code)
+	var kv KeyVal
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &kv))
+	assert.Equal(t, "from-origin", kv.Value)
+	require.Len(t, stored, 1)
+	assert.Equal(t, "from-origin", stored[0].Value)
+	assert.Equal(t, 60, stored[0].TTL)
+	assert.Equal(t, "nx", stored[0].Cond, "a loaded value must not replace a client write")
+
+	// A key the origin does not have is remembered as missing.
+	assert.Equal(t, http.StatusNotFound, get("missing").Code)
+	assert.Equal(t, http.StatusNotFound, get("missing").Code)
+	assert.Equal(t, int32(2), originCalls.Load())
+
+	// Writing the key clears the negative entry.
+	m.forgetMissing(DefaultNamespace, "missing")
+	get("missing")
+	assert.Equal(t, int32(3), originCalls.Load())
+}
+
+func TestBulkGet_LoadJoinsGetFlight(t *testing.T) {
+	var originCalls atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		originCalls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("from-origin"))
+	}))
+	defer origin.Close()
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/bulk/get":
+			w.Write([]byte(`{}`))
+		case r.Method == http.MethodGet:
+			http.NotFound(w, r)
+		}
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	m.SetLoader(NewHTTPLoader(map[string]string{DefaultNamespace: origin.URL + "/items/{key}"}, time.Minute), time.Minute)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		w := httptest.NewRecorder()
+		m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"}))
+		done <- w
+	}()
+	time.Sleep(50 * time.Millisecond)
+	w := httptest.NewRecorder()
+	m.BulkGet(w, httptest.NewRequest(http.MethodPost, "/bulk/get", strings.NewReader(`["k"]`)))
+
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+	assert.JSONEq(t, `{"k":"from-origin"}`, w.Body.String())
+	assert.Equal(t, int32(1), originCalls.Load(), "the bulk read and the Get should share one load")
+}
+
+func TestStoreLoaded_ReportsRefusals(t *testing.T) {
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}))
+	defer aux.Close()
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	assert.Error(t, m.storeLoaded(DefaultNamespace, KeyVal{Key: "k", Value: "v", Cond: "nx"}))
+
+	conflict := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "write condition not met", http.StatusConflict)
+	}))
+	defer conflict.Close()
+	m = NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(conflict.URL, "http://"))
+	assert.NoError(t, m.storeLoaded(DefaultNamespace, KeyVal{Key: "k", Value: "v", Cond: "nx"}), "a key a client wrote meanwhile counts as stored")
+}
+
+func TestCacheTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers map[string]string
+		ttl     time.Duration
+		noStore bool
+	}{
+		{"no headers", nil, 0, false},
+		{"max-age", map[string]string{"Cache-Control": "public, max-age=60"}, time.Minute, false},
+		{"s-maxage wins", map[string]string{"Cache-Control": "max-age=60, s-maxage=10"}, 10 * time.Second, false},
+		{"age is subtracted", map[string]string{"Cache-Control": "max-age=60", "Age": "20"}, 40 * time.Second, false},
+		{"stale", map[string]string{"Cache-Control": "max-age=60", "Age": "90"}, 0, true},
+		{"no-store", map[string]string{"Cache-Control": "no-store"}, 0, true},
+		{"expires", map[string]string{"Expires": now.Add(time.Hour).Format(http.TimeFormat)}, time.Hour, false},
+		{"expires in the past", map[string]string{"Expires": now.Add(-time.Hour).Format(http.TimeFormat)}, 0, true},
+		{"invalid expires", map[string]string{"Expires": "0"}, 0, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tc.headers {
+				h.Set(k, v)
+			}
+			ttl, noStore := cacheTTL(h, now)
+			assert.Equal(t, tc.ttl, ttl)
+			assert.Equal(t, tc.noStore, noStore)
+		})
+	}
+}
+
+func TestParseOrigins(t *testing.T) {
+	origins, err := parseOrigins("default=http://origin/items/{key}, search=http://search/doc/{key}?full=1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"default": "http://origin/items/{key}",
+		"search":  "http://search/doc/{key}?full=1",
+	}, origins)
+
+	_, err = parseOrigins("default=http://origin/items")
+	assert.Error(t, err, "template without {key}")
+}
@@ -58,6 +58,16 @@ func TestHashRing_RemoveNode(t *testing.T) {
 
 }
 
+func TestHashRing_Nodes(t *testing.T) {
+	hr := NewHashRing(3)
+	hr.AddNode("aux2")
+	hr.AddNode("aux1")
+	hr.AddNode("aux3")
+	hr.RemoveNode("aux3")
+
+	assert.Equal(t, []string{"aux1", "aux2"}, hr.Nodes())
+}
+
 func TestHashRing_GetNode(t *testing.T) {
 	hr := NewHashRing(3)
 
@@ -89,6 +99,41 @@ func TestHashRing_GetNode(t *testing.T) {
 
 }
 
+func TestHashRing_JoinRanges(t *testing.T) {
+	hr := NewHashRing(50)
+	hr.AddNode("aux1")
+	hr.AddNode("aux2")
+	hr.AddNode("aux3")
+
+	transfers := hr.JoinRanges("aux4", 2)
+	assert.NotEmpty(t, transfers)
+
+	future := NewHashRing(50)
+	for _, node := range []string{"aux1", "aux2", "aux3", "aux4"} {
+		future.AddNode(node)
+	}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		hash := crc32.ChecksumIEEE([]byte(key))
+		after, _ := future.GetNodes(key, 2)
+		before, _ := hr.GetNodes(key, 2)
+
+		var covering []RangeTransfer
+		for _, tr := range transfers {
+			if tr.Contains(hash) {
+				covering = append(covering, tr)
+			}
+		}
+		if !containsNode(after, "aux4") {
+			assert.Empty(t, covering, "key %s is not moving to aux4", key)
+			continue
+		}
+		if assert.Len(t, covering, 1, "key %s", key) {
+			assert.Equal(t, before, covering[0].Sources, "sources of key %s", key)
+		}
+	}
+}
+
 func TestHashRing_Performance(t *testing.T) {
 	hr := NewHashRing(10)
 
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"hash/crc32"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// migrationTable holds the ranges whose keys are being copied to new owners.
+// The ring already routes these keys to their new owners, which miss on
+// every key not copied yet, so reads of a migrating range fall back to the
+// owners it had before the change.
+type migrationTable struct {
+	mu    sync.RWMutex
+	moves map[string][]RangeMove // by job id
+}
+
+func newMigrationTable() *migrationTable {
+	return &migrationTable{moves: make(map[string][]RangeMove)}
+}
+
+func (t *migrationTable) add(id string, moves []RangeMove) {
+	if len(moves) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.moves[id] = moves
+}
+
+func (t *migrationTable) remove(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.moves, id)
+}
+
+// previousOwners returns the nodes that owned hash before a migration still
+// in progress, leaving out the nodes in current.
+func (t *migrationTable) previousOwners(hash uint32, current []string) []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var out []string
+	for _, moves := range t.moves {
+		for _, mv := range moves {
+			if !mv.Contains(hash) {
+				continue
+			}
+			for _, node := range mv.Sources {
+				if !containsNode(current, node) && !containsNode(out, node) {
+					out = append(out, node)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// startMigration registers moves as migrating and copies them in the
+// background. It must be called before the ring change that caused moves
+// is visible to readers, or right after it under m.auxMu, so no read sees
+// the new owners without the fallback.
+func (m *Master) startMigration(reason string, moves []RangeMove) *RebalanceJob {
+	job := m.jobs.start(reason)
+	m.migrating.add(job.id, moves)
+	go func() {
+		defer m.migrating.remove(job.id)
+		m.migrate(job, moves)
+	}()
+	return job
+}
+
+// readFallback returns the previous owners of key in namespace ns while its
+// range migrates away from them, to be read after the current owners miss.
+func (m *Master) readFallback(ns, key string, current []string) []string {
+	return m.migrating.previousOwners(crc32.ChecksumIEEE([]byte(routingKey(ns, key))), current)
+}
+
+// mirrorWrite applies a write of key to its previous owners while its range
+// migrates. Failures are only logged: the write has already landed on the
+// current owners.
+func (m *Master) mirrorWrite(ns, key string, current []string, method, path string, body []byte) {
+	prev := m.readFallback(ns, key, current)
+	if len(prev) == 0 {
+		return
+	}
+	for _, res := range m.sendAll(ns, prev, method, path, body) {
+		if res.err != nil {
+			log.Printf("migration: mirroring %s %s to previous owner %s failed: %v", method, path, res.node, res.err)
+		} else if !res.ok() && res.status != http.StatusNotFound {
+			log.Printf("migration: previous owner %s answered %d to %s %s", res.node, res.status, method, path)
+		}
+	}
+}
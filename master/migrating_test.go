@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet_FallsBackToPreviousOwnerDuringMigration(t *testing.T) {
+	var oldDeletes atomic.Int32
+	previous := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			oldDeletes.Add(1)
+			return
+		}
+		w.Write([]byte(`{"key":"k","value":"old"}`))
+	}))
+	defer previous.Close()
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer current.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(current.URL, "http://"))
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		m.Get(w, mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"}))
+		return w
+	}
+
+	// The whole ring is migrating away from previous.
+	m.migrating.add("1", []RangeMove{{HashRange: HashRange{Start: 0, End: 0}, Sources: []string{strings.TrimPrefix(previous.URL, "http://")}}})
+	w := get()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"k","value":"old"}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	m.Delete(w, mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/data/k", nil), map[string]string{"key": "k"}))
+	assert.Equal(t, int32(1), oldDeletes.Load(), "delete not applied to the previous owner")
+
+	m.migrating.remove("1")
+	assert.Equal(t, http.StatusNotFound, get().Code)
+}
+
+func TestTypedWrite_CopiedToPreviousOwnerWithDualWrite(t *testing.T) {
+	imports := make(chan string, 1)
+	previous := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		imports <- r.Method + " " + r.URL.Path
+	}))
+	defer previous.Close()
+	current := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"length":1}`))
+	}))
+	defer current.Close()
+
+	m := NewMaster("primary", "")
+	m.dualWrite = true
+	m.hashring.AddNode(strings.TrimPrefix(current.URL, "http://"))
+	m.migrating.add("1", []RangeMove{{HashRange: HashRange{Start: 0, End: 0}, Sources: []string{strings.TrimPrefix(previous.URL, "http://")}}})
+
+	req := httptest.NewRequest(http.MethodPost, "/list/q/rpush", strings.NewReader(`{"values":["job"]}`))
+	w := httptest.NewRecorder()
+	m.TypedWrite(w, mux.SetURLVars(req, map[string]string{"key": "q"}))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	select {
+	case got := <-imports:
+		assert.Equal(t, "POST /import", got, "the previous owner receives the entry, not the push")
+	default:
+		t.Fatal("the write was not copied to the previous owner")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// NamespaceHeader selects the namespace a request operates in. The master
+// forwards it to the aux nodes, which keep each namespace's keys apart.
+const NamespaceHeader = "X-Cache-Namespace"
+
+// DefaultNamespace is used by requests without a namespace header.
+const DefaultNamespace = "default"
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// namespaceOf returns the namespace of the request.
+func namespaceOf(r *http.Request) string {
+	if ns := r.Header.Get(NamespaceHeader); ns != "" {
+		return ns
+	}
+	return DefaultNamespace
+}
+
+// routingKey is the key placed on the hash ring. It matches the key an aux
+// node stores, so rebalancing (which works from raw aux keys) and client
+// requests agree on where a namespaced key lives.
+func routingKey(ns, key string) string {
+	if ns == "" || ns == DefaultNamespace {
+		return key
+	}
+	return ns + "\x00" + key
+}
+
+// splitRoutingKey is the inverse of routingKey: it splits a raw aux key
+// back into its namespace and client key.
+func splitRoutingKey(rk string) (ns, key string) {
+	if i := strings.IndexByte(rk, '\x00'); i >= 0 {
+		return rk[:i], rk[i+1:]
+	}
+	return DefaultNamespace, rk
+}
+
+// validKey reports whether a client key or tag can be namespaced. One
+// holding the separator routingKey uses would be read back by the aux nodes
+// as a key of another namespace.
+func validKey(key string) bool {
+	return !strings.Contains(key, "\x00")
+}
+
+// validEntry reports whether the key and tags of a write are valid keys.
+func validEntry(kv KeyVal) bool {
+	for _, tag := range kv.Tags {
+		if !validKey(tag) {
+			return false
+		}
+	}
+	return validKey(kv.Key)
+}
+
+// validateKey rejects requests whose path names a key or tag that is not a
+// valid key.
+func validateKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for _, name := range []string{"key", "tag"} {
+			if !validKey(vars[name]) {
+				http.Error(w, fmt.Sprintf("invalid %s %q", name, vars[name]), http.StatusBadRequest)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateNamespace rejects requests whose namespace header is malformed.
+func validateNamespace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ns := r.Header.Get(NamespaceHeader); ns != "" && !namespacePattern.MatchString(ns) {
+			http.Error(w, fmt.Sprintf("invalid namespace %q", ns), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// FlushNamespace removes every key of the namespace named in the path from
+// every aux node. It replaces the old whole-node erase, which wiped every
+// tenant at once.
+func (m *Master) FlushNamespace(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	ns := mux.Vars(r)["ns"]
+	if !namespacePattern.MatchString(ns) {
+		http.Error(w, fmt.Sprintf("invalid namespace %q", ns), http.StatusBadRequest)
+		return
+	}
+
+	count, err := m.deleteEverywhere(DefaultNamespace, "/namespaces/"+ns, false)
+	elapsedTime := time.Since(startTime).Seconds()
+	m.requests.WithLabelValues(r.Method, ns).Inc()
+	m.responseTime.WithLabelValues(r.Method, ns).Observe(elapsedTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"namespace": ns, "count": count})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet_ForwardsNamespace(t *testing.T) {
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "search", r.Header.Get(NamespaceHeader))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"k","value":"v"}`))
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/k", nil), map[string]string{"key": "k"})
+	req.Header.Set(NamespaceHeader, "search")
+	w := httptest.NewRecorder()
+	m.Get(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"k","value":"v"}`, w.Body.String())
+}
+
+func TestRoutingKey_SeparatesNamespaces(t *testing.T) {
+	assert.Equal(t, "k", routingKey(DefaultNamespace, "k"))
+	assert.Equal(t, "k", routingKey("", "k"))
+	assert.Equal(t, "search\x00k", routingKey("search", "k"))
+}
+
+func TestValidateNamespace(t *testing.T) {
+	h := validateNamespace(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/data/k", nil)
+	req.Header.Set(NamespaceHeader, "bad/name")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req.Header.Set(NamespaceHeader, "team-a")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestValidateKey_RejectsSeparator(t *testing.T) {
+	m := NewMaster("primary", "")
+	h := validateKey(http.HandlerFunc(m.Get))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodGet, "/data/x", nil), map[string]string{"key": "a\x00b"})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	for _, body := range []string{
+		`{"key":"a\u0000b","value":"v"}`,
+		`{"key":"k","value":"v","tags":["a\u0000b"]}`,
+	} {
+		w = httptest.NewRecorder()
+		m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+	}
+
+	w = httptest.NewRecorder()
+	m.BulkPut(w, httptest.NewRequest(http.MethodPost, "/data/bulk", strings.NewReader(`[{"key":"a\u0000b","value":"v"}]`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestFlushNamespace(t *testing.T) {
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/namespaces/search", r.URL.Path)
+		w.Write([]byte(`{"keys":["a","b"]}`))
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/namespaces/search", nil), map[string]string{"ns": "search"})
+	w := httptest.NewRecorder()
+	m.FlushNamespace(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"namespace":"search","count":2}`, w.Body.String())
+}
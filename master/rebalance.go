@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errIncompleteImport means the target of a copy could not hold every
+// entry sent to it, so the source must keep them.
+var errIncompleteImport = errors.New("target evicted imported entries")
+
+// rebalanceBatch is how many entries rebalance sends per bulk request.
+const rebalanceBatch = 500
+
+// snapshotMagic starts the stream an aux node's /export produces: an 8 byte
+// header ("DCSNAP", version, flags) followed by blocks, each an 8 byte frame
+// header (payload length, checksum) and its payload, and a zero-length frame
+// at the end. The master forwards blocks without decoding them.
+const snapshotMagic = "DCSNAP"
+
+// RangeMove is a range whose owners change between two rings.
+type RangeMove struct {
+	HashRange
+	Sources []string `json:"sources"` // owners before the change
+	Targets []string `json:"targets"` // owners that gain the range
+	Drops   []string `json:"drops"`   // owners that lose it
+}
+
+// clone returns a copy of the ring that later changes to hr do not affect.
+func (hr *HashRing) clone() *HashRing {
+	hr.mu.RLock()
+	defer hr.mu.RUnlock()
+	c := &HashRing{
+		sortedHash: append([]uint32(nil), hr.sortedHash...),
+		hashmap:    make(map[uint32]string, len(hr.hashmap)),
+		replica:    hr.replica,
+	}
+	for hash, node := range hr.hashmap {
+		c.hashmap[hash] = node
+	}
+	return c
+}
+
+// diffRings returns the ranges whose first n owners differ between before
+// and after. Adjacent ranges with the same owners are merged.
+func diffRings(before, after *HashRing, n int) []RangeMove {
+	before.mu.RLock()
+	defer before.mu.RUnlock()
+	after.mu.RLock()
+	defer after.mu.RUnlock()
+
+	if len(before.sortedHash) == 0 || len(after.sortedHash) == 0 {
+		return nil
+	}
+
+	// Between two consecutive points of either ring, both rings have a
+	// single owner list, named by the point that closes the arc.
+	seen := make(map[uint32]bool)
+	var points []uint32
+	for _, hashes := range [][]uint32{before.sortedHash, after.sortedHash} {
+		for _, h := range hashes {
+			if !seen[h] {
+				seen[h] = true
+				points = append(points, h)
+			}
+		}
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	var moves []RangeMove
+	for i, end := range points {
+		start := points[(i+len(points)-1)%len(points)]
+		was := before.nodesForHash(end, n)
+		now := after.nodesForHash(end, n)
+		targets, drops := missingFrom(now, was), missingFrom(was, now)
+		if len(targets) == 0 && len(drops) == 0 {
+			continue
+		}
+		if last := len(moves) - 1; last >= 0 && moves[last].End == start &&
+			sameNodes(moves[last].Sources, was) && sameNodes(moves[last].Targets, targets) && sameNodes(moves[last].Drops, drops) {
+			moves[last].End = end
+			continue
+		}
+		moves = append(moves, RangeMove{HashRange{Start: start, End: end}, was, targets, drops})
+	}
+	return moves
+}
+
+// missingFrom returns the nodes of a that are not in b.
+func missingFrom(a, b []string) []string {
+	var out []string
+	for _, node := range a {
+		if !containsNode(b, node) {
+			out = append(out, node)
+		}
+	}
+	return out
+}
+
+func sameNodes(a, b []string) bool {
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
+
+// migrate copies each range to the nodes gaining it and, once every one of
+// them has confirmed it holds every entry exported, removes the range from
+// the nodes losing it, unless the ring has given it back to them since.
+// Ranges are streamed from their current owners in blocks, so only keys
+// that actually change owner move and no node has to dump its whole cache.
+// Progress is reported through job, which can pause or cancel the copy
+// between blocks.
+func (m *Master) migrate(job *RebalanceJob, moves []RangeMove) {
+	defer job.finish()
+	if len(moves) == 0 {
+		return
+	}
+	startTime := time.Now()
+	job.mu.Lock()
+	job.ranges = len(moves)
+	job.mu.Unlock()
+
+	counts := m.countMoves(moves)
+	byTarget := make(map[string][]int)
+	for i, mv := range moves {
+		for _, target := range mv.Targets {
+			byTarget[target] = append(byTarget[target], i)
+			job.addTotal(counts[i])
+		}
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := make([]bool, len(moves))
+	for target, idx := range byTarget {
+		wg.Add(1)
+		go func(target string, idx []int) {
+			defer wg.Done()
+			lost := m.copyToTarget(job, target, moves, idx)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, i := range lost {
+				failed[i] = true
+				if !job.cancelled() {
+					job.addLostRange(counts[i])
+				}
+			}
+		}(target, idx)
+	}
+	wg.Wait()
+
+	byDrop := make(map[string][]HashRange)
+	for i, mv := range moves {
+		if failed[i] {
+			continue
+		}
+		for _, node := range mv.Drops {
+			byDrop[node] = append(byDrop[node], mv.HashRange)
+		}
+	}
+	for node, ranges := range byDrop {
+		n, err := m.dropUnowned(node, ranges)
+		if err != nil {
+			log.Printf("rebalance: failed to drop %d moved ranges from %s: %v", len(ranges), node, err)
+			continue
+		}
+		job.addDropped(n)
+	}
+
+	st := job.status()
+	log.Printf("rebalance job %s (%s): %d ranges in %.3fs, %d keys copied, %d dropped from old owners, %d failed",
+		st.ID, st.Reason, len(moves), time.Since(startTime).Seconds(), st.KeysMoved, st.KeysDropped, st.KeysFailed)
+}
+
+// dropUnowned drops ranges from node, leaving out any the node owns again:
+// the ring may have changed since the job was planned, e.g. because the
+// node died and came back. The ring cannot change during the check and the
+// drop, which both hold m.auxMu.
+func (m *Master) dropUnowned(node string, ranges []HashRange) (int, error) {
+	m.auxMu.RLock()
+	defer m.auxMu.RUnlock()
+	var unowned []HashRange
+	for _, r := range ranges {
+		if m.hashring.ownsAny(node, r, m.replicationFactor) {
+			log.Printf("rebalance: %s owns range (%d, %d] again, keeping it", node, r.Start, r.End)
+			continue
+		}
+		unowned = append(unowned, r)
+	}
+	if len(unowned) == 0 {
+		return 0, nil
+	}
+	return m.dropRanges(node, unowned)
+}
+
+// countMoves asks the first source of each move how many keys it holds. A
+// source that cannot answer leaves its moves counted as empty.
+func (m *Master) countMoves(moves []RangeMove) []int {
+	counts := make([]int, len(moves))
+	bySource := make(map[string][]int)
+	for i, mv := range moves {
+		if len(mv.Sources) > 0 {
+			bySource[mv.Sources[0]] = append(bySource[mv.Sources[0]], i)
+		}
+	}
+	for source, idx := range bySource {
+		ranges := make([]HashRange, len(idx))
+		for j, i := range idx {
+			ranges[j] = moves[i].HashRange
+		}
+		got, err := m.countRanges(source, ranges)
+		if err != nil || len(got) != len(idx) {
+			log.Printf("rebalance: failed to count keys on %s: %v", source, err)
+			continue
+		}
+		for j, i := range idx {
+			counts[i] = got[j]
+		}
+	}
+	return counts
+}
+
+// copyToTarget copies the ranges moves[idx] to target, trying their sources
+// in order, and returns the indexes of the moves it could not complete.
+func (m *Master) copyToTarget(job *RebalanceJob, target string, moves []RangeMove, idx []int) []int {
+	var lost []int
+	pending := idx
+	for attempt := 0; len(pending) > 0; attempt++ {
+		bySource := make(map[string][]int)
+		for _, i := range pending {
+			sources := missingFrom(moves[i].Sources, []string{target})
+			if attempt >= len(sources) {
+				lost = append(lost, i)
+				continue
+			}
+			bySource[sources[attempt]] = append(bySource[sources[attempt]], i)
+		}
+
+		pending = nil
+		for source, batch := range bySource {
+			if job.cancelled() {
+				lost = append(lost, batch...)
+				continue
+			}
+			ranges := make([]HashRange, len(batch))
+			for j, i := range batch {
+				ranges[j] = moves[i].HashRange
+			}
+			n, err := m.copyRanges(job, source, target, ranges)
+			switch {
+			case errors.Is(err, errJobCancelled):
+				lost = append(lost, batch...)
+			case errors.Is(err, errIncompleteImport):
+				// Another source would not fit either.
+				log.Printf("rebalance: copying %d ranges from %s to %s: %v", len(ranges), source, target, err)
+				lost = append(lost, batch...)
+			case err != nil:
+				log.Printf("rebalance: copying %d ranges from %s to %s failed after %d entries: %v", len(ranges), source, target, n, err)
+				pending = append(pending, batch...)
+			}
+		}
+	}
+	return lost
+}
+
+// exportCursorHeader carries the cursor of the next page of an aux node's
+// export; "0" follows the last page.
+const exportCursorHeader = "X-Export-Cursor"
+
+// copyRanges pages the entries of ranges out of source and imports each
+// page into target. Every page is read in full before it is imported, so a
+// paused or rate-limited job never keeps a response from source open. The
+// target keeps whichever version of a key is newer, so a copy racing a
+// client write never undoes it.
+func (m *Master) copyRanges(job *RebalanceJob, source, target string, ranges []HashRange) (int, error) {
+	body, err := json.Marshal(ranges)
+	if err != nil {
+		return 0, err
+	}
+
+	copied, exported := 0, 0
+	for cursor := "0"; ; {
+		if err := job.checkpoint(); err != nil {
+			return copied, err
+		}
+		page, next, err := m.exportPage(source, body, cursor)
+		if err != nil {
+			return copied, err
+		}
+		err = forEachSnapshotBlock(bytes.NewReader(page), func(block []byte) error {
+			held, received, err := m.importBlock(target, block)
+			copied += held
+			exported += received
+			job.addMoved(held)
+			job.limiter.spend(received)
+			return err
+		})
+		if err != nil {
+			return copied, err
+		}
+		if next == "" || next == "0" {
+			break
+		}
+		cursor = next
+	}
+	if copied < exported {
+		return copied, fmt.Errorf("%w: %s holds %d of %d entries", errIncompleteImport, target, copied, exported)
+	}
+	return copied, nil
+}
+
+// exportPage reads the page of source's export of ranges at cursor and
+// returns it with the cursor of the next page.
+func (m *Master) exportPage(source string, ranges []byte, cursor string) ([]byte, string, error) {
+	resp, err := m.client.Post(fmt.Sprintf("http://%s/export?cursor=%s", source, url.QueryEscape(cursor)), "application/json", bytes.NewReader(ranges))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("%s returned %d", source, resp.StatusCode)
+	}
+	page, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return page, resp.Header.Get(exportCursorHeader), nil
+}
+
+// forEachSnapshotBlock hands each block of a snapshot stream to fn as a
+// complete snapshot holding just that block.
+func forEachSnapshotBlock(r io.Reader, fn func(block []byte) error) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(snapshotMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return fmt.Errorf("reading export header: %w", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return fmt.Errorf("export is not a snapshot stream")
+	}
+
+	var end [8]byte
+	for {
+		var frame [8]byte
+		if _, err := io.ReadFull(br, frame[:]); err != nil {
+			return fmt.Errorf("export truncated: %w", err)
+		}
+		size := binary.BigEndian.Uint32(frame[:4])
+		if size == 0 {
+			return nil
+		}
+		block := make([]byte, 0, len(header)+len(frame)+int(size)+len(end))
+		block = append(append(block, header...), frame[:]...)
+		block = block[:len(block)+int(size)]
+		if _, err := io.ReadFull(br, block[len(header)+len(frame):]); err != nil {
+			return fmt.Errorf("export truncated: %w", err)
+		}
+		if err := fn(append(block, end[:]...)); err != nil {
+			return err
+		}
+	}
+}
+
+// importBlock sends one block to node's bulk import and returns how many
+// entries the block held and how many of them node holds afterwards. Node
+// may have had to evict some to make room.
+func (m *Master) importBlock(node string, block []byte) (held, received int, err error) {
+	resp, err := m.client.Post(fmt.Sprintf("http://%s/import", node), "application/octet-stream", bytes.NewReader(block))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return 0, 0, fmt.Errorf("%s returned %d: %s", node, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	var result struct {
+		Count    int `json:"count"`
+		Received int `json:"received"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, 0, err
+	}
+	return result.Count, result.Received, nil
+}
+
+// dropRanges removes the keys of ranges from node and returns how many it
+// held.
+func (m *Master) dropRanges(node string, ranges []HashRange) (int, error) {
+	body, err := json.Marshal(ranges)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := m.client.Post(fmt.Sprintf("http://%s/ranges/drop", node), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %d", node, resp.StatusCode)
+	}
+	var result struct {
+		Count int `json:"count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Count, nil
+}
+
+// countRanges returns how many keys node holds in each of ranges.
+func (m *Master) countRanges(node string, ranges []HashRange) ([]int, error) {
+	body, err := json.Marshal(ranges)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client.Post(fmt.Sprintf("http://%s/ranges/count", node), "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", node, resp.StatusCode)
+	}
+	var result struct {
+		Counts []int `json:"counts"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result.Counts, nil
+}
+
+// rebalance writes keyvals to their current owners. It is used for the
+// backup file, which holds the raw keys of aux nodes: each is split back
+// into its namespace and key, and entries are sent through the bulk
+// endpoint one batch per node and namespace at a time, reporting progress
+// through job.
+func (m *Master) rebalance(job *RebalanceJob, keyvals map[string]string) {
+	defer job.finish()
+	if len(keyvals) == 0 {
+		return
+	}
+
+	startTime := time.Now()
+
+	type batchKey struct{ node, ns string }
+	groups := make(map[batchKey][]KeyVal)
+	for rk, v := range keyvals {
+		nodes, err := m.hashring.GetNodes(rk, m.replicationFactor)
+		if err != nil {
+			log.Printf("failed to remap key %q: %v", rk, err)
+			job.addFailed(1)
+			continue
+		}
+		ns, key := splitRoutingKey(rk)
+		kv := KeyVal{Key: key, Value: v, Version: m.nextVersion()}
+		for _, node := range nodes {
+			groups[batchKey{node, ns}] = append(groups[batchKey{node, ns}], kv)
+			job.addTotal(1)
+		}
+	}
+
+	log.Printf("rebalancing %d keys in %d batches", len(keyvals), len(groups))
+
+	var wg sync.WaitGroup
+	for b, entries := range groups {
+		wg.Add(1)
+		go func(b batchKey, entries []KeyVal) {
+			defer wg.Done()
+			for len(entries) > 0 {
+				if job.checkpoint() != nil {
+					return
+				}
+				n := rebalanceBatch
+				if n > len(entries) {
+					n = len(entries)
+				}
+				if err := m.bulkPut(b.ns, b.node, entries[:n]); err != nil {
+					log.Printf("failed to send %d keys of %s to aux server %s: %v", n, b.ns, b.node, err)
+					job.addFailed(n)
+				} else {
+					job.addMoved(n)
+				}
+				job.limiter.spend(n)
+				entries = entries[n:]
+			}
+		}(b, entries)
+	}
+	wg.Wait()
+
+	st := job.status()
+	log.Printf("rebalance job %s (%s): %d of %d keys written in %.3fs",
+		st.ID, st.Reason, st.KeysMoved, st.KeysTotal, time.Since(startTime).Seconds())
+}
+
+// bulkPut writes entries of namespace ns to node in one request.
+func (m *Master) bulkPut(ns, node string, entries []KeyVal) error {
+	body, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	resp, err := m.auxRequest(ns, http.MethodPost, fmt.Sprintf("http://%s/bulk", node), bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", node, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// snapshotStream builds an export stream holding the given block payloads.
+func snapshotStream(payloads ...string) []byte {
+	buf := []byte(snapshotMagic + "\x01\x00")
+	for _, p := range payloads {
+		var frame [8]byte
+		binary.BigEndian.PutUint32(frame[:4], uint32(len(p)))
+		buf = append(append(buf, frame[:]...), p...)
+	}
+	return append(buf, make([]byte, 8)...)
+}
+
+func TestMigrate_CopiesThenDrops(t *testing.T) {
+	var mu sync.Mutex
+	var imported []string
+	var dropped []HashRange
+
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			w.Write(snapshotStream("block-1", "block-2"))
+		case "/ranges/count":
+			w.Write([]byte(`{"counts":[2]}`))
+		case "/ranges/drop":
+			mu.Lock()
+			json.NewDecoder(r.Body).Decode(&dropped)
+			mu.Unlock()
+			w.Write([]byte(`{"count":2}`))
+		}
+	}))
+	defer source.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/import", r.URL.Path)
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		imported = append(imported, string(body))
+		mu.Unlock()
+		w.Write([]byte(`{"count":1,"received":1}`))
+	}))
+	defer target.Close()
+
+	src, dst := strings.TrimPrefix(source.URL, "http://"), strings.TrimPrefix(target.URL, "http://")
+	moved := HashRange{Start: 10, End: 20}
+	m := NewMaster("primary", "")
+	job := m.jobs.start("test")
+	m.migrate(job, []RangeMove{{HashRange: moved, Sources: []string{src}, Targets: []string{dst}, Drops: []string{src}}})
+
+	// Each block reaches the target as a snapshot of its own.
+	require.Len(t, imported, 2)
+	assert.Equal(t, string(snapshotStream("block-1")), imported[0])
+	assert.Equal(t, string(snapshotStream("block-2")), imported[1])
+	assert.Equal(t, []HashRange{moved}, dropped)
+
+	st := job.status()
+	assert.Equal(t, JobDone, st.State)
+	assert.Equal(t, 2, st.KeysTotal)
+	assert.Equal(t, 2, st.KeysMoved)
+	assert.Equal(t, 0, st.KeysRemaining)
+	assert.Equal(t, 2, st.KeysDropped)
+}
+
+func TestMigrate_PagesExport(t *testing.T) {
+	var mu sync.Mutex
+	var cursors []string
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/export" {
+			return
+		}
+		cursor := r.URL.Query().Get("cursor")
+		mu.Lock()
+		cursors = append(cursors, cursor)
+		mu.Unlock()
+		if cursor == "0" {
+			w.Header().Set(exportCursorHeader, "page-2")
+			w.Write(snapshotStream("block-1"))
+			return
+		}
+		w.Header().Set(exportCursorHeader, "0")
+		w.Write(snapshotStream("block-2"))
+	}))
+	defer source.Close()
+	var imports int
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		imports++
+		mu.Unlock()
+		w.Write([]byte(`{"count":1,"received":1}`))
+	}))
+	defer target.Close()
+
+	src, dst := strings.TrimPrefix(source.URL, "http://"), strings.TrimPrefix(target.URL, "http://")
+	m := NewMaster("primary", "")
+	job := m.jobs.start("test")
+	m.migrate(job, []RangeMove{{HashRange: HashRange{Start: 10, End: 20}, Sources: []string{src}, Targets: []string{dst}}})
+
+	assert.Equal(t, []string{"0", "page-2"}, cursors)
+	assert.Equal(t, 2, imports)
+	assert.Equal(t, 2, job.status().KeysMoved)
+}
+
+func TestMigrate_KeepsRangeWhenCopyFails(t *testing.T) {
+	dropCalled := false
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			w.Write(snapshotStream("block-1"))
+		case "/ranges/drop":
+			dropCalled = true
+		}
+	}))
+	defer source.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	}))
+	defer target.Close()
+
+	src, dst := strings.TrimPrefix(source.URL, "http://"), strings.TrimPrefix(target.URL, "http://")
+	m := NewMaster("primary", "")
+	job := m.jobs.start("test")
+	m.migrate(job, []RangeMove{{HashRange: HashRange{Start: 10, End: 20}, Sources: []string{src}, Targets: []string{dst}, Drops: []string{src}}})
+
+	assert.False(t, dropCalled, "range dropped from its old owner although the copy failed")
+	assert.Equal(t, JobFailed, job.status().State)
+}
+
+func TestMigrate_KeepsRangeTargetCouldNotHold(t *testing.T) {
+	dropCalled := false
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			w.Write(snapshotStream("block-1"))
+		case "/ranges/drop":
+			dropCalled = true
+		}
+	}))
+	defer source.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"count":3,"received":5}`)) // evicted two to make room
+	}))
+	defer target.Close()
+
+	src, dst := strings.TrimPrefix(source.URL, "http://"), strings.TrimPrefix(target.URL, "http://")
+	m := NewMaster("primary", "")
+	job := m.jobs.start("test")
+	m.migrate(job, []RangeMove{{HashRange: HashRange{Start: 10, End: 20}, Sources: []string{src}, Targets: []string{dst}, Drops: []string{src}}})
+
+	assert.False(t, dropCalled, "range dropped from its old owner although the target could not hold it")
+	assert.Equal(t, JobFailed, job.status().State)
+}
+
+func TestMigrate_KeepsRangeOwnedAgain(t *testing.T) {
+	dropCalled := false
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			w.Write(snapshotStream("block-1"))
+		case "/ranges/drop":
+			dropCalled = true
+		}
+	}))
+	defer source.Close()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"count":1,"received":1}`))
+	}))
+	defer target.Close()
+
+	src, dst := strings.TrimPrefix(source.URL, "http://"), strings.TrimPrefix(target.URL, "http://")
+	m := NewMaster("primary", "")
+	// The source left the ring when the job was planned and is back.
+	m.hashring.AddNode(src)
+	job := m.jobs.start("test")
+	m.migrate(job, []RangeMove{{HashRange: HashRange{Start: 10, End: 20}, Sources: []string{src}, Targets: []string{dst}, Drops: []string{src}}})
+
+	assert.False(t, dropCalled, "range dropped from a node that owns it again")
+	assert.Equal(t, JobDone, job.status().State)
+}
+
+func TestDiffRings(t *testing.T) {
+	before := NewHashRing(50)
+	for _, node := range []string{"aux1", "aux2", "aux3"} {
+		before.AddNode(node)
+	}
+	after := before.clone()
+	after.AddNode("aux4")
+
+	moves := diffRings(before, after, 2)
+	assert.NotEmpty(t, moves)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		hash := crc32.ChecksumIEEE([]byte(key))
+		was, _ := before.GetNodes(key, 2)
+		now, _ := after.GetNodes(key, 2)
+
+		var covering []RangeMove
+		for _, mv := range moves {
+			if mv.Contains(hash) {
+				covering = append(covering, mv)
+			}
+		}
+		if sameNodes(was, now) {
+			assert.Empty(t, covering, "key %s did not change owners", key)
+			continue
+		}
+		if assert.Len(t, covering, 1, "key %s", key) {
+			mv := covering[0]
+			assert.Equal(t, was, mv.Sources, "sources of key %s", key)
+			assert.Equal(t, []string{"aux4"}, mv.Targets, "targets of key %s", key)
+			assert.Equal(t, missingFrom(was, now), mv.Drops, "drops of key %s", key)
+		}
+	}
+}
+
+func TestRebalanceDeadAux_CopiesRangesThroughExport(t *testing.T) {
+	// A namespaced key and a hash: the export carries both as they are.
+	payload := "tenant\x00k + hash profile"
+	var mu sync.Mutex
+	var imported, unexpected []string
+	dying := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			w.Write(snapshotStream(payload))
+		case "/ranges/count":
+			var ranges []HashRange
+			json.NewDecoder(r.Body).Decode(&ranges)
+			json.NewEncoder(w).Encode(map[string][]int{"counts": make([]int, len(ranges))})
+		default:
+			mu.Lock()
+			unexpected = append(unexpected, r.Method+" "+r.URL.Path)
+			mu.Unlock()
+		}
+	}))
+	defer dying.Close()
+	survivor := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/import" {
+			unexpected = append(unexpected, r.Method+" "+r.URL.Path)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		imported = append(imported, string(body))
+		w.Write([]byte(`{"count":2,"received":2}`))
+	}))
+	defer survivor.Close()
+
+	m := NewMaster("primary", "")
+	m.replicationFactor = 1
+	dead := strings.TrimPrefix(dying.URL, "http://")
+	for _, node := range []string{dead, strings.TrimPrefix(survivor.URL, "http://")} {
+		m.activeAuxServers[node] = true
+		m.hashring.AddNode(node)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/rebalance-dead-aux", strings.NewReader(`{"tenant\u0000k":"v"}`))
+	req.Header.Set("aux-server", dead)
+	m.RebalanceDeadAuxServer(httptest.NewRecorder(), req)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.NotEmpty(t, imported, "the dying node's ranges were not copied")
+	for _, body := range imported {
+		assert.Equal(t, string(snapshotStream(payload)), body)
+	}
+	assert.Empty(t, unexpected, "the handoff must not rewrite keys through /bulk or drop the leaving node")
+	assert.NotContains(t, m.hashring.Nodes(), dead)
+}
+
+func TestRebalance_SplitsNamespacedKeys(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[string][]KeyVal)
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []KeyVal
+		json.NewDecoder(r.Body).Decode(&batch)
+		mu.Lock()
+		got[namespaceOf(r)] = append(got[namespaceOf(r)], batch...)
+		mu.Unlock()
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	job := m.jobs.start("restore from backup")
+	m.rebalance(job, map[string]string{"tenant\x00k": "v", "plain": "w"})
+
+	require.Len(t, got["tenant"], 1)
+	assert.Equal(t, "k", got["tenant"][0].Key)
+	require.Len(t, got[DefaultNamespace], 1)
+	assert.Equal(t, "plain", got[DefaultNamespace][0].Key)
+	assert.Equal(t, JobDone, job.status().State)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// refreshLease is the least time a caller asked to refresh a value has
+// before another caller is asked too.
+const refreshLease = 5 * time.Second
+
+// refreshLeases decides who refreshes a value. Aux nodes only report that
+// a read is due a refresh; every replica, hot copy and hedged read would
+// report it on its own, so the master hands out one lease per routing key
+// and asks only the caller holding it.
+type refreshLeases struct {
+	mu     sync.Mutex
+	leases map[string]time.Time // routing key -> lease expiry
+}
+
+func newRefreshLeases() *refreshLeases {
+	return &refreshLeases{leases: make(map[string]time.Time)}
+}
+
+// grant reports whether a caller may refresh key, leasing it to that caller
+// for twice the value's recompute time, and at least refreshLease.
+func (l *refreshLeases) grant(key string, now time.Time, recompute time.Duration) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Before(l.leases[key]) {
+		return false
+	}
+	if len(l.leases) >= 4096 {
+		for k, until := range l.leases {
+			if !now.Before(until) {
+				delete(l.leases, k)
+			}
+		}
+	}
+	lease := 2 * recompute
+	if lease < refreshLease {
+		lease = refreshLease
+	}
+	l.leases[key] = now.Add(lease)
+	return true
+}
+
+// release ends the lease on key once it is written, so the next refresh
+// cycle of the new value is not held up by the last one.
+func (l *refreshLeases) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.leases, key)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// replicaResponse is the outcome of forwarding one request to one replica.
+type replicaResponse struct {
+	node   string
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+func (res replicaResponse) ok() bool {
+	return res.err == nil && res.status >= 200 && res.status < 300
+}
+
+// sendAll sends the same request to every node in parallel, bounded by
+// replicaSem, and returns the responses in the order of nodes.
+func (m *Master) sendAll(ns string, nodes []string, method, path string, body []byte) []replicaResponse {
+	resps := make([]replicaResponse, len(nodes))
+	done := make(chan struct{}, len(nodes))
+	for i, node := range nodes {
+		go func(i int, node string) {
+			m.replicaSem <- struct{}{}
+			defer func() {
+				<-m.replicaSem
+				done <- struct{}{}
+			}()
+			resps[i] = m.send(ns, node, method, path, body)
+		}(i, node)
+	}
+	for range nodes {
+		<-done
+	}
+	return resps
+}
+
+// send issues a single request to an aux node and reads the whole response.
+func (m *Master) send(ns, node, method, path string, body []byte) replicaResponse {
+	return m.sendContext(context.Background(), ns, node, method, path, body)
+}
+
+// sendContext is send with a context that can cancel the request.
+func (m *Master) sendContext(ctx context.Context, ns, node, method, path string, body []byte) replicaResponse {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	resp, err := m.auxRequestContext(ctx, ns, method, fmt.Sprintf("http://%s%s", node, path), reader)
+	if err != nil {
+		return replicaResponse{node: node, err: err}
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return replicaResponse{node: node, err: err}
+	}
+	return replicaResponse{node: node, status: resp.StatusCode, header: resp.Header, body: data}
+}
+
+// auxRequest sends a request to an aux node on behalf of namespace ns. The
+// caller must close the response body.
+func (m *Master) auxRequest(ns, method, url string, body io.Reader) (*http.Response, error) {
+	return m.auxRequestContext(context.Background(), ns, method, url, body)
+}
+
+// auxRequestContext is auxRequest with a context that can cancel the request.
+func (m *Master) auxRequestContext(ctx context.Context, ns, method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if ns != "" && ns != DefaultNamespace {
+		req.Header.Set(NamespaceHeader, ns)
+	}
+	return m.client.Do(req)
+}
+
+// forwardWrite applies a mutation of key (a counter, a typed value) on its
+// primary replica only and relays the primary's answer. The other replicas
+// then receive a copy of the entry the primary ended up with, see
+// copyEntry, instead of applying the operation themselves: operations like
+// LPUSH or INCR depend on the state they start from, so replicas applying
+// them independently drift apart as soon as one misses or reorders a write.
+func (m *Master) forwardWrite(w http.ResponseWriter, r *http.Request, key, path string, body []byte) {
+	startTime := time.Now()
+	ns := namespaceOf(r)
+	defer m.invalidateHotKey(ns, key)()
+	m.leases.release(routingKey(ns, key)) // e.g. EXPIRE starts a new refresh cycle
+
+	nodes, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	res := m.send(ns, nodes[0], r.Method, path, body)
+	if res.err != nil {
+		log.Printf("%s %s: primary replica %s unavailable: %v", r.Method, path, nodes[0], res.err)
+		http.Error(w, "primary replica unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if res.ok() {
+		m.copyEntry(ns, key, nodes[0], nodes)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(res.status)
+	w.Write(res.body)
+	elapsedTime := time.Since(startTime).Seconds()
+	m.requests.WithLabelValues(r.Method, ns).Inc()
+	m.responseTime.WithLabelValues(r.Method, ns).Observe(elapsedTime)
+}
+
+// copyEntry makes the entry of key on node from, which has just applied a
+// write, the state of the other nodes. The copy keeps its version, and aux
+// nodes only import entries newer than their own, so an older copy never
+// replaces a newer one. If the write removed the key (e.g. it popped the
+// last element) the key is deleted from the other nodes. Copies of the same
+// key are serialised, so a delete cannot overtake a later copy. With dual
+// writes on, the previous owners of a migrating key get the copy as well.
+// Failures are only logged: the write has already been applied.
+func (m *Master) copyEntry(ns, key, from string, nodes []string) {
+	var to []string
+	for _, node := range nodes {
+		if node != from {
+			to = append(to, node)
+		}
+	}
+	if m.dualWrite {
+		to = append(to, m.readFallback(ns, key, nodes)...)
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	mu := &m.copyMu[crc32.ChecksumIEEE([]byte(routingKey(ns, key)))%uint32(len(m.copyMu))]
+	mu.Lock()
+	defer mu.Unlock()
+
+	path := "/data/" + url.PathEscape(key)
+	res := m.send(ns, from, http.MethodGet, path+"/entry", nil)
+	var resps []replicaResponse
+	switch {
+	case res.err == nil && res.status == http.StatusNotFound:
+		resps = m.sendAll(ns, to, http.MethodDelete, path, nil)
+	case !res.ok():
+		log.Printf("copying %s from %s failed: status=%d err=%v", key, from, res.status, res.err)
+		return
+	default:
+		resps = m.sendAll(ns, to, http.MethodPost, "/import", res.body)
+	}
+	for _, res := range resps {
+		if !res.ok() && res.status != http.StatusNotFound {
+			log.Printf("copying %s to %s failed: status=%d err=%v", key, res.node, res.status, res.err)
+		}
+	}
+}
+
+// forwardRead sends a read to the replicas of key in random order and relays
+// the first definitive answer. A 404 falls through to the next replica, and
+// then to the previous owners of a migrating range; any other client error
+// (e.g. wrong type) is relayed as is. A replica slower than usual is
+// hedged, see hedgedRead.
+func (m *Master) forwardRead(w http.ResponseWriter, r *http.Request, key, path string) {
+	startTime := time.Now()
+
+	ns := namespaceOf(r)
+	nodes, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
+	res, ok := m.hedgedRead(ns, nodes, m.readFallback(ns, key, nodes), path, func(res replicaResponse) bool {
+		return res.err == nil && res.status != http.StatusNotFound && res.status < 500
+	})
+	if ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+		elapsedTime := time.Since(startTime).Seconds()
+		m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+		m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+		return
+	}
+
+	elapsedTime := time.Since(startTime).Seconds()
+	m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+	http.Error(w, fmt.Sprintf("key %s not found", key), http.StatusNotFound)
+}
+
+// touchReplicas restarts the sliding expiry of key on every replica except
+// the one a read was served from, so the copies expire together.
+func (m *Master) touchReplicas(ns, key string, nodes []string, readFrom string) {
+	var others []string
+	for _, node := range nodes {
+		if node != readFrom {
+			others = append(others, node)
+		}
+	}
+	for _, res := range m.sendAll(ns, others, http.MethodPost, "/data/"+url.PathEscape(key)+"/touch", nil) {
+		if res.err != nil {
+			log.Printf("touch: replica %s unavailable: %v", res.node, res.err)
+		}
+	}
+}
+
+// TypedWrite forwards a data-type mutation (e.g. HSET) to every replica of
+// the key named in the path. Master and aux share the same route layout, so
+// the request URI is forwarded unchanged.
+func (m *Master) TypedWrite(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	m.forwardWrite(w, r, mux.Vars(r)["key"], r.URL.RequestURI(), body)
+}
+
+// TypedRead forwards a data-type read (e.g. HGETALL) to one replica of the
+// key named in the path.
+func (m *Master) TypedRead(w http.ResponseWriter, r *http.Request) {
+	m.forwardRead(w, r, mux.Vars(r)["key"], r.URL.RequestURI())
+}
+
+// ListPop handles LPOP/RPOP. A plain pop is applied on the primary replica
+// like any other mutation. A blocking pop (?timeout=<seconds>) waits on the
+// key's primary replica only, and stops waiting when the client goes away.
+// Once the element has been written to the client the list left behind is
+// copied to the other replicas. If the client went away before that, the
+// element is pushed back where it came from instead. Delivery is at most
+// once: an element written to a connection that breaks before the client
+// reads it is lost.
+func (m *Master) ListPop(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if r.URL.Query().Get("timeout") == "" {
+		m.forwardWrite(w, r, key, r.URL.RequestURI(), nil)
+		return
+	}
+
+	startTime := time.Now()
+	ns := namespaceOf(r)
+	nodes, err := m.hashring.GetNodes(routingKey(ns, key), m.replicationFactor)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Fall back to the next replica only if the primary is unreachable.
+	for _, node := range nodes {
+		res := m.sendContext(r.Context(), ns, node, r.Method, r.URL.RequestURI(), nil)
+		if res.err != nil {
+			if r.Context().Err() != nil {
+				return // the client is gone
+			}
+			log.Printf("blocking pop: replica %s unavailable: %v", node, res.err)
+			continue
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(res.status)
+		_, werr := w.Write(res.body)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		delivered := werr == nil && r.Context().Err() == nil
+		if res.ok() {
+			if delivered {
+				go m.copyEntry(ns, key, node, nodes)
+			} else {
+				go m.unpop(ns, node, key, r.URL.Path, res.body)
+			}
+		}
+		elapsedTime := time.Since(startTime).Seconds()
+		m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+		m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+		return
+	}
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+}
+
+// unpop pushes an element a client never received back onto the end of the
+// list on node it was popped from: the head for LPOP, the tail for RPOP.
+// popPath is the pop's path and popped the replica's answer.
+func (m *Master) unpop(ns, node, key, popPath string, popped []byte) {
+	var kv KeyVal
+	if err := json.Unmarshal(popped, &kv); err != nil {
+		log.Printf("blocking pop: cannot return an element to %s: %v", key, err)
+		return
+	}
+	end := "rpush"
+	if strings.HasSuffix(popPath, "/lpop") {
+		end = "lpush"
+	}
+	body, _ := json.Marshal(map[string][]string{"values": {kv.Value}})
+	res := m.send(ns, node, http.MethodPost, "/list/"+url.PathEscape(key)+"/"+end, body)
+	if !res.ok() {
+		log.Printf("blocking pop: failed to return an undelivered element to %s on %s: %v %s", key, node, res.err, res.body)
+	}
+}
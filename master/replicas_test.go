@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIncr_ReturnsPrimaryValue(t *testing.T) {
+	var versions []uint64
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/incr", r.URL.Path)
+		var inc Increment
+		json.NewDecoder(r.Body).Decode(&inc)
+		versions = append(versions, inc.Version)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"key":"hits","value":3}`))
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+
+	req := httptest.NewRequest(http.MethodPost, "/data/incr", strings.NewReader(`{"key":"hits","delta":1}`))
+	w := httptest.NewRecorder()
+
+	m.Incr(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"key":"hits","value":3}`, w.Body.String())
+	require.Len(t, versions, 1)
+	assert.NotZero(t, versions[0], "master should stamp a version")
+}
+
+func TestIncr_IncrementsOnlyThePrimary(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]string{}
+	newAux := func() *httptest.Server {
+		srv := httptest.NewUnstartedServer(nil)
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			got[srv.Listener.Addr().String()] = append(got[srv.Listener.Addr().String()], r.Method+" "+r.URL.Path)
+			mu.Unlock()
+			w.Write([]byte(`{"key":"hits","value":3}`))
+		})
+		srv.Start()
+		return srv
+	}
+	a, b := newAux(), newAux()
+	defer a.Close()
+	defer b.Close()
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(a.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(b.URL, "http://"))
+	nodes, err := m.hashring.GetNodes("hits", 2)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/data/incr", strings.NewReader(`{"key":"hits","delta":1}`))
+	w := httptest.NewRecorder()
+	m.Incr(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"POST /incr", "GET /data/hits/entry"}, got[nodes[0]])
+	assert.Equal(t, []string{"POST /import"}, got[nodes[1]], "the other replica takes the primary's value instead of incrementing")
+}
+
+func TestListPop_BlockingSyncsOnlyDeliveredElements(t *testing.T) {
+	requests := make(chan string, 8)
+	block := make(chan struct{})
+	newAux := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r.Method + " " + r.URL.RequestURI()
+			if r.URL.Query().Get("timeout") != "" {
+				select {
+				case <-block:
+				case <-r.Context().Done():
+					return
+				}
+			}
+			w.Write([]byte(`{"key":"q","value":"job"}`))
+		}))
+	}
+	a, b := newAux(), newAux()
+	defer a.Close()
+	defer b.Close()
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(a.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(b.URL, "http://"))
+	pop := func(ctx context.Context) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/list/q/lpop?timeout=5", nil).WithContext(ctx)
+		w := httptest.NewRecorder()
+		m.ListPop(w, mux.SetURLVars(req, map[string]string{"key": "q"}))
+		return w
+	}
+
+	// The client gives up while the primary is still waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requests
+		cancel()
+	}()
+	pop(ctx)
+	select {
+	case req := <-requests:
+		t.Fatalf("a pop the client never received reached a replica: %s", req)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(block)
+	w := pop(context.Background())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "POST /list/q/lpop?timeout=5", <-requests)
+	for _, want := range []string{"GET /data/q/entry", "POST /import"} {
+		select {
+		case req := <-requests:
+			assert.Equal(t, want, req, "the list left behind is copied to the other replica")
+		case <-time.After(time.Second):
+			t.Fatal("the other replica was not synced")
+		}
+	}
+}
+
+func TestTypedWrite_CopiesPrimaryStateToReplicas(t *testing.T) {
+	var mu sync.Mutex
+	got := map[string][]string{}
+	entry := "entry of q"
+	newAux := func() *httptest.Server {
+		srv := httptest.NewUnstartedServer(nil)
+		srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			mu.Lock()
+			got[srv.Listener.Addr().String()] = append(got[srv.Listener.Addr().String()], r.Method+" "+r.URL.Path+" "+string(body))
+			mu.Unlock()
+			switch {
+			case r.URL.Path == "/data/q/entry" && entry == "":
+				http.NotFound(w, r)
+			case r.URL.Path == "/data/q/entry":
+				w.Write([]byte(entry))
+			default:
+				w.Write([]byte(`{"key":"q","length":1}`))
+			}
+		})
+		srv.Start()
+		return srv
+	}
+	a, b := newAux(), newAux()
+	defer a.Close()
+	defer b.Close()
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(a.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(b.URL, "http://"))
+	nodes, err := m.hashring.GetNodes("q", 2)
+	require.NoError(t, err)
+	push := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/list/q/rpush", strings.NewReader(`{"values":["job"]}`))
+		w := httptest.NewRecorder()
+		m.TypedWrite(w, mux.SetURLVars(req, map[string]string{"key": "q"}))
+		return w
+	}
+
+	w := push()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{`POST /list/q/rpush {"values":["job"]}`, "GET /data/q/entry "}, got[nodes[0]])
+	assert.Equal(t, []string{"POST /import entry of q"}, got[nodes[1]], "the other replica receives the primary's state, not the push")
+
+	// A write that removes the key removes it from the other replicas too.
+	got = map[string][]string{}
+	entry = ""
+	push()
+	assert.Equal(t, []string{"DELETE /data/q "}, got[nodes[1]])
+
+	// Without the primary the write is refused rather than applied elsewhere.
+	got = map[string][]string{}
+	for _, srv := range []*httptest.Server{a, b} {
+		if srv.Listener.Addr().String() == nodes[0] {
+			srv.Close()
+		}
+	}
+	w = push()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Empty(t, got[nodes[1]])
+}
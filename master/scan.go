@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// ScanPage is one page of a cluster-wide key scan. A Cursor of "0" means the
+// scan is complete.
+type ScanPage struct {
+	Cursor string   `json:"cursor"`
+	Keys   []string `json:"keys"`
+}
+
+// scanCursor is the decoded form of a master scan cursor: the aux node being
+// walked and that node's own opaque cursor.
+type scanCursor struct {
+	Node   string `json:"node"`
+	Cursor string `json:"cursor"`
+}
+
+// Scan returns one page of keys across the cluster (?cursor=&count=&match=
+// &type=). Aux nodes are walked one at a time in sorted order, each with its
+// own cursor. Because every key lives on several replicas, a node only
+// reports the keys it is the primary replica for, so each key is returned
+// once. Pages may be short, or empty, while the cursor is still non-zero.
+func (m *Master) Scan(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	q := r.URL.Query()
+
+	pos, err := decodeScanCursor(q.Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	nodes := m.hashring.Nodes()
+	i := sort.SearchStrings(nodes, pos.Node)
+	if i < len(nodes) && nodes[i] != pos.Node {
+		// The node we were walking left the ring; its keys now belong to the
+		// remaining replicas, so carry on with the next node from scratch.
+		pos.Cursor = "0"
+	}
+	if i >= len(nodes) {
+		writeScanPage(w, ScanPage{Cursor: "0", Keys: []string{}})
+		return
+	}
+	node := nodes[i]
+
+	params := url.Values{}
+	params.Set("cursor", pos.Cursor)
+	for _, name := range []string{"count", "match", "type"} {
+		if v := q.Get(name); v != "" {
+			params.Set(name, v)
+		}
+	}
+	ns := namespaceOf(r)
+	res := m.send(ns, node, http.MethodGet, "/scan?"+params.Encode(), nil)
+	if res.err != nil {
+		http.Error(w, fmt.Sprintf("aux node %s unavailable, retry the same cursor", node), http.StatusServiceUnavailable)
+		return
+	}
+	if !res.ok() {
+		w.WriteHeader(res.status)
+		w.Write(res.body)
+		return
+	}
+
+	var auxPage ScanPage
+	if err := json.Unmarshal(res.body, &auxPage); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	page := ScanPage{Keys: make([]string, 0, len(auxPage.Keys))}
+	for _, key := range auxPage.Keys {
+		if owner, err := m.hashring.GetNode(routingKey(ns, key)); err == nil && owner == node {
+			page.Keys = append(page.Keys, key)
+		}
+	}
+	switch {
+	case auxPage.Cursor != "0":
+		page.Cursor = encodeScanCursor(scanCursor{Node: node, Cursor: auxPage.Cursor})
+	case i+1 < len(nodes):
+		page.Cursor = encodeScanCursor(scanCursor{Node: nodes[i+1], Cursor: "0"})
+	default:
+		page.Cursor = "0"
+	}
+
+	writeScanPage(w, page)
+	elapsedTime := time.Since(startTime).Seconds()
+	m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+}
+
+func writeScanPage(w http.ResponseWriter, page ScanPage) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func encodeScanCursor(c scanCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeScanCursor(raw string) (scanCursor, error) {
+	if raw == "" || raw == "0" {
+		return scanCursor{Cursor: "0"}, nil
+	}
+	var c scanCursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err == nil {
+		err = json.Unmarshal(data, &c)
+	}
+	if err != nil || c.Node == "" {
+		return scanCursor{}, fmt.Errorf("invalid cursor %q", raw)
+	}
+	return c, nil
+}
+
+// DeleteMatching removes every key with the given ?prefix= and/or matching
+// the glob ?match= from every aux node, or only counts them with
+// ?dry_run=true. The count is of distinct keys, not of replica copies.
+// If any node cannot be reached the others are still cleaned and 503 is
+// returned; the operation is idempotent, so the caller can simply retry.
+func (m *Master) DeleteMatching(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	q := r.URL.Query()
+	if q.Get("prefix") == "" && q.Get("match") == "" {
+		http.Error(w, "prefix or match is required", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := q.Get("dry_run") == "true"
+	count, err := m.deleteEverywhere(namespaceOf(r), "/data?"+q.Encode(), dryRun)
+	elapsedTime := time.Since(startTime).Seconds()
+	m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"count": count, "dry_run": dryRun})
+}
+
+// deleteEverywhere sends a delete in namespace ns to every aux node on the
+// ring. Each node answers with the keys it removed; replicas report the same
+// key, so the result is the number of distinct keys. A dry run only counts,
+// so it leaves the copies of hot keys alone.
+func (m *Master) deleteEverywhere(ns, path string, dryRun bool) (int, error) {
+	if !dryRun {
+		// The delete may hit copies of hot keys; they are remade after it.
+		defer m.invalidateHotKeys()()
+	}
+	resps := m.sendAll(ns, m.hashring.Nodes(), http.MethodDelete, path, nil)
+
+	deleted := make(map[string]struct{})
+	var failed []string
+	for _, res := range resps {
+		var result struct {
+			Keys []string `json:"keys"`
+		}
+		if !res.ok() || json.Unmarshal(res.body, &result) != nil {
+			log.Printf("delete %s: aux %s failed: status=%d err=%v", path, res.node, res.status, res.err)
+			failed = append(failed, res.node)
+			continue
+		}
+		for _, key := range result.Keys {
+			deleted[key] = struct{}{}
+		}
+	}
+	if len(failed) > 0 {
+		return len(deleted), fmt.Errorf("aux nodes %v unavailable, retry", failed)
+	}
+	return len(deleted), nil
+}
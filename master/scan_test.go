@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScan_DedupsReplicas(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	fakeAux := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/scan", r.URL.Path)
+			assert.Equal(t, "user:*", r.URL.Query().Get("match"))
+			// Both replicas hold every key and answer in one page.
+			json.NewEncoder(w).Encode(ScanPage{Cursor: "0", Keys: keys})
+		}))
+	}
+	aux1, aux2 := fakeAux(), fakeAux()
+	defer aux1.Close()
+	defer aux2.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux1.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(aux2.URL, "http://"))
+
+	seen := make(map[string]int)
+	cursor, pages := "0", 0
+	for {
+		req := httptest.NewRequest(http.MethodGet, "/scan?match=user:*&cursor="+cursor, nil)
+		w := httptest.NewRecorder()
+		m.Scan(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var page ScanPage
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		for _, key := range page.Keys {
+			seen[key]++
+		}
+		pages++
+		if cursor = page.Cursor; cursor == "0" {
+			break
+		}
+	}
+
+	assert.Equal(t, 2, pages, "one page per aux node")
+	assert.Len(t, seen, len(keys))
+	for key, n := range seen {
+		assert.Equal(t, 1, n, "key %s returned more than once", key)
+	}
+}
+
+func TestScan_InvalidCursor(t *testing.T) {
+	m := NewMaster("primary", "")
+	req := httptest.NewRequest(http.MethodGet, "/scan?cursor=bogus", nil)
+	w := httptest.NewRecorder()
+	m.Scan(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestDeleteMatching_CountsDistinctKeys(t *testing.T) {
+	fakeAux := func(keys string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, http.MethodDelete, r.Method)
+			assert.Equal(t, "user:42:", r.URL.Query().Get("prefix"))
+			w.Write([]byte(`{"count":2,"keys":` + keys + `}`))
+		}))
+	}
+	// The two nodes hold overlapping replicas.
+	aux1 := fakeAux(`["user:42:a","user:42:b"]`)
+	aux2 := fakeAux(`["user:42:b","user:42:c"]`)
+	defer aux1.Close()
+	defer aux2.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux1.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(aux2.URL, "http://"))
+
+	req := httptest.NewRequest(http.MethodDelete, "/data?prefix=user:42:", nil)
+	w := httptest.NewRecorder()
+	m.DeleteMatching(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"count":3,"dry_run":false}`, w.Body.String())
+}
+
+func TestDeleteMatching_DryRunKeepsHotCopies(t *testing.T) {
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"count":1,"keys":["k"],"dry_run":true}`))
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	m.hot = newHotKeyTracker(10, 8)
+	rk := routingKey(DefaultNamespace, "k")
+	for i := 0; i < 100; i++ {
+		m.recordRead(DefaultNamespace, "k")
+	}
+	m.hot.rotate(m.hot.started.Add(time.Second))
+	gen, ok := m.hot.generation(rk)
+	require.True(t, ok)
+	require.True(t, m.hot.markSpread(rk, gen, []string{"copy:1"}))
+
+	w := httptest.NewRecorder()
+	m.DeleteMatching(w, httptest.NewRequest(http.MethodDelete, "/data?prefix=k&dry_run=true", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []string{"copy:1"}, m.hotCopies(DefaultNamespace, "k", nil), "a dry run dropped the hot copies")
+
+	w = httptest.NewRecorder()
+	m.DeleteMatching(w, httptest.NewRequest(http.MethodDelete, "/data?prefix=k", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, m.hotCopies(DefaultNamespace, "k", nil))
+}
+
+func TestDeleteMatching_RequiresFilter(t *testing.T) {
+	m := NewMaster("primary", "")
+	req := httptest.NewRequest(http.MethodDelete, "/data", nil)
+	w := httptest.NewRecorder()
+	m.DeleteMatching(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Write modes of the backing store.
+const (
+	WriteThrough = "through" // the store accepts a write before the cache applies it
+	WriteBehind  = "behind"  // the cache applies a write and the store gets it later
+)
+
+// sinkTimeout bounds one call to the backing store.
+const sinkTimeout = 30 * time.Second
+
+// SinkOp is one change forwarded to the backing store.
+type SinkOp struct {
+	Op        string `json:"op"` // "put" or "delete"
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	TTL       int    `json:"ttl,omitempty"`
+	Version   uint64 `json:"version,omitempty"` // lets the store ignore changes older than what it holds
+}
+
+// Sink is the backing store the cache sits in front of. Write must apply
+// every op or return an error; in write-behind mode a batch that failed is
+// sent again, so applying an op twice must be harmless.
+type Sink interface {
+	Write(ctx context.Context, ops []SinkOp) error
+}
+
+// HTTPSink posts batches of ops as a JSON array to a URL. Any 2xx answer
+// means the whole batch was applied.
+type HTTPSink struct {
+	client *http.Client
+	url    string
+}
+
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{client: &http.Client{}, url: url}
+}
+
+func (s *HTTPSink) Write(ctx context.Context, ops []SinkOp) error {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("backing store returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// EnableWriteThrough forwards every Put, Delete and BulkPut to s before it
+// is applied to the cache; a write the store rejects is not cached.
+func (m *Master) EnableWriteThrough(s Sink) {
+	m.sink, m.writeMode = s, WriteThrough
+}
+
+// EnableWriteBehind queues every Put, Delete and BulkPut applied to the
+// cache in a durable queue at path, and forwards them to s in batches of up
+// to batch ops in the background, retrying until s accepts them.
+func (m *Master) EnableWriteBehind(s Sink, path string, batch int) error {
+	q, err := openWriteQueue(path)
+	if err != nil {
+		return err
+	}
+	m.sink, m.writeMode, m.writeQueue = s, WriteBehind, q
+	go q.run(s, batch, func(n int, err error) {
+		if err != nil {
+			log.Printf("write-behind: backing store rejected %d changes, retrying: %v", n, err)
+			m.sinkOps.WithLabelValues(WriteBehind, "error").Add(float64(n))
+			return
+		}
+		m.sinkOps.WithLabelValues(WriteBehind, "ok").Add(float64(n))
+	})
+	return nil
+}
+
+// DrainWriteBehind waits up to timeout for the queued changes to reach the
+// backing store, then stops the queue. Changes still queued stay on disk
+// and are sent after the next start.
+func (m *Master) DrainWriteBehind(timeout time.Duration) {
+	if m.writeQueue == nil {
+		return
+	}
+	if left := m.writeQueue.drain(timeout); left > 0 {
+		log.Printf("write-behind: %d changes still queued at shutdown, kept in %s", left, m.writeQueue.path)
+	}
+}
+
+// WriteBehindBacklog returns how many changes wait for the backing store.
+func (m *Master) WriteBehindBacklog() int {
+	if m.writeQueue == nil {
+		return 0
+	}
+	return m.writeQueue.backlog()
+}
+
+// writeThrough sends ops to the backing store in write-through mode and is
+// a no-op otherwise.
+func (m *Master) writeThrough(ops ...SinkOp) error {
+	if m.writeMode != WriteThrough || len(ops) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	if err := m.sink.Write(ctx, ops); err != nil {
+		m.sinkOps.WithLabelValues(WriteThrough, "error").Add(float64(len(ops)))
+		return err
+	}
+	m.sinkOps.WithLabelValues(WriteThrough, "ok").Add(float64(len(ops)))
+	return nil
+}
+
+// writeBehind queues ops applied to the cache in write-behind mode and is a
+// no-op otherwise.
+func (m *Master) writeBehind(ops ...SinkOp) {
+	if m.writeMode != WriteBehind || len(ops) == 0 {
+		return
+	}
+	if err := m.writeQueue.append(ops); err != nil {
+		log.Printf("write-behind: failed to queue %d changes, they will not reach the backing store: %v", len(ops), err)
+		m.sinkOps.WithLabelValues(WriteBehind, "dropped").Add(float64(len(ops)))
+	}
+}
+
+func putOp(ns string, kv KeyVal) SinkOp {
+	return SinkOp{Op: "put", Namespace: ns, Key: kv.Key, Value: kv.Value, TTL: kv.TTL, Version: kv.Version}
+}
+
+func deleteOp(ns, key string, version uint64) SinkOp {
+	return SinkOp{Op: "delete", Namespace: ns, Key: key, Version: version}
+}
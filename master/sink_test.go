@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sinkFunc is a Sink backed by a function.
+type sinkFunc func(ops []SinkOp) error
+
+func (f sinkFunc) Write(ctx context.Context, ops []SinkOp) error { return f(ops) }
+
+func TestPut_WriteThrough(t *testing.T) {
+	var auxWrites atomic.Int32
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auxWrites.Add(1)
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	var stored []SinkOp
+	storeErr := errors.New("store down")
+	m.EnableWriteThrough(sinkFunc(func(ops []SinkOp) error {
+		if storeErr != nil {
+			return storeErr
+		}
+		stored = append(stored, ops...)
+		return nil
+	}))
+	put := func() int {
+		w := httptest.NewRecorder()
+		m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v","ttl":60}`)))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusBadGateway, put())
+	assert.Equal(t, int32(0), auxWrites.Load(), "a write the store rejected was cached")
+
+	storeErr = nil
+	assert.Equal(t, http.StatusOK, put())
+	assert.Equal(t, int32(1), auxWrites.Load())
+	require.Len(t, stored, 1)
+	assert.Equal(t, "put", stored[0].Op)
+	assert.Equal(t, "k", stored[0].Key)
+	assert.Equal(t, "v", stored[0].Value)
+	assert.Equal(t, 60, stored[0].TTL)
+	assert.NotZero(t, stored[0].Version)
+}
+
+func TestPut_ConditionalWriteThroughRevertsRejectedWrite(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Query().Get("previous") == "true" {
+			w.Write([]byte(`{"version":5,"previous":{"Key":"k","Value":"old"}}`))
+		}
+	}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	m.EnableWriteThrough(sinkFunc(func(ops []SinkOp) error { return errors.New("store down") }))
+
+	w := httptest.NewRecorder()
+	m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v","cond":"xx"}`)))
+
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+	assert.Equal(t, []string{"POST /data?previous=true", "POST /data/k/revert"}, paths,
+		"the rejected write should be reverted, not deleted")
+}
+
+func TestWriteBehind_RetriesAndDrains(t *testing.T) {
+	aux := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer aux.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux.URL, "http://"))
+	var mu sync.Mutex
+	var stored []SinkOp
+	calls := 0
+	path := t.TempDir() + "/queue.log"
+	require.NoError(t, m.EnableWriteBehind(sinkFunc(func(ops []SinkOp) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if calls++; calls == 1 {
+			return errors.New("store down")
+		}
+		stored = append(stored, ops...)
+		return nil
+	}), path, 10))
+
+	w := httptest.NewRecorder()
+	m.Put(w, httptest.NewRequest(http.MethodPost, "/data", strings.NewReader(`{"key":"k","value":"v"}`)))
+	require.Equal(t, http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	m.Delete(w, mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/data/gone", nil), map[string]string{"key": "gone"}))
+
+	m.DrainWriteBehind(5 * time.Second)
+	assert.Equal(t, 0, m.WriteBehindBacklog())
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, stored, 2)
+	assert.Equal(t, "k", stored[0].Key)
+	assert.Equal(t, "delete", stored[1].Op)
+	assert.Equal(t, "gone", stored[1].Key)
+}
+
+func TestBulkPut_ChecksReplicaStatusAndQueuesAppliedWrites(t *testing.T) {
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(ok.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(down.URL, "http://"))
+	// A sink that never succeeds keeps the queued writes in the backlog.
+	require.NoError(t, m.EnableWriteBehind(sinkFunc(func(ops []SinkOp) error {
+		return errors.New("store down")
+	}), t.TempDir()+"/queue.log", 10))
+
+	// One replica down: the other applied the writes, so they are queued.
+	w := httptest.NewRecorder()
+	m.BulkPut(w, httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(`[{"key":"a","value":"1"},{"key":"b","value":"2"}]`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 2, m.WriteBehindBacklog())
+
+	// A replica refusing the batch is relayed, and nothing is queued.
+	refusing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `invalid key "a"`, http.StatusBadRequest)
+	}))
+	defer refusing.Close()
+	m.hashring.RemoveNode(strings.TrimPrefix(ok.URL, "http://"))
+	m.hashring.RemoveNode(strings.TrimPrefix(down.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(refusing.URL, "http://"))
+	w = httptest.NewRecorder()
+	m.BulkPut(w, httptest.NewRequest(http.MethodPost, "/bulk", strings.NewReader(`[{"key":"a","value":"1"}]`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "invalid key")
+	assert.Equal(t, 2, m.WriteBehindBacklog(), "a write no replica applied was queued")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// InvalidateTag removes every key carrying the tag named in the path from
+// every aux node and returns how many distinct keys were removed. Like
+// DeleteMatching it answers 503 if any node was unreachable.
+func (m *Master) InvalidateTag(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	tag := mux.Vars(r)["tag"]
+
+	count, err := m.deleteEverywhere(namespaceOf(r), "/tags/"+url.PathEscape(tag), false)
+	elapsedTime := time.Since(startTime).Seconds()
+	m.requests.WithLabelValues(r.Method, namespaceOf(r)).Inc()
+	m.responseTime.WithLabelValues(r.Method, namespaceOf(r)).Observe(elapsedTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"tag": tag, "count": count})
+}
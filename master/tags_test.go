@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidateTag_FansOutToAllNodes(t *testing.T) {
+	var paths []string
+	var mu sync.Mutex
+	fakeAux := func(keys string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+			mu.Unlock()
+			w.Write([]byte(`{"keys":` + keys + `}`))
+		}))
+	}
+	aux1 := fakeAux(`["page:/home","page:/p/1"]`)
+	aux2 := fakeAux(`["page:/p/1"]`)
+	defer aux1.Close()
+	defer aux2.Close()
+
+	m := NewMaster("primary", "")
+	m.hashring.AddNode(strings.TrimPrefix(aux1.URL, "http://"))
+	m.hashring.AddNode(strings.TrimPrefix(aux2.URL, "http://"))
+
+	req := mux.SetURLVars(httptest.NewRequest(http.MethodDelete, "/tags/product:1", nil), map[string]string{"tag": "product:1"})
+	w := httptest.NewRecorder()
+	m.InvalidateTag(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"tag":"product:1","count":2}`, w.Body.String())
+	assert.Equal(t, []string{"DELETE /tags/product:1", "DELETE /tags/product:1"}, paths)
+}
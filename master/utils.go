@@ -2,7 +2,9 @@ package main
 
 import (
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func getAuxServers() []string {
@@ -14,3 +16,12 @@ func getAuxServers() []string {
 	}
 	return result
 }
+
+// envSeconds reads a duration in whole seconds from the environment,
+// falling back to def seconds if it is unset or invalid.
+func envSeconds(name string, def int) time.Duration {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second
+	}
+	return time.Duration(def) * time.Second
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultQueueCompactSize is how many bytes of accepted changes may
+// accumulate at the head of the write-behind queue before it is compacted.
+const defaultQueueCompactSize = 16 << 20
+
+// writeQueue is the durable queue of write-behind mode. Changes are
+// appended to a file as JSON lines and consumed from its head once the
+// backing store has accepted them. The position of the first line not yet
+// accepted is kept in <path>.offset, so a restarted master resumes where it
+// stopped. If the master stops after the store accepted a batch but before
+// the offset was saved, that batch is sent again.
+//
+// Appends reach the OS immediately and are fsynced once a second, so a
+// master crash loses nothing and a power failure at most one second.
+//
+// The file starts over whenever the queue empties. A queue that never
+// empties is compacted instead once the accepted lines at its head pass
+// compactAt bytes: the rest is copied to <path>.next, which is renamed over
+// <path>.
+type writeQueue struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	offset  int64 // start of the first line the store has not accepted
+	end     int64 // end of the last line
+	pending int   // lines between offset and end
+
+	compactAt int64 // accepted bytes at the head that trigger a compaction
+
+	wake    chan struct{} // signalled by append
+	stop    chan struct{}
+	stopped chan struct{} // closed when run returns
+}
+
+// openWriteQueue opens the queue at path, keeping the changes a previous
+// run left in it. A torn line at the end, left by a crash mid-append, is
+// dropped.
+func openWriteQueue(path string) (*writeQueue, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := readQueueOffset(path + ".offset")
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	// Find the end of the last complete line and count the lines after
+	// the offset.
+	var end int64
+	pending := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		if end >= offset {
+			pending++
+		}
+		end += int64(len(line))
+	}
+	if offset > end {
+		// The file was replaced or truncated behind our back.
+		offset, pending = 0, 0
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &writeQueue{
+		compactAt: defaultQueueCompactSize,
+		path:      path,
+		file:      f,
+		offset:    offset,
+		end:       end,
+		pending:   pending,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}, nil
+}
+
+func readQueueOffset(path string) (int64, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// saveOffsetLocked records where the unaccepted changes start. Caller must
+// hold q.mu.
+func (q *writeQueue) saveOffsetLocked(offset int64) error {
+	tmp := q.path + ".offset.tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatInt(offset, 10)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path+".offset")
+}
+
+// append adds ops to the end of the queue.
+func (q *writeQueue) append(ops []SinkOp) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf) // Encode ends each op with a newline
+	for _, op := range ops {
+		if err := enc.Encode(op); err != nil {
+			return err
+		}
+	}
+
+	q.mu.Lock()
+	n, err := q.file.WriteAt(buf.Bytes(), q.end)
+	if err != nil {
+		// Cut off a partial write so the next append starts on a line.
+		q.file.Truncate(q.end)
+		q.mu.Unlock()
+		return err
+	}
+	q.end += int64(n)
+	q.pending += len(ops)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek reads up to max ops from the head of the queue. It returns how many
+// lines it consumed, which can exceed len(ops) if a line is unreadable,
+// and where the next line starts.
+func (q *writeQueue) peek(max int) (ops []SinkOp, lines int, next int64) {
+	q.mu.Lock()
+	offset, end := q.offset, q.end
+	q.mu.Unlock()
+
+	r := bufio.NewReader(io.NewSectionReader(q.file, offset, end-offset))
+	next = offset
+	for len(ops) < max {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		next += int64(len(line))
+		lines++
+		var op SinkOp
+		if err := json.Unmarshal(line, &op); err != nil {
+			log.Printf("write-behind: skipping unreadable change at offset %d in %s: %v", next-int64(len(line)), q.path, err)
+			continue
+		}
+		ops = append(ops, op)
+	}
+	return ops, lines, next
+}
+
+// ack removes the lines before next, which the store has accepted. Once
+// the queue is empty the file starts over; once enough accepted lines
+// accumulate ahead of unaccepted ones, it is compacted. In both cases the
+// offset is reset before the file is replaced, so a crash in between can
+// only resend changes, never skip new ones.
+func (q *writeQueue) ack(lines int, next int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.offset = next
+	q.pending -= lines
+	if q.offset == q.end {
+		if err := q.saveOffsetLocked(0); err == nil {
+			if err := q.file.Truncate(0); err == nil {
+				q.offset, q.end = 0, 0
+				return nil
+			}
+		}
+	} else if q.offset >= q.compactAt {
+		if err := q.compactLocked(); err != nil {
+			log.Printf("write-behind: compaction of %s failed: %v", q.path, err)
+		} else {
+			return nil
+		}
+	}
+	return q.saveOffsetLocked(q.offset)
+}
+
+// compactLocked copies the unaccepted lines to <path>.next and renames it
+// over <path>. Caller must hold q.mu.
+func (q *writeQueue) compactLocked() error {
+	next, err := os.OpenFile(q.path+".next", os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(next, io.NewSectionReader(q.file, q.offset, q.end-q.offset))
+	if err == nil {
+		err = next.Sync()
+	}
+	if err == nil {
+		err = q.saveOffsetLocked(0)
+	}
+	if err == nil {
+		err = os.Rename(q.path+".next", q.path)
+	}
+	if err != nil {
+		next.Close()
+		os.Remove(q.path + ".next")
+		return err
+	}
+	q.file.Close()
+	q.file = next
+	q.offset, q.end = 0, n
+	return nil
+}
+
+// backlog returns how many changes wait for the store.
+func (q *writeQueue) backlog() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func (q *writeQueue) sync() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.file.Sync(); err != nil {
+		log.Printf("write-behind: sync of %s failed: %v", q.path, err)
+	}
+}
+
+// run sends the queued changes to sink in batches of up to batch ops until
+// the queue is stopped. A batch the sink rejects is retried with a backoff
+// of up to 30 seconds. report is called with the outcome of every attempt.
+func (q *writeQueue) run(sink Sink, batch int, report func(n int, err error)) {
+	defer close(q.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	backoff := time.Second
+
+	for {
+		ops, lines, next := q.peek(batch)
+		if lines == 0 {
+			select {
+			case <-q.wake:
+			case <-ticker.C:
+				q.sync()
+			case <-q.stop:
+				return
+			}
+			continue
+		}
+
+		if len(ops) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+			err := sink.Write(ctx, ops)
+			cancel()
+			report(len(ops), err)
+			if err != nil {
+				select {
+				case <-time.After(backoff):
+				case <-q.stop:
+					return
+				}
+				if backoff *= 2; backoff > 30*time.Second {
+					backoff = 30 * time.Second
+				}
+				continue
+			}
+		}
+		backoff = time.Second
+		if err := q.ack(lines, next); err != nil {
+			log.Printf("write-behind: failed to record progress in %s, changes may be sent again: %v", q.path, err)
+		}
+	}
+}
+
+// drain waits up to timeout for the queue to empty, then stops run and
+// closes the file. It returns how many changes are left.
+func (q *writeQueue) drain(timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for q.backlog() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(q.stop)
+	<-q.stopped
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.file.Sync()
+	q.file.Close()
+	return q.pending
+}
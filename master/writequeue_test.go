@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteQueue_ResumesAfterRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q, err := openWriteQueue(path)
+	require.NoError(t, err)
+	require.NoError(t, q.append([]SinkOp{{Op: "put", Key: "a"}, {Op: "put", Key: "b"}, {Op: "delete", Key: "c"}}))
+	assert.Equal(t, 3, q.backlog())
+
+	ops, lines, next := q.peek(2)
+	require.Len(t, ops, 2)
+	assert.Equal(t, "b", ops[1].Key)
+	require.NoError(t, q.ack(lines, next))
+	q.file.Close()
+
+	// A crash mid-append leaves a torn line behind.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(t, err)
+	f.WriteString(`{"op":"put","ke`)
+	f.Close()
+
+	q, err = openWriteQueue(path)
+	require.NoError(t, err)
+	assert.Equal(t, 1, q.backlog())
+	ops, lines, next = q.peek(10)
+	require.Len(t, ops, 1)
+	assert.Equal(t, SinkOp{Op: "delete", Key: "c"}, ops[0])
+
+	// Once drained the file starts over.
+	require.NoError(t, q.ack(lines, next))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+	assert.Equal(t, 0, q.backlog())
+	q.file.Close()
+}
+
+func TestWriteQueue_CompactsBusyQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q, err := openWriteQueue(path)
+	require.NoError(t, err)
+	q.compactAt = 1
+	require.NoError(t, q.append([]SinkOp{{Op: "put", Key: "a"}, {Op: "put", Key: "b"}}))
+
+	// The queue never empties, yet the accepted head is dropped.
+	ops, lines, next := q.peek(1)
+	require.Len(t, ops, 1)
+	require.NoError(t, q.ack(lines, next))
+	require.NoError(t, q.append([]SinkOp{{Op: "put", Key: "c"}}))
+	assert.Zero(t, q.offset)
+	q.file.Close()
+
+	q, err = openWriteQueue(path)
+	require.NoError(t, err)
+	ops, _, _ = q.peek(10)
+	assert.Equal(t, []SinkOp{{Op: "put", Key: "b"}, {Op: "put", Key: "c"}}, ops)
+	q.file.Close()
+}